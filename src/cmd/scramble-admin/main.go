@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"scramble"
+)
+
+const usage = `Usage:
+  scramble-admin reset-2fa <user>   turns off two-factor login for a user
+                                    who lost their app and recovery codes
+
+The database comes from ~/.scramble/config.json, like for the server.
+`
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := scramble.CheckMigrations(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not running: %v\n", err)
+		os.Exit(1)
+	}
+	var err error
+	switch os.Args[1] {
+	case "reset-2fa":
+		err = resetTwoFactor(os.Args[2])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// Check who is asking before running this: whoever has the passphrase
+// can log in with it alone afterwards.
+func resetTwoFactor(token string) error {
+	if _, err := scramble.LoadUserID(token); err != nil {
+		return fmt.Errorf("user %s: %w", token, err)
+	}
+	if err := scramble.DeleteTwoFactor(token); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Two-factor is off for %s, they can enroll again after logging in\n", token)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"scramble"
+)
+
+const usage = `Usage:
+  scramble-backup backup <file>    writes a snapshot of this instance
+  scramble-backup restore <file>   restores a snapshot into a new database
+
+Use - as the file for stdout or stdin.
+The database comes from ~/.scramble/config.json, like for the server.
+`
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = backup(os.Args[2])
+	case "restore":
+		err = restore(os.Args[2])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// Writes to a temp file first, so that
+// a failed backup never looks like a good one
+func backup(path string) error {
+	if path == "-" {
+		return scramble.WriteBackup(os.Stdout)
+	}
+	tmpPath := path + ".partial"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = scramble.WriteBackup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backup written to %s\n", path)
+	return os.Rename(tmpPath, path)
+}
+
+func restore(path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	err := scramble.RestoreBackup(r)
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Restored %s, start the server to use it\n", path)
+	}
+	return err
+}
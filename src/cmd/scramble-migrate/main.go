@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"scramble"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage:
+  scramble-migrate status           lists applied and pending migrations
+  scramble-migrate sql <version>    prints the SQL a migration runs, up and down
+  scramble-migrate up [-n]          runs the pending migrations
+  scramble-migrate down [-n] <n>    rolls back the last n migrations
+
+With -n, up and down only print the SQL they would run.
+The database comes from ~/.scramble/config.json, like for the server.
+Unless DbManualMigrations is set there, the other scramble commands
+migrate the database as they start. This one never does by itself.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+	dryRun := len(args) > 0 && args[0] == "-n"
+	if dryRun {
+		args = args[1:]
+	}
+
+	// before anything opens the store, which would migrate it
+	scramble.GetConfig().DbManualMigrations = true
+
+	var err error
+	switch {
+	case command == "status" && len(args) == 0 && !dryRun:
+		err = status()
+	case command == "sql" && len(args) == 1 && !dryRun:
+		err = printSQL(args[0])
+	case command == "up" && len(args) == 0:
+		err = up(dryRun)
+	case command == "down" && len(args) == 1:
+		err = down(args[0], dryRun)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
+func status() error {
+	statuses, err := scramble.LoadMigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		when := "pending"
+		if s.Applied {
+			when = time.Unix(s.UnixTime, 0).UTC().Format("2006-01-02 15:04")
+		}
+		var notes []string
+		if s.HasCode {
+			notes = append(notes, "runs code")
+		}
+		if !s.CanRollBack {
+			notes = append(notes, "no down step")
+		}
+		if s.Problem != "" {
+			notes = append(notes, "PROBLEM: "+s.Problem)
+		}
+		fmt.Printf("%4d  %-16s  %s", s.Version, when, s.Name)
+		if len(notes) > 0 {
+			fmt.Printf("  (%s)", strings.Join(notes, ", "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func printSQL(arg string) error {
+	statuses, err := scramble.LoadMigrationStatus()
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(arg)
+	if err != nil || version < 1 || version > len(statuses) {
+		return fmt.Errorf("no migration %s, see status", arg)
+	}
+	s := statuses[version-1]
+	printStatements(s, "up", s.SQL, s.HasCode)
+	if s.CanRollBack {
+		printStatements(s, "down", s.DownSQL, s.HasDownCode)
+	} else {
+		fmt.Printf("-- %d %s has no down step\n", s.Version, s.Name)
+	}
+	return nil
+}
+
+func up(dryRun bool) error {
+	statuses, err := scramble.LoadMigrationStatus()
+	if err != nil {
+		return err
+	}
+	if err = checkProblems(statuses); err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range statuses {
+		if !s.Applied {
+			pending++
+			if dryRun {
+				printStatements(s, "up", s.SQL, s.HasCode)
+			}
+		}
+	}
+	if pending == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to migrate")
+		return nil
+	}
+	if dryRun {
+		return nil
+	}
+	if err = scramble.Migrate(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Ran %d migrations\n", pending)
+	return nil
+}
+
+func down(arg string, dryRun bool) error {
+	steps, err := strconv.Atoi(arg)
+	if err != nil || steps < 1 {
+		return fmt.Errorf("%s isn't a number of migrations", arg)
+	}
+	statuses, err := scramble.LoadMigrationStatus()
+	if err != nil {
+		return err
+	}
+	if err = checkProblems(statuses); err != nil {
+		return err
+	}
+	applied := 0
+	for _, s := range statuses {
+		if s.Applied {
+			applied++
+		}
+	}
+	if steps > applied {
+		return fmt.Errorf("only %d migrations have run", applied)
+	}
+	if !dryRun {
+		if err = scramble.RollBackMigrations(steps); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Rolled back %d migrations\n", steps)
+		return nil
+	}
+	for version := applied; version > applied-steps; version-- {
+		s := statuses[version-1]
+		if !s.CanRollBack {
+			return fmt.Errorf("%d %s has no down step", s.Version, s.Name)
+		}
+		printStatements(s, "down", s.DownSQL, s.HasDownCode)
+	}
+	return nil
+}
+
+// up and down refuse to run when the history doesn't match the code.
+// Checking first explains why.
+func checkProblems(statuses []scramble.MigrationStatus) error {
+	for _, s := range statuses {
+		if s.Problem != "" {
+			return errors.New("the database doesn't match the code, see status")
+		}
+	}
+	return nil
+}
+
+func printStatements(s scramble.MigrationStatus, direction string, statements []string, hasCode bool) {
+	fmt.Printf("-- %d %s, %s\n", s.Version, s.Name, direction)
+	for _, statement := range statements {
+		statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+		fmt.Printf("%s;\n", statement)
+	}
+	if hasCode {
+		fmt.Printf("-- then runs Go code, see the %s migration in src/scramble\n", s.Name)
+	}
+	fmt.Println()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"scramble"
 )
 
@@ -10,6 +11,11 @@ const unreadNoticeSubject = "Scramble.io | You've got mail"
 const unreadNoticeBody = "You have new encrypted mail! Read it at https://scramble.io"
 
 func main() {
+	if err := scramble.CheckMigrations(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not running: %v\n", err)
+		os.Exit(1)
+	}
+
 	minAgeMins := 60
 	maxAgeMins := 60 * 48
 	fmt.Printf("Fetching users with unread email older than %d mins "+
@@ -17,7 +23,11 @@ func main() {
 
 	// TODO: probably use MailChimp instead, which has nice HTML
 	// email and an unsubscribe link
-	addresses := scramble.GetUsersWithUnreadMail(minAgeMins, maxAgeMins)
+	addresses, err := scramble.GetUsersWithUnreadMail(minAgeMins, maxAgeMins)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load users with unread mail: %v\n", err)
+		os.Exit(1)
+	}
 	for _, address := range addresses {
 		if address == "" {
 			continue
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"log"
 	"scramble"
 )
 
 func main() {
+	// with DbManualMigrations set, scramble-migrate up has to run first
+	if err := scramble.CheckMigrations(); err != nil {
+		log.Fatalf("Not starting: %v", err)
+	}
+
 	// SMTP Incoming Messages
 	scramble.StartSMTPServer()
 	scramble.StartSMTPSaver()
 
+	// Deletes mail past its retention period
+	scramble.StartJanitor()
+
 	// HTTP Static Files + REST API
 	scramble.StartHTTPServer()
 }
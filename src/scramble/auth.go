@@ -1,45 +1,171 @@
 package scramble
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 )
 
-// Checks cookies, returns the logged-in user
+// Logins last this long unless SessionHours in the config says otherwise
+const defaultSessionHours = 24
+
+// How much of the client's IP and User-Agent a session remembers
+const (
+	maxSessionIPLen        = 45
+	maxSessionUserAgentLen = 255
+)
+
+// Why authentication failed, as opposed to a database error
+type authError string
+
+func (e authError) Error() string {
+	return string(e)
+}
+
+// Checks the session header, or else the token and passphrase hash headers.
+// Returns the logged-in user.
 //
-// Returns nil and a descriptive error if authentication fails
+// Returns nil and a descriptive authError if authentication fails
 func authenticate(r *http.Request) (*UserID, error) {
+	if secret := r.Header.Get("x-scramble-session"); secret != "" {
+		return authenticateSession(secret, time.Now().Unix())
+	}
 	token := r.Header.Get("x-scramble-token")
 	if token == "" {
-		return nil, errors.New("Not logged in")
+		return nil, authError("Not logged in")
 	}
 	passHash := r.Header.Get("x-scramble-passHash")
 	passHashOld := r.Header.Get("x-scramble-passHashOld")
-	return authenticateUserPass(token, passHash, passHashOld)
+	code := r.Header.Get("x-scramble-code")
+	return authenticateUserPass(token, passHash, passHashOld, code, requestIP(r))
 }
 
-// Checks given username nad passphrase hash, returns the logged-in user
+// Checks given username nad passphrase hash, and the two-factor code
+// if the user has two-factor on. Returns the logged-in user
+// Failures from the client's IP count towards throttling, see throttle.go
 //
-// Returns nil and a descriptive error if authentication fails
-func authenticateUserPass(token string, passHash string, passHashOld string) (*UserID, error) {
+// Returns nil and a descriptive authError if authentication fails,
+// or a throttledError if it's too soon to try again
+func authenticateUserPass(token string, passHash string, passHashOld string, code string, ip string) (*UserID, error) {
+	if err := checkLoginThrottle(token, ip); err != nil {
+		return nil, err
+	}
+
 	// look up the user
-	userID := LoadUserID(token)
-	if userID == nil {
-		return nil, errors.New("User " + token + " not found")
+	userID, err := LoadUserID(token)
+	if errors.Is(err, ErrNotFound) {
+		recordLoginFailure("", ip)
+		return nil, authError("User " + token + " not found")
+	} else if err != nil {
+		return nil, err
 	}
 
 	// verify password
 	if (passHash == "" || passHash != userID.PasswordHash) &&
 	   (passHashOld == "" || passHashOld != userID.PasswordHashOld) {
-		return nil, errors.New("Incorrect passphrase")
+		recordLoginFailure(token, ip)
+		return nil, authError("Incorrect passphrase")
 	}
 
 	// check if the user is banned
-	if (userID.IsBanned) {
-		return nil, errors.New("User " + token + " has been banned. " +
-			"If you think this is in error, please address questions to hello@scramble.io")
+	if err := checkNotBanned(userID); err != nil {
+		return nil, err
+	}
+
+	// check the second factor, see totp.go.
+	// A missing code isn't a guess, clients send the passphrase first.
+	err = checkTwoFactor(token, code, time.Now().Unix())
+	var authErr authError
+	if errors.As(err, &authErr) && authErr != errTwoFactorNeeded {
+		recordLoginFailure(token, ip)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	// success
+	recordLoginSuccess(token)
 	return userID, nil
 }
+
+func checkNotBanned(userID *UserID) error {
+	if userID.IsBanned {
+		return authError("User " + userID.Token + " has been banned. " +
+			"If you think this is in error, please address questions to hello@scramble.io")
+	}
+	return nil
+}
+
+// Checks the secret of a session, returns the logged-in user
+// if the session exists and hasn't expired by now
+//
+// Returns nil and a descriptive authError if authentication fails
+func authenticateSession(secret string, now int64) (*UserID, error) {
+	session, err := LoadSession(hashSessionSecret(secret))
+	if errors.Is(err, ErrNotFound) || (err == nil && session.ExpiresTime <= now) {
+		return nil, authError("Session expired, please log in again")
+	} else if err != nil {
+		return nil, err
+	}
+	userID, err := LoadUserID(session.Token)
+	if errors.Is(err, ErrNotFound) {
+		return nil, authError("User " + session.Token + " not found")
+	} else if err != nil {
+		return nil, err
+	}
+	if err := checkNotBanned(userID); err != nil {
+		return nil, err
+	}
+	return userID, nil
+}
+
+// Starts a session for a user who just logged in with their passphrase hash.
+// Returns the session and its secret. The secret isn't stored anywhere,
+// only its hash is, so this is the one chance to hand it to the client.
+func createSession(token, ip, userAgent string, now int64) (*Session, string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, "", err
+	}
+	secret := hex.EncodeToString(random)
+	hours := GetConfig().SessionHours
+	if hours == 0 {
+		hours = defaultSessionHours
+	}
+	session := &Session{
+		Token:       token,
+		Hash:        hashSessionSecret(secret),
+		IP:          cleanSessionField(ip, maxSessionIPLen),
+		UserAgent:   cleanSessionField(userAgent, maxSessionUserAgentLen),
+		CreatedTime: now,
+		ExpiresTime: now + int64(hours)*60*60,
+	}
+	if err := CreateSession(session); err != nil {
+		return nil, "", err
+	}
+	return session, secret, nil
+}
+
+func hashSessionSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// IPs and user agents are only shown back to the user.
+// Keeps them printable ASCII and short enough for the session table.
+func cleanSessionField(value string, maxLen int) string {
+	value = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, value)
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	return value
+}
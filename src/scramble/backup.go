@@ -0,0 +1,444 @@
+/**
+ * Backs up and restores a whole Scramble instance: every table,
+ * the message bodies in the blob store, and the notary key.
+ *
+ * A backup is a gzipped tar file:
+ *   manifest.json        see backupManifest
+ *   tables/<table>.jsonl the column names, then one JSON array per row
+ *   blobs/<ref>          the blobs the email table refers to
+ *   notary_privkey       the notary's keys
+ *
+ * config.json is not included, it holds the database password
+ * and a restored server usually runs with its own.
+ * Nor are sessions, everyone logs in again after a restore.
+ */
+
+package scramble
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const backupFormat = 1
+
+// Tables in the order they are restored, so that foreign keys hold
+var backupTables = []struct {
+	name   string
+	serial string // auto-increment column, if any
+}{
+	{"user", ""},
+	{"two_factor", ""},
+	{"recovery_code", ""},
+	{"email", ""},
+	{"box", "id"},
+	{"label", "id"},
+	{"box_label", ""},
+	{"draft", ""},
+	{"search_token", ""},
+	{"name_resolution", ""},
+	{"mx_hosts", ""},
+}
+
+var regexColumnName = regexp.MustCompile(`^[a-z_]+$`)
+
+type backupManifest struct {
+	Format           int
+	DbDriver         string
+	MigrationVersion int // a backup restores only into the same version
+	UnixTime         int64
+	SMTPMxHost       string
+}
+
+// Writes a consistent snapshot of the database,
+// the blobs it refers to and the notary key to w
+func WriteBackup(w io.Writer) error {
+	s, ok := getStore().(*sqlStore)
+	if !ok {
+		return errors.New("the memory store has nothing to back up")
+	}
+	notaryKey, err := ioutil.ReadFile(notaryKeyFile())
+	if err != nil {
+		return err
+	}
+	return s.writeBackup(w, blobs, notaryKey, backupManifest{
+		DbDriver:   dbDriverName(GetConfig()),
+		SMTPMxHost: GetConfig().SMTPMxHost,
+	})
+}
+
+// Restores a backup into an empty database, the way
+// a fresh server migrates it. The notary key it replaces,
+// if any, is kept as notary_privkey.before-restore
+func RestoreBackup(r io.Reader) error {
+	s, ok := getStore().(*sqlStore)
+	if !ok {
+		return errors.New("can't restore into the memory store")
+	}
+	notaryKey, err := s.restoreBackup(r, blobs, dbDriverName(GetConfig()))
+	if err != nil {
+		return err
+	}
+	keyFile := notaryKeyFile()
+	oldKey, err := ioutil.ReadFile(keyFile)
+	if err == nil && !bytes.Equal(oldKey, notaryKey) {
+		err = os.Rename(keyFile, keyFile+".before-restore")
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(keyFile, notaryKey, 0600)
+}
+
+// "mysql" is the default DbDriver
+func dbDriverName(conf *Config) string {
+	if conf.DbDriver == "" {
+		return "mysql"
+	}
+	return conf.DbDriver
+}
+
+// All tables are read in one read-only transaction. With repeatable read
+// that sees a single snapshot, even while the server keeps writing.
+// SQLite ignores the options, but a read transaction on a WAL database
+// is a snapshot too.
+func (s *sqlStore) writeBackup(w io.Writer, b BlobStore, notaryKey []byte, manifest backupManifest) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return s.mapError(err)
+	}
+	defer tx.Rollback()
+
+	manifest.Format = backupFormat
+	manifest.UnixTime = time.Now().Unix()
+	err = tx.QueryRow("select version from migration").Scan(&manifest.MigrationVersion)
+	if err != nil {
+		return s.mapError(err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifestJSON, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	if err := writeTarFile(tw, "manifest.json", manifestJSON); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "notary_privkey", notaryKey); err != nil {
+		return err
+	}
+
+	bodyRefs := map[string]bool{}
+	for _, table := range backupTables {
+		err := s.backupTable(tx, tw, table.name, func(row map[string]interface{}) {
+			if ref, ok := row["body_ref"].(string); ok {
+				bodyRefs[ref] = true
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// blobs never change. if the janitor collected one since the
+	// snapshot was taken, because its email got deleted, this fails
+	// and the backup has to be run again.
+	for ref := range bodyRefs {
+		data, err := b.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "blobs/"+ref, data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// A tar header needs the size up front, so the table is dumped
+// to a temp file first. Tables can be bigger than memory.
+func (s *sqlStore) backupTable(tx *sql.Tx, tw *tar.Writer, table string, onRow func(map[string]interface{})) error {
+	tmp, err := ioutil.TempFile("", "scramble-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	w := bufio.NewWriter(tmp)
+	if err := s.dumpTable(tx, table, w, onRow); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "tables/" + table + ".jsonl",
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = io.Copy(tw, tmp)
+	}
+	return err
+}
+
+// Writes the column names, then each row, as JSON arrays.
+// Calls onRow with each row by column name.
+func (s *sqlStore) dumpTable(tx *sql.Tx, table string, w io.Writer, onRow func(map[string]interface{})) error {
+	rows, err := tx.Query(s.dialect.rebind("SELECT * FROM `" + table + "`"))
+	if err != nil {
+		return s.mapError(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return s.mapError(err)
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(columns); err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return s.mapError(err)
+		}
+		row := map[string]interface{}{}
+		for i, value := range values {
+			// the MySQL driver returns text as bytes
+			if bytes, ok := value.([]byte); ok {
+				values[i] = string(bytes)
+			}
+			row[columns[i]] = values[i]
+		}
+		onRow(row)
+		if err := enc.Encode(values); err != nil {
+			return err
+		}
+	}
+	return s.mapError(rows.Err())
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	return err
+}
+
+// Restores all tables in one transaction, and returns the notary key.
+// Blobs are saved as they come, if the restore fails
+// the janitor collects them.
+func (s *sqlStore) restoreBackup(r io.Reader, b BlobStore, driver string) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	// the manifest comes first, check it before touching anything
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != "manifest.json" {
+		return nil, errors.New("not a Scramble backup, manifest.json missing")
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	if err := s.checkRestore(&manifest, driver); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, s.mapError(err)
+	}
+	defer tx.Rollback()
+	var notaryKey []byte
+	restored := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case hdr.Name == "notary_privkey":
+			notaryKey, err = ioutil.ReadAll(tr)
+		case strings.HasPrefix(hdr.Name, "tables/"):
+			table := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "tables/"), ".jsonl")
+			err = s.restoreTable(tx, table, tr)
+			restored[table] = true
+		case strings.HasPrefix(hdr.Name, "blobs/"):
+			err = restoreBlob(b, strings.TrimPrefix(hdr.Name, "blobs/"), tr)
+		default:
+			err = fmt.Errorf("unexpected file %s in backup", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, table := range backupTables {
+		if !restored[table.name] {
+			return nil, fmt.Errorf("table %s missing from backup", table.name)
+		}
+	}
+	if notaryKey == nil {
+		return nil, errors.New("notary_privkey missing from backup")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, s.mapError(err)
+	}
+	log.Printf("Restored backup of %s from %s\n",
+		manifest.SMTPMxHost, time.Unix(manifest.UnixTime, 0))
+	return notaryKey, nil
+}
+
+// Only restores into an empty database at the same migration version,
+// so that every column in the backup exists and nothing gets overwritten
+func (s *sqlStore) checkRestore(manifest *backupManifest, driver string) error {
+	if manifest.Format != backupFormat {
+		return fmt.Errorf("unknown backup format %d", manifest.Format)
+	}
+	if manifest.DbDriver != driver {
+		return fmt.Errorf("backup is from %s, can't restore into %s",
+			manifest.DbDriver, driver)
+	}
+	version, err := loadMigrationVersion(s.db)
+	if err != nil {
+		return s.mapError(err)
+	}
+	if version != manifest.MigrationVersion {
+		return fmt.Errorf("backup is at migration version %d but the database is at %d, "+
+			"restore with the scramble-backup that made it", manifest.MigrationVersion, version)
+	}
+	for _, table := range backupTables {
+		var count int
+		err := s.queryRow("SELECT COUNT(*) FROM `" + table.name + "`").Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("table %s is not empty, restore only into a new database", table.name)
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) restoreTable(tx *sql.Tx, table string, r io.Reader) error {
+	serial, known := "", false
+	for _, t := range backupTables {
+		if t.name == table {
+			serial, known = t.serial, true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown table %s in backup", table)
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	var columns []string
+	if err := dec.Decode(&columns); err != nil {
+		return fmt.Errorf("table %s: %w", table, err)
+	}
+	for _, column := range columns {
+		if !regexColumnName.MatchString(column) {
+			return fmt.Errorf("table %s: invalid column %q", table, column)
+		}
+	}
+	stmt, err := tx.Prepare(s.dialect.rebind("INSERT INTO `" + table + "` (`" +
+		strings.Join(columns, "`, `") + "`) VALUES (?" +
+		strings.Repeat(",?", len(columns)-1) + ")"))
+	if err != nil {
+		return s.mapError(err)
+	}
+	defer stmt.Close()
+
+	count := 0
+	for dec.More() {
+		var values []interface{}
+		if err := dec.Decode(&values); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+		if len(values) != len(columns) {
+			return fmt.Errorf("table %s: row with %d values for %d columns",
+				table, len(values), len(columns))
+		}
+		for i, value := range values {
+			if number, ok := value.(json.Number); ok {
+				values[i], err = number.Int64()
+				if err != nil {
+					return fmt.Errorf("table %s: %w", table, err)
+				}
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return s.mapError(err)
+		}
+		count++
+	}
+	if reset := s.dialect.resetSerial(table, serial); serial != "" && reset != "" {
+		if _, err := tx.Exec(reset); err != nil {
+			return s.mapError(err)
+		}
+	}
+	log.Printf("Restored %d rows into %s\n", count, table)
+	return nil
+}
+
+func restoreBlob(b BlobStore, ref string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if blobRef(data) != ref {
+		return fmt.Errorf("blob %s is corrupt", ref)
+	}
+	_, err = b.Put(data)
+	return err
+}
@@ -0,0 +1,87 @@
+package scramble
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := backupManifest{DbDriver: "sqlite", SMTPMxHost: "local.scramble.io"}
+	savedBlobs := blobs
+	defer func() { blobs = savedBlobs }()
+
+	old := migrated(newSQLiteStore(filepath.Join(dir, "old.db")))
+	oldBlobs := newMemoryBlobStore()
+	blobs = oldBlobs
+	user := &User{UserID: UserID{Token: "bob", PublicHash: "aaaabbbbccccdddd", EmailHost: "local.scramble.io"}}
+	if err := old.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	bob := "bob@local.scramble.io"
+	for _, e := range []*Email{
+		newTestEmail("r1@x.com", "r1@x.com", 100),
+		newTestEmail("r2@x.com", "r1@x.com", 200),
+	} {
+		e.CipherBody = "body of " + e.MessageID
+		if err := old.DeliverMessage(e, []MessageBox{{bob, "inbox"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.SetMxHostInfo("mx.example.com", true, "notary key")
+	var backup bytes.Buffer
+	if err := old.writeBackup(&backup, oldBlobs, []byte("notary keys"), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh database, with a blob store of its own
+	fresh := migrated(newSQLiteStore(filepath.Join(dir, "fresh.db")))
+	freshBlobs := newMemoryBlobStore()
+	blobs = freshBlobs
+	notaryKey, err := fresh.restoreBackup(bytes.NewReader(backup.Bytes()), freshBlobs, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(notaryKey) != "notary keys" {
+		t.Errorf("Expected the notary key back, got %q", notaryKey)
+	}
+	if user, err := fresh.LoadUser("bob"); err != nil || user.PublicHash != "aaaabbbbccccdddd" {
+		t.Errorf("Expected bob to be restored, got %v, %v", user, err)
+	}
+	thread, err := fresh.LoadThread(bob, "r1@x.com")
+	if err != nil || len(thread) != 2 || thread[1].CipherBody != "body of r2@x.com" {
+		t.Errorf("Expected bob's thread with its bodies, got %v, %v", thread, err)
+	}
+	if info, err := fresh.GetMxHostInfo("mx.example.com"); err != nil || info.NotaryPublicKey != "notary key" {
+		t.Errorf("Expected the mx host to be restored, got %v, %v", info, err)
+	}
+	// new box rows must not collide with restored ones
+	e := newTestEmail("r3@x.com", "r1@x.com", 300)
+	if err := fresh.DeliverMessage(e, []MessageBox{{bob, "inbox"}}); err != nil {
+		t.Errorf("Expected new mail to be delivered after a restore, got %v", err)
+	}
+
+	// restoring twice would overwrite
+	_, err = fresh.restoreBackup(bytes.NewReader(backup.Bytes()), freshBlobs, "sqlite")
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("Expected restoring into a database with data to fail, got %v", err)
+	}
+	empty := migrated(newSQLiteStore(filepath.Join(dir, "empty.db")))
+	_, err = empty.restoreBackup(bytes.NewReader(backup.Bytes()), freshBlobs, "mysql")
+	if err == nil || !strings.Contains(err.Error(), "can't restore into mysql") {
+		t.Errorf("Expected restoring into another kind of database to fail, got %v", err)
+	}
+	empty.db.Exec("update migration set version = version + 1")
+	_, err = empty.restoreBackup(bytes.NewReader(backup.Bytes()), freshBlobs, "sqlite")
+	if err == nil || !strings.Contains(err.Error(), "migration version") {
+		t.Errorf("Expected restoring into another migration version to fail, got %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+/**
+ * Keeps message bodies (and later, attachments) by content hash,
+ * outside the database. The email table only holds the hash,
+ * see email.body_ref, so backups and replication of the database
+ * don't carry every armored body.
+ *
+ * Blobs are never changed once written. The janitor deletes
+ * the ones nothing refers to anymore, see collectBlobs.
+ */
+
+package scramble
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// BlobStore keeps immutable blobs by the hex SHA-256 of their content
+type BlobStore interface {
+	// Saves data, and returns its ref. Saving the same data twice is fine.
+	Put(data []byte) (string, error)
+	// Loads a blob, or ErrNotFound
+	Get(ref string) ([]byte, error)
+	// Deletes a blob unless it was Put since before.
+	// Returns whether it deleted it.
+	Delete(ref string, before time.Time) (bool, error)
+	// Calls fn for each blob, with the last time it was Put
+	Walk(fn func(ref string, putTime time.Time) error) error
+}
+
+var blobs BlobStore
+
+var regexBlobRef = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Opens the BlobStore for the configured BlobDir.
+// The memory store keeps its blobs in memory too.
+func openBlobStore(conf *Config) BlobStore {
+	if conf.DbDriver == "memory" {
+		return newMemoryBlobStore()
+	}
+	return newFileBlobStore(blobDir(conf))
+}
+
+// Where blobs live, relative paths are relative to ~/.scramble
+func blobDir(conf *Config) string {
+	dir := conf.BlobDir
+	if dir == "" {
+		dir = "blobs"
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".scramble", dir)
+}
+
+func blobRef(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func checkBlobRef(ref string) error {
+	if !regexBlobRef.MatchString(ref) {
+		return fmt.Errorf("%w: invalid blob ref %q", ErrNotFound, ref)
+	}
+	return nil
+}
+
+// Deletes blobs that weren't Put since before, and that no email refers to.
+// For a dry run, only counts them.
+//
+// Put refreshes the put time of a blob that already exists,
+// so a blob that is about to be referenced again is kept. That
+// includes one Put again after isReferenced looked, Delete checks.
+func collectBlobs(b BlobStore, isReferenced func(ref string) (bool, error), before time.Time, dryRun bool) (count int64, err error) {
+	err = b.Walk(func(ref string, putTime time.Time) error {
+		if !putTime.Before(before) {
+			return nil
+		}
+		referenced, err := isReferenced(ref)
+		if err != nil || referenced {
+			return err
+		}
+		if dryRun {
+			count++
+			return nil
+		}
+		deleted, err := b.Delete(ref, before)
+		if deleted {
+			count++
+		}
+		return err
+	})
+	return
+}
+
+//
+// FILESYSTEM
+//
+
+// fileBlobStore keeps each blob in its own file,
+// eg <dir>/3f/3fa9...c2, so that no directory gets too big
+type fileBlobStore struct {
+	dir string
+	// so that Delete can't remove a blob between
+	// a Put refreshing it and returning its ref
+	mutex sync.Mutex
+}
+
+func newFileBlobStore(dir string) *fileBlobStore {
+	log.Printf("Keeping blobs in %s\n", dir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+	return &fileBlobStore{dir: dir}
+}
+
+func (b *fileBlobStore) path(ref string) string {
+	return filepath.Join(b.dir, ref[:2], ref)
+}
+
+func (b *fileBlobStore) Put(data []byte) (string, error) {
+	ref := blobRef(data)
+	path := b.path(ref)
+	now := time.Now()
+	b.mutex.Lock()
+	err := os.Chtimes(path, now, now)
+	b.mutex.Unlock()
+	if err == nil {
+		return ref, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// write to a temp file and rename it, so that
+	// a blob is either there with all its content, or not at all
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return ref, nil
+}
+
+func (b *fileBlobStore) Get(ref string) ([]byte, error) {
+	if err := checkBlobRef(ref); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(b.path(ref))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: blob %s", ErrNotFound, ref)
+	}
+	return data, err
+}
+
+func (b *fileBlobStore) Delete(ref string, before time.Time) (bool, error) {
+	if err := checkBlobRef(ref); err != nil {
+		return false, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	path := b.path(ref)
+	info, err := os.Stat(path)
+	if err == nil && !info.ModTime().Before(before) {
+		return false, nil
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *fileBlobStore) Walk(fn func(ref string, putTime time.Time) error) error {
+	return filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip directories, and temp files of unfinished Puts
+		if info.IsDir() || !regexBlobRef.MatchString(info.Name()) {
+			return nil
+		}
+		return fn(info.Name(), info.ModTime())
+	})
+}
+
+//
+// MEMORY
+//
+
+// memoryBlobStore keeps blobs in a map, nothing survives a restart
+type memoryBlobStore struct {
+	mutex sync.Mutex
+	blobs map[string]*memoryBlob // by ref
+}
+
+type memoryBlob struct {
+	data    []byte
+	putTime time.Time
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: map[string]*memoryBlob{}}
+}
+
+func (b *memoryBlobStore) Put(data []byte) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ref := blobRef(data)
+	b.blobs[ref] = &memoryBlob{append([]byte{}, data...), time.Now()}
+	return ref, nil
+}
+
+func (b *memoryBlobStore) Get(ref string) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	blob := b.blobs[ref]
+	if blob == nil {
+		return nil, fmt.Errorf("%w: blob %s", ErrNotFound, ref)
+	}
+	return append([]byte{}, blob.data...), nil
+}
+
+func (b *memoryBlobStore) Delete(ref string, before time.Time) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	blob := b.blobs[ref]
+	if blob == nil || !blob.putTime.Before(before) {
+		return false, nil
+	}
+	delete(b.blobs, ref)
+	return true, nil
+}
+
+func (b *memoryBlobStore) Walk(fn func(ref string, putTime time.Time) error) error {
+	b.mutex.Lock()
+	refs := map[string]time.Time{}
+	for ref, blob := range b.blobs {
+		refs[ref] = blob.putTime
+	}
+	b.mutex.Unlock()
+	// without the lock, so that fn can Delete
+	for ref, putTime := range refs {
+		if err := fn(ref, putTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
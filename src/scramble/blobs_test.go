@@ -0,0 +1,127 @@
+package scramble
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testBlobStore(t, newFileBlobStore(dir))
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	testBlobStore(t, newMemoryBlobStore())
+}
+
+func testBlobStore(t *testing.T, b BlobStore) {
+	ref, err := b.Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != blobRef([]byte("hello")) {
+		t.Errorf("Expected the ref to be the content hash, got %s", ref)
+	}
+	if again, err := b.Put([]byte("hello")); err != nil || again != ref {
+		t.Errorf("Expected putting the same blob twice to work, got %s, %v", again, err)
+	}
+	if data, err := b.Get(ref); err != nil || string(data) != "hello" {
+		t.Errorf("Expected to get hello back, got %q, %v", data, err)
+	}
+	if _, err := b.Get("../../etc/passwd"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an invalid ref, got %v", err)
+	}
+
+	other, _ := b.Put([]byte("world"))
+	referenced := func(r string) (bool, error) {
+		return r == ref, nil
+	}
+	if count, err := collectBlobs(b, referenced, time.Now().Add(-time.Hour), false); err != nil || count != 0 {
+		t.Errorf("Expected new blobs to be kept, got %d, %v", count, err)
+	}
+	later := time.Now().Add(time.Hour)
+	if count, err := collectBlobs(b, referenced, later, true); err != nil || count != 1 {
+		t.Errorf("Expected a dry run to count one unreferenced blob, got %d, %v", count, err)
+	}
+	if count, err := collectBlobs(b, referenced, later, false); err != nil || count != 1 {
+		t.Errorf("Expected to collect one unreferenced blob, got %d, %v", count, err)
+	}
+	if _, err := b.Get(other); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the unreferenced blob to be deleted, got %v", err)
+	}
+	if _, err := b.Get(ref); err != nil {
+		t.Errorf("Expected the referenced blob to be kept, got %v", err)
+	}
+
+	// a message with the same body is saved while the janitor runs:
+	// its Put comes after isReferenced said no, before the Delete
+	again, _ := b.Put([]byte("again"))
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	refreshing := func(r string) (bool, error) {
+		if r == again {
+			_, err := b.Put([]byte("again"))
+			return false, err
+		}
+		return r == ref, nil
+	}
+	if count, err := collectBlobs(b, refreshing, before, false); err != nil || count != 0 {
+		t.Errorf("Expected the refreshed blob to be kept, got %d, %v", count, err)
+	}
+	if _, err := b.Get(again); err != nil {
+		t.Errorf("Expected the refreshed blob to still be there, got %v", err)
+	}
+}
+
+// Bodies saved before the blob store get moved out of the email table
+func TestSQLiteMoveBodiesToBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "old.db")+"?_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// migrate up to just before the blob store
+	before := 0
+	for i, migration := range sqliteMigrations {
+		if migration.name == "sqliteMigrateAddEmailBodyRef" {
+			before = i
+		}
+	}
+	migrateDb(db, sqliteDialect{}, sqliteMigrations[:before])
+	for _, id := range []string{"old1@x.com", "old2@x.com"} {
+		_, err = db.Exec("INSERT INTO email (message_id, unix_time, from_email, to_email, "+
+			"cipher_subject, cipher_body, ancestor_ids, thread_id) VALUES (?,100,'','','',?,'',?)",
+			id, "body of "+id, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrateDb(db, sqliteDialect{}, sqliteMigrations)
+
+	s := &sqlStore{db, sqliteDialect{}}
+	for _, id := range []string{"old1@x.com", "old2@x.com"} {
+		email, err := s.LoadMessage(id)
+		if err != nil || email.CipherBody != "body of "+id {
+			t.Errorf("Expected the body of %s to survive, got %q, %v", id, email.CipherBody, err)
+		}
+		if referenced, _ := s.IsBlobReferenced(blobRef([]byte("body of " + id))); !referenced {
+			t.Errorf("Expected %s to refer to its body blob", id)
+		}
+	}
+}
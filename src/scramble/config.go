@@ -14,10 +14,14 @@ import (
 // All configuration for a Scramble server+notary.
 // The config object is read from ~/.scramble/config.json
 type Config struct {
+	DbDriver   string // "mysql" (default), "postgres", "sqlite" or "memory", see openStore
 	DbServer   string
 	DbUser     string
 	DbPassword string
 	DbCatalog  string
+	BlobDir    string // message bodies, relative to ~/.scramble, see blobs.go
+	// don't migrate the database on startup, run scramble-migrate instead
+	DbManualMigrations bool
 
 	SMTPMxHost   string
 	SMTPPort     int // internal, nginx handles TLS and forwards
@@ -33,19 +37,43 @@ type Config struct {
 
 	// abuse prevention
 	SendWhitelist []string // whitelist of accounts allowed to send outgoing mail
+	// bytes of mail each user can store, 0 for unlimited.
+	// user.quota_bytes overrides it, -1 for unlimited
+	DefaultQuotaBytes int64
+
+	// retention, see janitor.go. 0 days means keep forever.
+	JanitorIntervalMins int  // how often the janitor runs, 0 turns it off
+	JanitorDryRun       bool // only log what the janitor would delete
+	TrashRetentionDays  int  // counted from when mail was trashed
+	SentRetentionDays   int  // default, users can choose their own
+	MxHostRetentionDays int  // dropped hosts get probed again on the next send
+
+	// how long a login lasts before the passphrase is needed again, see auth.go
+	SessionHours int
 
 	// When adding more config options, also update validateConfig!
 }
 
 func validateConfig(cfg *Config) error {
-	if cfg.DbServer == "" {
-		return errors.New("DbServer must be set")
-	}
-	if cfg.DbUser == "" {
-		return errors.New("DbUser must be set")
-	}
-	if cfg.DbCatalog == "" {
-		return errors.New("DbCatalog must be set")
+	switch cfg.DbDriver {
+	case "", "mysql", "postgres":
+		if cfg.DbServer == "" {
+			return errors.New("DbServer must be set")
+		}
+		if cfg.DbUser == "" {
+			return errors.New("DbUser must be set")
+		}
+		if cfg.DbCatalog == "" {
+			return errors.New("DbCatalog must be set")
+		}
+	case "sqlite":
+		if cfg.DbCatalog == "" {
+			return errors.New("DbCatalog must be set to the SQLite database file")
+		}
+	case "memory":
+		// nothing to connect to
+	default:
+		return errors.New("DbDriver must be mysql, postgres, sqlite or memory")
 	}
 	if cfg.SMTPMxHost == "" {
 		return errors.New("SMTPMxHost must be set")
@@ -68,6 +96,16 @@ func validateConfig(cfg *Config) error {
 	if cfg.AncestorIDsMaxBytes == 0 {
 		return errors.New("AncestorIDsMaxBytes must be set")
 	}
+	if cfg.DefaultQuotaBytes < 0 {
+		return errors.New("DefaultQuotaBytes can't be negative, use 0 for unlimited")
+	}
+	if cfg.JanitorIntervalMins < 0 || cfg.TrashRetentionDays < 0 ||
+		cfg.SentRetentionDays < 0 || cfg.MxHostRetentionDays < 0 {
+		return errors.New("JanitorIntervalMins and *RetentionDays can't be negative")
+	}
+	if cfg.SessionHours < 0 {
+		return errors.New("SessionHours can't be negative, use 0 for the default")
+	}
 	return nil
 }
 
@@ -78,10 +116,13 @@ func GetConfig() *Config {
 }
 
 var defaultConfig = Config{
+	"mysql",
 	"127.0.0.1",
 	"scramble",
 	"scramble",
 	"scramble",
+	"blobs",
+	false,
 
 	"local.scramble.io",
 	8825,
@@ -97,6 +138,15 @@ var defaultConfig = Config{
 	10240,
 	[]string{},
 	[]string{},
+	1073741824, // 1 GB per user
+
+	60,
+	false,
+	30,
+	0,
+	7,
+
+	defaultSessionHours,
 }
 
 var config Config
@@ -163,3 +213,19 @@ func (cfg *Config) IsReservedName(name string) bool {
 func (cfg *Config) IsSendWhitelisted(name string) bool {
 	return sliceContains(cfg.SendWhitelist, name)
 }
+
+// Checks whether a logged-in user is one of the AdminEmails,
+// who can see the server's status, eg GET /admin/janitor
+func (cfg *Config) IsAdmin(address string) bool {
+	return sliceContains(cfg.AdminEmails, address)
+}
+
+// Returns how many bytes of mail a user can store, 0 for unlimited
+func (cfg *Config) StorageQuota(user *User) int64 {
+	if user.QuotaBytes < 0 {
+		return 0
+	} else if user.QuotaBytes > 0 {
+		return user.QuotaBytes
+	}
+	return cfg.DefaultQuotaBytes
+}
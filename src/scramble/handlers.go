@@ -1,6 +1,7 @@
 package scramble
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,11 +21,23 @@ func StartHTTPServer() {
 	http.HandleFunc("/keybase/", keybaseHandler)                      // proxy the Keybase API
 
 	// Private Rest API
-	http.HandleFunc("/user/me/contacts", auth(contactsHandler)) // load contacts
-	http.HandleFunc("/user/me/key", auth(privateKeyHandler))    // load encrypted privkey
-	http.HandleFunc("/user/me", auth(loginHandler))             // load pubkey, email address, encrypted privkey
-	http.HandleFunc("/email/", auth(emailHandler))              // load email body
-	http.HandleFunc("/box/", auth(boxHandler))                  // load email headers
+	http.HandleFunc("/user/me/contacts", auth(contactsHandler))     // load contacts
+	http.HandleFunc("/user/me/key", auth(privateKeyHandler))        // load encrypted privkey
+	http.HandleFunc("/user/me/retention", auth(retentionHandler))   // how long sent mail is kept
+	http.HandleFunc("/user/me/sessions", auth(sessionsHandler))     // log in, list and end sessions
+	http.HandleFunc("/user/me/sessions/", auth(sessionsHandler))    // end one session
+	http.HandleFunc("/user/me/twofactor", auth(twoFactorHandler))   // turn TOTP codes on or off
+	http.HandleFunc("/user/me/passphrase", auth(passphraseHandler)) // change the passphrase
+	http.HandleFunc("/user/me/delete", auth(deleteAccountHandler))  // close the account
+	http.HandleFunc("/user/me", auth(loginHandler))                 // load pubkey, email address, encrypted privkey
+	http.HandleFunc("/email/", auth(emailHandler))                  // load email body
+	http.HandleFunc("/email/bulk", auth(bulkHandler))               // change many threads at once
+	http.HandleFunc("/box/", auth(boxHandler))                      // load email headers
+	http.HandleFunc("/boxes", auth(boxCountsHandler))               // thread and unread counts of every box
+	http.HandleFunc("/labels/", auth(labelsHandler))                // user-defined labels and folders
+	http.HandleFunc("/drafts/", auth(draftsHandler))                // save unsent email
+	http.HandleFunc("/search/", auth(searchHandler))                // blind index of decrypted mail
+	http.HandleFunc("/admin/janitor", auth(janitorStatsHandler))    // what the janitor deleted, for AdminEmails
 
 	// Resources
 	http.HandleFunc("/", staticHandler) // html, js, css
@@ -35,22 +48,44 @@ func StartHTTPServer() {
 	log.Fatal(http.ListenAndServe(address, recoverAndLogHandler(http.DefaultServeMux)))
 }
 
-// Wraps an HTTP handler, adding cookie authentication.
+// Wraps an HTTP handler, adding authentication by session or passphrase hash.
 //
-// The outer function either sends a HTTP 401 (Unauthorized),
+// The outer function either sends a HTTP 401 (Unauthorized), or 429 (Too Many
+// Requests) after too many failed logins, see throttle.go,
 // or calls the inner function passing in a valid logged-in username.
 func auth(handler func(http.ResponseWriter, *http.Request, *UserID)) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID, err := authenticate(r)
-		if err != nil {
+		var authErr authError
+		if sendThrottled(w, err) {
+			return
+		} else if errors.As(err, &authErr) {
+			if authErr == errTwoFactorNeeded {
+				w.Header().Set("X-Scramble-Two-Factor", "needed")
+			}
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
+		} else if err != nil {
+			storeError(w, err)
+			return
 		}
 
 		handler(w, r, userID)
 	})
 }
 
+// Sends a HTTP 429 (Too Many Requests), with Retry-After,
+// if err is a throttledError. Returns whether it did.
+func sendThrottled(w http.ResponseWriter, err error) bool {
+	var throttled *throttledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	w.Header().Set("Retry-After", throttled.RetryAfter())
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+	return true
+}
+
 // Wraps an HTTP handler, adding error logging.
 //
 // If the inner function panics, the outer function recovers, logs, sends an
@@ -80,6 +115,33 @@ func recoverAndLogHandler(handler http.Handler) http.Handler {
 	})
 }
 
+// Sends the HTTP error response for an error returned by the Store.
+//
+// Any error other than the Store's sentinels means the database failed,
+// that gets logged and the client is told to try again later.
+func storeError(w http.ResponseWriter, err error) {
+	status, message := storeErrorStatus(err)
+	if status == http.StatusServiceUnavailable {
+		log.Printf("Database error: %v", err)
+	}
+	http.Error(w, message, status)
+}
+
+// The status and message that storeError responds with
+func storeErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "Not found"
+	case errors.Is(err, ErrDuplicate):
+		return http.StatusConflict, "Already exists"
+	case errors.Is(err, ErrConstraint):
+		return http.StatusBadRequest, "Bad request"
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, "Changed elsewhere, reload and try again"
+	}
+	return http.StatusServiceUnavailable, "Database error. Please try again."
+}
+
 // Remember the status for logging
 type responseWriterWrapper struct {
 	Status int
@@ -1,6 +1,7 @@
 package scramble
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,9 +33,9 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 // that the public key we send here matches the hash they requested
 func publicKeyHandler(w http.ResponseWriter, r *http.Request) {
 	userPubHash := validateHash(r.URL.Path[len("/user/"):])
-	userPub := LoadPubKey(userPubHash)
-	if userPub == "" {
-		http.Error(w, "Not found", http.StatusNotFound)
+	userPub, err := LoadPubKey(userPubHash)
+	if err != nil {
+		storeError(w, err)
 	} else {
 		w.Write([]byte(userPub))
 	}
@@ -63,18 +64,70 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("New user, token: %s, email: %s", user.Token, user.EmailAddress)
 
-	if !SaveUser(user) {
+	err := SaveUser(user)
+	if errors.Is(err, ErrDuplicate) {
 		http.Error(w, "That username is taken", http.StatusBadRequest)
 		return
+	} else if err != nil {
+		storeError(w, err)
+		return
 	}
 
-	// Add user to local name_resolution table
-	AddNameResolution(user.Token, user.EmailHost, user.PublicHash)
+	// Add user to local name_resolution table.
+	// The name may still be taken there by a deleted account's tombstone.
+	err = AddNameResolution(user.Token, user.EmailHost, user.PublicHash)
+	if errors.Is(err, ErrDuplicate) {
+		if err := DeleteUser(user.Token); err != nil {
+			storeError(w, err)
+			return
+		}
+		http.Error(w, "That username is taken", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		storeError(w, err)
+		return
+	}
 
 	// Seed user token & hash to notaries.
 	SeedUserToNotaries(user)
 }
 
+// POST /user/me/delete to close the logged-in user's account for good.
+// Takes the passphrase hash again, and a two-factor code if the user
+// has two-factor on, the same way logging in does.
+// The name stays taken, see DeleteAccount and SeedTombstoneToNotaries.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := authenticateUserPass(userID.Token, r.FormValue("passHash"),
+		r.FormValue("passHashOld"), r.FormValue("code"), requestIP(r))
+	var authErr authError
+	if sendThrottled(w, err) {
+		return
+	} else if errors.As(err, &authErr) {
+		http.Error(w, authErr.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		storeError(w, err)
+		return
+	}
+	user, err := LoadUser(userID.Token)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = DeleteAccount(user.Token)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("Account deleted. User %s, IP %s", user.Token, requestIP(r))
+
+	SeedTombstoneToNotaries(user)
+}
+
 // GET /user/me/contacts for the logged-in user's encrypted address book
 // POST /user/me/contacts to update logged-in user's encrypted address book
 // The entire address book is a single blob.
@@ -83,8 +136,10 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 // the user makes changes, the client encrypts and posts all contacts
 func contactsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	if r.Method == "GET" {
-		cipherContactsHex := LoadContacts(userID.Token)
-		if cipherContactsHex == nil {
+		cipherContactsHex, err := LoadContacts(userID.Token)
+		if err != nil {
+			storeError(w, err)
+		} else if cipherContactsHex == nil {
 			http.Error(w, "Not found", http.StatusNotFound)
 		} else {
 			w.Write([]byte(*cipherContactsHex))
@@ -94,44 +149,365 @@ func contactsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 		if err != nil {
 			panic(err)
 		}
-		SaveContacts(userID.Token, string(cipherContactsHex))
+		err = SaveContacts(userID.Token, string(cipherContactsHex))
+		if err != nil {
+			storeError(w, err)
+		}
 	}
 }
 
 // GET /user/me/key for the logged-in user's encrypted private key
 func privateKeyHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
-	user := LoadUser(userID.Token)
-	if user == nil {
-		http.Error(w, "Not found", http.StatusNotFound)
+	user, err := LoadUser(userID.Token)
+	if err != nil {
+		storeError(w, err)
 		return
 	}
 	w.Write([]byte(user.CipherPrivateKey))
 }
 
+type RetentionResponse struct {
+	SentRetentionDays        int // 0 means the server default applies
+	DefaultSentRetentionDays int // 0 means sent mail is kept forever
+}
+
+// GET /user/me/retention for how long the logged-in user's sent mail is kept
+// POST /user/me/retention to change it, sentDays=0 for the server default
+func retentionHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	if r.Method == "POST" {
+		days, err := strconv.Atoi(r.FormValue("sentDays"))
+		if err != nil || days < 0 {
+			http.Error(w, "Invalid sentDays", http.StatusBadRequest)
+			return
+		}
+		err = SetSentRetentionDays(userID.Token, days)
+		if err != nil {
+			storeError(w, err)
+		}
+		return
+	}
+	user, err := LoadUser(userID.Token)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	res := RetentionResponse{
+		user.SentRetentionDays,
+		GetConfig().SentRetentionDays,
+	}
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+type NewSessionResponse struct {
+	ID          int64
+	Session     string // the secret, for the x-scramble-session header
+	ExpiresTime int64
+}
+
+type SessionResponse struct {
+	ID          int64
+	IP          string
+	UserAgent   string
+	CreatedTime int64
+	ExpiresTime int64
+	IsCurrent   bool // the session this request came with
+}
+
+// POST /user/me/sessions logs in: it trades the passphrase hash for the
+// secret of a new session, which the client sends as x-scramble-session
+// instead until the session expires. GET lists the user's sessions.
+// DELETE /user/me/sessions/<id> ends one of them, and
+// DELETE /user/me/sessions ends them all, logging out everywhere.
+func sessionsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	idStr := strings.TrimPrefix(r.URL.Path[len("/user/me/sessions"):], "/")
+	if idStr != "" {
+		if r.Method != "DELETE" {
+			http.Error(w, "Expected DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid session", http.StatusBadRequest)
+			return
+		}
+		if err = DeleteSession(userID.Token, id); err != nil {
+			storeError(w, err)
+		}
+		return
+	}
+
+	var res interface{}
+	now := time.Now().Unix()
+	switch r.Method {
+	case "POST":
+		// otherwise a stolen session could keep itself alive forever
+		if r.Header.Get("x-scramble-session") != "" {
+			http.Error(w, "Log in with your passphrase to start a session", http.StatusForbidden)
+			return
+		}
+		session, secret, err := createSession(userID.Token, requestIP(r), r.UserAgent(), now)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		log.Printf("Session started. User %s, IP %s", userID.Token, session.IP)
+		res = NewSessionResponse{session.ID, secret, session.ExpiresTime}
+	case "DELETE":
+		if _, err := DeleteSessions(userID.Token); err != nil {
+			storeError(w, err)
+		}
+		return
+	case "GET":
+		sessions, err := LoadSessions(userID.Token, now)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		currentHash := ""
+		if secret := r.Header.Get("x-scramble-session"); secret != "" {
+			currentHash = hashSessionSecret(secret)
+		}
+		list := []SessionResponse{}
+		for _, session := range sessions {
+			list = append(list, SessionResponse{
+				session.ID,
+				session.IP,
+				session.UserAgent,
+				session.CreatedTime,
+				session.ExpiresTime,
+				session.Hash == currentHash,
+			})
+		}
+		res = list
+	default:
+		http.Error(w, "Expected GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+// POST /user/me/passphrase changes the passphrase. The client sends hashes
+// of the current passphrase as oldPassHash and oldPassHashOld, the new
+// passHash, and the private key encrypted with the new passphrase,
+// plus cipherContacts if the user has saved contacts, and code if the
+// user has two-factor on.
+// All sessions end, the response has a new one for the caller.
+func passphraseHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	change := &PassphraseChange{
+		OldPassHash:      r.FormValue("oldPassHash"),
+		OldPassHashOld:   r.FormValue("oldPassHashOld"),
+		PassHash:         validatePassHash(r.FormValue("passHash")),
+		CipherPrivateKey: validateHex(r.FormValue("cipherPrivateKey")),
+	}
+	if cipherContacts := r.FormValue("cipherContacts"); cipherContacts != "" {
+		validateHex(cipherContacts)
+		change.CipherContacts = &cipherContacts
+	}
+	// the old passphrase can be guessed here too, see throttle.go
+	if sendThrottled(w, checkLoginThrottle(userID.Token, requestIP(r))) {
+		return
+	}
+	// a session alone doesn't get past two-factor
+	err := checkTwoFactor(userID.Token, r.FormValue("code"), time.Now().Unix())
+	var authErr authError
+	if errors.As(err, &authErr) {
+		if authErr != errTwoFactorNeeded {
+			recordLoginFailure(userID.Token, requestIP(r))
+		}
+		http.Error(w, authErr.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = ChangePassphrase(userID.Token, change)
+	if errors.Is(err, ErrNotFound) {
+		recordLoginFailure(userID.Token, requestIP(r))
+		http.Error(w, "Incorrect passphrase", http.StatusForbidden)
+		return
+	} else if err != nil {
+		storeError(w, err)
+		return
+	}
+	recordLoginSuccess(userID.Token)
+	log.Printf("Passphrase changed. User %s, IP %s", userID.Token, requestIP(r))
+
+	session, secret, err := createSession(userID.Token, requestIP(r), r.UserAgent(), time.Now().Unix())
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	resJSON, err := json.Marshal(NewSessionResponse{session.ID, secret, session.ExpiresTime})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+type TwoFactorResponse struct {
+	IsEnabled         bool
+	RecoveryCodesLeft int
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret string // to type into an authenticator app
+	URI    string // otpauth://, to show as a QR code
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string
+}
+
+// GET /user/me/twofactor tells whether two-factor login is on, see totp.go.
+// POST passHash= starts enrolling with a new secret, PUT code= confirms it
+// with a code from the user's app and returns their recovery codes, and
+// DELETE ?code= turns two-factor off again.
+func twoFactorHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	var res interface{}
+	now := time.Now().Unix()
+	switch r.Method {
+	case "GET":
+		tf, err := LoadTwoFactor(userID.Token)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			storeError(w, err)
+			return
+		}
+		count, err := CountRecoveryCodes(userID.Token)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		res = TwoFactorResponse{tf != nil && tf.EnabledTime != 0, count}
+	case "POST":
+		// a stolen session mustn't lock the owner out with another app
+		_, err := authenticateUserPass(userID.Token, r.FormValue("passHash"),
+			r.FormValue("passHashOld"), r.FormValue("code"), requestIP(r))
+		var authErr authError
+		if sendThrottled(w, err) {
+			return
+		} else if errors.As(err, &authErr) {
+			http.Error(w, authErr.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			storeError(w, err)
+			return
+		}
+		secret, err := newTOTPSecret()
+		if err != nil {
+			panic(err)
+		}
+		if err = SaveTwoFactor(&TwoFactor{Token: userID.Token, Secret: secret}); err != nil {
+			storeError(w, err)
+			return
+		}
+		res = TwoFactorEnrollResponse{secret, totpURI(userID.EmailAddress, secret)}
+	case "PUT":
+		tf, err := LoadTwoFactor(userID.Token)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if tf.EnabledTime != 0 {
+			http.Error(w, "Two-factor is on already", http.StatusConflict)
+			return
+		}
+		step := matchTOTP(tf.Secret, r.FormValue("code"), now, tf.LastStep)
+		if step < 0 {
+			http.Error(w, "Incorrect code, check the time on your phone", http.StatusBadRequest)
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			panic(err)
+		}
+		if err = EnableTwoFactor(userID.Token, step, now, hashes); err != nil {
+			storeError(w, err)
+			return
+		}
+		log.Printf("Two-factor turned on. User %s", userID.Token)
+		res = RecoveryCodesResponse{codes}
+	case "DELETE":
+		tf, err := LoadTwoFactor(userID.Token)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		// so that someone with a stolen session can't turn it off.
+		// the code can be guessed here too, see throttle.go
+		if tf.EnabledTime != 0 {
+			if sendThrottled(w, checkLoginThrottle(userID.Token, requestIP(r))) {
+				return
+			}
+			err = useTwoFactorCode(tf, r.FormValue("code"), now)
+			var authErr authError
+			if errors.As(err, &authErr) {
+				recordLoginFailure(userID.Token, requestIP(r))
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			} else if err != nil {
+				storeError(w, err)
+				return
+			}
+			recordLoginSuccess(userID.Token)
+		}
+		if err = DeleteTwoFactor(userID.Token); err != nil {
+			storeError(w, err)
+			return
+		}
+		log.Printf("Two-factor turned off. User %s", userID.Token)
+		return
+	default:
+		http.Error(w, "Expected GET, POST, PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
 type UserResponse struct {
-	EmailAddress     string
-	PublicHash       string
-	PublicKey        string
-	CipherPrivateKey string
+	EmailAddress      string
+	PublicHash        string
+	PublicKey         string
+	CipherPrivateKey  string
+	StorageUsedBytes  int64
+	StorageQuotaBytes int64 // 0 for unlimited
 }
 
 // GET /user/me for the logged-in user's email address, public key, and encrypted private key
 func loginHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
-	user := LoadUser(userID.Token)
-	if user == nil {
-		http.Error(w, "Not found", http.StatusNotFound)
+	user, err := LoadUser(userID.Token)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("Login successful. User %s, IP %s", userID.Token, requestIP(r))
+	usage, err := LoadStorageUsage(user)
+	if err != nil {
+		storeError(w, err)
 		return
 	}
-	ip := r.RemoteAddr
-	if strings.HasPrefix(ip, "127.0.0.1:") {
-		ip = r.Header.Get("X-Real-IP") // NGINX reverse proxy
-        }
-	log.Printf("Login successful. User %s, IP %s", userID.Token, ip)
 	res := UserResponse{
 		user.EmailAddress,
 		user.PublicHash,
 		user.PublicKey,
 		user.CipherPrivateKey,
+		usage.UsedBytes,
+		usage.QuotaBytes,
 	}
 	resJSON, err := json.Marshal(res)
 	if err != nil {
@@ -140,6 +516,33 @@ func loginHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	w.Write(resJSON)
 }
 
+// GET /admin/janitor for what the janitor deleted since startup, see
+// JanitorStats. Only for users whose address is in AdminEmails.
+func janitorStatsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	if !GetConfig().IsAdmin(userID.EmailAddress) {
+		http.Error(w, "Only admins can see this", http.StatusForbidden)
+		return
+	}
+	resJSON, err := json.Marshal(GetJanitorStats())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resJSON)
+}
+
+// The client's IP, as NGINX saw it when it proxies the request.
+// Without the port, which changes with every connection.
+func requestIP(r *http.Request) string {
+	if strings.HasPrefix(r.RemoteAddr, "127.0.0.1:") {
+		return r.Header.Get("X-Real-IP") // NGINX reverse proxy
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 func computeEmailHost(requestHost string) string {
 	if requestHost == "localhost" || strings.HasPrefix(requestHost, "localhost:") {
 		return GetConfig().SMTPMxHost
@@ -161,25 +564,102 @@ func computeEmailHost(requestHost string) string {
 // Takes no arguments, returns all the metadata about a user's (in)box.
 // Encrypted subjects are returned, but no message bodies.
 // The caller must have auth cookies set.
+//
+// Pages either by ?offset=, or by the ?cursor= from the previous page.
+// Cursor paging is stable when new mail arrives between pages,
+// and doesn't slow down deep into a big box.
+//
+// ?flag=starred only lists the threads with a starred message,
+// several comma separated flags the threads with any of them.
+// /box/label/<id> lists the threads with one of the user's labels.
+// /box/drafts lists drafts, one by one rather than by thread,
+// and only pages by offset.
+//
+// DELETE /box/trash empties the trash.
+// PUT /box/<box> with isRead=true marks everything in the box read.
 func boxHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	box := r.URL.Path[len("/box/"):]
-	query := r.URL.Query()
-	offset, err := strconv.Atoi(query.Get("offset"))
-	if err != nil {
-		panic(err)
+	if r.Method == "DELETE" {
+		emptyTrashHandler(w, box, userID)
+		return
+	}
+	if r.Method == "PUT" {
+		markBoxReadHandler(w, r, box, userID)
+		return
+	}
+	useOffset, offset, limit, after, ok := parseBoxPage(w, r)
+	if !ok {
+		return
 	}
-	limit, err := strconv.Atoi(query.Get("limit"))
+
+	flags, err := ParseFlags(r.URL.Query().Get("flag"))
 	if err != nil {
-		panic(err)
+		http.Error(w, "Invalid flag", http.StatusBadRequest)
+		return
 	}
 
 	var emailHeaders []EmailHeader
+	var next *BoxCursor
 	var total int
-	if box == "inbox" || box == "archive" || box == "sent" {
-		emailHeaders = LoadBoxByThread(userID.EmailAddress, box, offset, limit)
-		total, err = CountBox(userID.EmailAddress, box)
+	if flags != 0 && (box == "inbox" || box == "archive" || box == "sent" || box == "trash") {
+		if useOffset {
+			emailHeaders, err = LoadFlaggedByThread(userID.EmailAddress, box, flags, offset, limit)
+		} else {
+			emailHeaders, next, err = LoadFlaggedByThreadAfter(userID.EmailAddress, box, flags, after, limit)
+		}
+		if err == nil {
+			total, err = CountFlagged(userID.EmailAddress, box, flags)
+		}
 		if err != nil {
-			panic(err)
+			storeError(w, err)
+			return
+		}
+	} else if flags != 0 {
+		http.Error(w, "Only inbox, archive, sent and trash filter by flag", http.StatusBadRequest)
+		return
+	} else if box == "inbox" || box == "archive" || box == "sent" || box == "trash" {
+		if useOffset {
+			emailHeaders, err = LoadBoxByThread(userID.EmailAddress, box, offset, limit)
+		} else {
+			emailHeaders, next, err = LoadBoxByThreadAfter(userID.EmailAddress, box, after, limit)
+		}
+		if err == nil {
+			total, err = CountBox(userID.EmailAddress, box)
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+	} else if box == "drafts" {
+		if !useOffset {
+			http.Error(w, "Drafts only page by offset", http.StatusBadRequest)
+			return
+		}
+		emailHeaders, err = LoadDrafts(userID.EmailAddress, offset, limit)
+		if err == nil {
+			total, err = CountDrafts(userID.EmailAddress)
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+	} else if strings.HasPrefix(box, "label/") {
+		labelID, err := strconv.ParseInt(box[len("label/"):], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid label", http.StatusBadRequest)
+			return
+		}
+		if useOffset {
+			emailHeaders, err = LoadLabelByThread(userID.EmailAddress, labelID, offset, limit)
+		} else {
+			emailHeaders, next, err = LoadLabelByThreadAfter(userID.EmailAddress, labelID, after, limit)
+		}
+		if err == nil {
+			total, err = CountLabel(userID.EmailAddress, labelID)
+		}
+		if err != nil {
+			storeError(w, err)
+			return
 		}
 	} else {
 		http.Error(w, "Unknown box. "+
@@ -188,6 +668,37 @@ func boxHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 		return
 	}
 
+	writeBoxSummary(w, userID, box, offset, limit, total, emailHeaders, next)
+}
+
+// Reads ?offset= or ?cursor=, and ?limit=.
+// Writes an error and returns ok=false if the cursor is invalid.
+func parseBoxPage(w http.ResponseWriter, r *http.Request) (useOffset bool, offset, limit int, after *BoxCursor, ok bool) {
+	query := r.URL.Query()
+	useOffset = query.Get("offset") != ""
+	var err error
+	if useOffset {
+		offset, err = strconv.Atoi(query.Get("offset"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	limit, err = strconv.Atoi(query.Get("limit"))
+	if err != nil {
+		panic(err)
+	}
+	if query.Get("cursor") != "" {
+		after, err = decodeBoxCursor(query.Get("cursor"))
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	return useOffset, offset, limit, after, true
+}
+
+func writeBoxSummary(w http.ResponseWriter, userID *UserID, box string, offset, limit, total int,
+	emailHeaders []EmailHeader, next *BoxCursor) {
 	var summary BoxSummary
 	summary.EmailAddress = userID.EmailAddress
 	summary.PublicHash = userID.PublicHash
@@ -196,6 +707,9 @@ func boxHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	summary.Limit = limit
 	summary.Total = total
 	summary.EmailHeaders = emailHeaders
+	if next != nil {
+		summary.NextCursor = encodeBoxCursor(next)
+	}
 
 	summaryJSON, err := json.Marshal(summary)
 	if err != nil {
@@ -204,6 +718,166 @@ func boxHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	w.Write(summaryJSON)
 }
 
+type EmptyTrashResponse struct {
+	Deleted int64 // messages
+}
+
+func emptyTrashHandler(w http.ResponseWriter, box string, userID *UserID) {
+	if box != "trash" {
+		http.Error(w, "Only the trash can be emptied", http.StatusBadRequest)
+		return
+	}
+	deleted, err := EmptyTrash(userID.EmailAddress)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("Emptied the trash of %s, %d messages", userID.EmailAddress, deleted)
+	resJSON, err := json.Marshal(EmptyTrashResponse{deleted})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+type MarkBoxReadResponse struct {
+	Marked int64 // messages that were unread
+}
+
+func markBoxReadHandler(w http.ResponseWriter, r *http.Request, box string, userID *UserID) {
+	if r.FormValue("isRead") != "true" {
+		http.Error(w, "Boxes can only be marked read", http.StatusBadRequest)
+		return
+	}
+	marked, err := MarkBoxAsRead(userID.EmailAddress, validateBox(box))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	resJSON, err := json.Marshal(MarkBoxReadResponse{marked})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+type BoxCountsResponse struct {
+	Boxes map[string]BoxCount // by the name /box/ takes, eg "inbox" or "label/12"
+}
+
+// GET /boxes counts the threads, and the threads with unread mail,
+// of every box, drafts and label, for badges. It's one query, cheap to poll.
+func boxCountsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	if r.Method != "GET" {
+		http.Error(w, "Expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	counts, err := LoadBoxCounts(userID.EmailAddress)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	resJSON, err := json.Marshal(BoxCountsResponse{counts})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+// Cursors are opaque to clients, so that we can change them later
+func encodeBoxCursor(cursor *BoxCursor) string {
+	str := strconv.FormatInt(cursor.UnixTime, 10) + " " + cursor.ThreadID
+	return base64.RawURLEncoding.EncodeToString([]byte(str))
+}
+
+func decodeBoxCursor(encoded string) (*BoxCursor, error) {
+	str, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(str), " ", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid box cursor")
+	}
+	unixTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &BoxCursor{unixTime, parts[1]}, nil
+}
+
+//
+// LABELS ROUTE
+//
+
+// GET /labels/ lists the user's labels, POST /labels/ creates one.
+// PUT /labels/<id> renames a label, DELETE /labels/<id> deletes it.
+// Names are PGP-encrypted by the client, in cipherName.
+func labelsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	idStr := r.URL.Path[len("/labels/"):]
+	if idStr == "" {
+		if r.Method == "POST" {
+			cipherName := validateMessageArmor(r.FormValue("cipherName"))
+			label, err := CreateLabel(userID.EmailAddress, cipherName)
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			writeLabelsJSON(w, label)
+			return
+		}
+		labels, err := LoadLabels(userID.EmailAddress)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		writeLabelsJSON(w, labels)
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid label", http.StatusBadRequest)
+		return
+	}
+	if r.Method == "PUT" {
+		cipherName := validateMessageArmor(r.FormValue("cipherName"))
+		err = RenameLabel(userID.EmailAddress, id, cipherName)
+	} else if r.Method == "DELETE" {
+		err = DeleteLabel(userID.EmailAddress, id)
+	} else {
+		http.Error(w, "Expected PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+	}
+}
+
+func writeLabelsJSON(w http.ResponseWriter, v interface{}) {
+	resJSON, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+// Parses a comma separated list of label ids, eg "3,14"
+func parseLabelIDs(str string) ([]int64, error) {
+	var ids []int64
+	if str == "" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(str, ",") {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 //
 // EMAIL ROUTE
 //
@@ -215,6 +889,8 @@ func emailHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 		emailPutHandler(w, r, userID)
 	} else if r.Method == "POST" {
 		emailSendHandler(w, r, userID)
+	} else if r.Method == "DELETE" {
+		emailDeleteHandler(w, r, userID)
 	}
 }
 
@@ -223,7 +899,11 @@ func emailHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 func emailFetchHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	threadID := r.FormValue("threadID")
 
-	threadEmails := LoadThread(userID.EmailAddress, threadID)
+	threadEmails, err := LoadThread(userID.EmailAddress, threadID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	if len(threadEmails) == 0 {
 		http.Error(w, "Not found or unauthorized", http.StatusUnauthorized)
 		return
@@ -235,25 +915,240 @@ func emailFetchHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	w.Write(resJSON)
 }
 
-// PUT /email/id can change things about an email, eg what box it's in
+// PUT /email/id can change things about an email, eg what box it's in.
+// box=trash moves its thread to the trash, restore=true moves it back.
+// addLabels and removeLabels take comma separated label ids, and
+// together with box=archive move a thread into or out of a folder.
+// addFlags and removeFlags take comma separated flag names, eg
+// "starred,important".
+//
+// With messageOnly=true, box, restore, isRead and the flags only change
+// the one message rather than its thread, and the response lists the
+// boxes it is in afterwards. Labels always apply to the whole thread.
 func emailPutHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	id := r.URL.Path[len("/email/"):]
+	if r.FormValue("messageOnly") == "true" {
+		messagePutHandler(w, r, id, userID)
+		return
+	}
+	if r.FormValue("addFlags") != "" || r.FormValue("removeFlags") != "" {
+		set, clear, err := parseFlagChanges(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := FlagThread(userID.EmailAddress, id, set, clear); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	if r.FormValue("addLabels") != "" || r.FormValue("removeLabels") != "" {
+		add, err := parseLabelIDs(r.FormValue("addLabels"))
+		if err != nil {
+			http.Error(w, "Invalid addLabels", http.StatusBadRequest)
+			return
+		}
+		remove, err := parseLabelIDs(r.FormValue("removeLabels"))
+		if err != nil {
+			http.Error(w, "Invalid removeLabels", http.StatusBadRequest)
+			return
+		}
+		if err := LabelThread(userID.EmailAddress, id, add, remove); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	if r.FormValue("restore") == "true" {
+		if err := RestoreThread(userID.EmailAddress, id); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
 	if r.FormValue("box") != "" {
 		newBox := validateBox(r.FormValue("box"))
-		threadMoveBox(id, userID, newBox)
+		if err := threadMoveBox(id, userID, newBox); err != nil {
+			storeError(w, err)
+			return
+		}
 	}
 	if r.FormValue("isRead") != "" {
 		isRead := r.FormValue("isRead") == "true"
-		ThreadMarkAsRead(userID.EmailAddress, id, isRead)
+		if err := ThreadMarkAsRead(userID.EmailAddress, id, isRead); err != nil {
+			storeError(w, err)
+		}
 	}
 }
 
-func threadMoveBox(id string, userID *UserID, newBox string) {
+// The messageOnly=true half of emailPutHandler
+func messagePutHandler(w http.ResponseWriter, r *http.Request, id string, userID *UserID) {
+	if r.FormValue("addLabels") != "" || r.FormValue("removeLabels") != "" {
+		http.Error(w, "Labels apply to whole threads", http.StatusBadRequest)
+		return
+	}
+	boxes, err := BoxesForMessage(userID.EmailAddress, id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if len(boxes) == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.FormValue("addFlags") != "" || r.FormValue("removeFlags") != "" {
+		set, clear, err := parseFlagChanges(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := FlagMessage(userID.EmailAddress, id, set, clear); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	if r.FormValue("restore") == "true" {
+		if err := RestoreEmail(userID.EmailAddress, id); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	if r.FormValue("box") != "" {
+		newBox := validateBox(r.FormValue("box"))
+		if newBox == "trash" {
+			err = TrashEmail(userID.EmailAddress, id)
+		} else {
+			err = MoveEmail(userID.EmailAddress, id, newBox)
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	if r.FormValue("isRead") != "" {
+		isRead := r.FormValue("isRead") == "true"
+		if err := MarkAsRead(userID.EmailAddress, id, isRead); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	writeMessageBoxes(w, userID, id)
+}
+
+// DELETE /email/id deletes one message for good, from all of the user's boxes
+func emailDeleteHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	id := r.URL.Path[len("/email/"):]
+	if err := DeleteFromBoxes(userID.EmailAddress, id); err != nil {
+		storeError(w, err)
+		return
+	}
+	writeMessageBoxes(w, userID, id)
+}
+
+// How many messages one POST /email/bulk can change
+const maxBulkMessages = 1000
+
+type BulkResult struct {
+	MessageID string
+	Status    int    // what a PUT /email/<id> of its own would have responded
+	Error     string // "" if it worked
+}
+
+type BulkResponse struct {
+	Results []BulkResult // in the order of the request
+}
+
+// POST /email/bulk makes one change to many threads in one transaction.
+// Takes msgID once per thread, and an action: move with a box (the trash
+// included), restore, read, unread, delete, which deletes for good, or
+// label with addLabels and removeLabels. With messageOnly=true it changes
+// just the messages. Responds with a result per message, so that one
+// that's gone doesn't stop the others.
+func bulkHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	messageIDs := r.PostForm["msgID"]
+	if len(messageIDs) == 0 || len(messageIDs) > maxBulkMessages {
+		http.Error(w, fmt.Sprintf("Expected 1 to %d msgIDs", maxBulkMessages), http.StatusBadRequest)
+		return
+	}
+	for _, messageID := range messageIDs {
+		validateMessageID(messageID)
+	}
+	op := BulkOp{
+		Action:      r.FormValue("action"),
+		Box:         r.FormValue("box"),
+		MessageOnly: r.FormValue("messageOnly") == "true",
+	}
+	var err error
+	if op.AddLabels, err = parseLabelIDs(r.FormValue("addLabels")); err != nil {
+		http.Error(w, "Invalid addLabels", http.StatusBadRequest)
+		return
+	}
+	if op.RemoveLabels, err = parseLabelIDs(r.FormValue("removeLabels")); err != nil {
+		http.Error(w, "Invalid removeLabels", http.StatusBadRequest)
+		return
+	}
+	if err := op.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	errs, err := UpdateInBulk(userID.EmailAddress, op, messageIDs)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	results := make([]BulkResult, len(messageIDs))
+	for i, messageID := range messageIDs {
+		results[i] = BulkResult{MessageID: messageID, Status: http.StatusOK}
+		if errs[i] != nil {
+			results[i].Status, results[i].Error = storeErrorStatus(errs[i])
+		}
+	}
+	resJSON, err := json.Marshal(BulkResponse{results})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+type MessageBoxesResponse struct {
+	Boxes []string // eg ["inbox", "sent"], empty once it's deleted
+}
+
+func writeMessageBoxes(w http.ResponseWriter, userID *UserID, id string) {
+	boxes, err := BoxesForMessage(userID.EmailAddress, id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	resJSON, err := json.Marshal(MessageBoxesResponse{boxes})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+// Parses addFlags and removeFlags
+func parseFlagChanges(r *http.Request) (set, clear Flags, err error) {
+	set, err = ParseFlags(r.FormValue("addFlags"))
+	if err != nil {
+		return 0, 0, errors.New("Invalid addFlags")
+	}
+	clear, err = ParseFlags(r.FormValue("removeFlags"))
+	if err != nil {
+		return 0, 0, errors.New("Invalid removeFlags")
+	}
+	return set, clear, nil
+}
+
+func threadMoveBox(id string, userID *UserID, newBox string) error {
 	if newBox == "trash" {
-		DeleteThreadFromBoxes(userID.EmailAddress, id)
-	} else {
-		MoveThread(userID.EmailAddress, id, newBox)
+		return TrashThread(userID.EmailAddress, id)
 	}
+	return MoveThread(userID.EmailAddress, id, newBox)
 }
 
 // POST /email/ creates a new email from auth user
@@ -315,9 +1210,16 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 		}
 		localRecipients = localRecipients.Unique()
 		// Populate outgoingEmail
-		email.CipherSubject = encryptForUsers(formSubject, localRecipients.Strings())
-		email.CipherBody = encryptForUsers("Subject: "+formSubject+"\n\n"+
-			formBody, localRecipients.Strings())
+		var err error
+		email.CipherSubject, err = encryptForUsers(formSubject, localRecipients.Strings())
+		if err == nil {
+			email.CipherBody, err = encryptForUsers("Subject: "+formSubject+"\n\n"+
+				formBody, localRecipients.Strings())
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
 		outgoingEmail.Email = *email
 		outgoingEmail.PlaintextSubject = formSubject
 		outgoingEmail.PlaintextBody = formBody
@@ -329,35 +1231,53 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 		outgoingEmail.IsPlaintext = false
 	}
 
-	// This will fail if the client tried to send the same
-	// message twice---because at that point there will be a dupe Message-ID
-	err := SaveMessage(email)
+	// the sent box counts against the sender's quota.
+	// a draft of this message is deleted as it's sent, so it doesn't.
+	user, err := LoadUser(userID.Token)
+	var usage *StorageUsage
+	if err == nil {
+		usage, err = LoadStorageUsage(user)
+	}
+	var draftSize int64
+	if err == nil {
+		draftSize, err = loadDraftSize(userID.EmailAddress, email.MessageID)
+	}
 	if err != nil {
-		w.WriteHeader(500)
-		if strings.HasPrefix(err.Error(), "Error 1062: Duplicate entry") {
-			w.Write([]byte("Already sent."))
-		} else {
-			w.Write([]byte("Error sending mail. Please try again."))
-		}
+		storeError(w, err)
+		return
+	}
+	if !usage.HasRoomFor(int64(len(email.CipherBody)) - draftSize) {
+		http.Error(w, "Your mailbox is full. Delete some mail and try again.",
+			http.StatusInsufficientStorage)
 		return
 	}
 
-	// Add message to sender's sent box
-	AddMessageToBox(email, userID.EmailAddress, "sent")
-
-	// Deliver mail locally
+	// Add message to sender's sent box, and deliver mail locally
+	boxes := []MessageBox{{userID.EmailAddress, "sent"}}
 	for mxHost, addrs := range mxHostAddrs {
 		// if mxHost is GetConfig().SMTPMxHost, assume that the lookup will return itself.
 		// this saves us from having to set up test MX records for localhost testing.
 		if mxHost == GetConfig().SMTPMxHost {
 			// add to inbox locally
 			for _, addr := range addrs {
-				AddMessageToBox(email, addr.String(), "inbox")
+				boxes = append(boxes, MessageBox{addr.String(), "inbox"})
 			}
-			continue
 		}
 	}
 
+	// This will fail if the client tried to send the same
+	// message twice---because at that point there will be a dupe Message-ID.
+	// Any other error saved nothing, so the client can simply retry.
+	// Drafts are sent with their own message ID, and deleted with it.
+	err = DeliverDraft(userID.EmailAddress, email, boxes)
+	if errors.Is(err, ErrDuplicate) {
+		http.Error(w, "Already sent.", http.StatusConflict)
+		return
+	} else if err != nil {
+		storeError(w, err)
+		return
+	}
+
 	// Deliver mail outside synchronously
 	// In the future we may want more advanced logic.
 	err = SmtpSend(outgoingEmail)
@@ -366,6 +1286,213 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
 	}
 }
 
+//
+// DRAFTS ROUTE
+//
+
+type DraftSaveResponse struct {
+	Version int64 // pass it back to save again
+}
+
+// POST /drafts/ creates a draft, with the message ID it will be sent with.
+// GET /drafts/<id> loads one, PUT /drafts/<id> saves over it
+// and DELETE /drafts/<id> deletes it.
+//
+// Saving takes the Version the draft was loaded or last saved at.
+// If it was saved since, eg from another tab, the save fails with
+// 409 Conflict instead of overwriting it.
+func draftsHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	id := r.URL.Path[len("/drafts/"):]
+	if id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+			return
+		}
+		draft := parseDraftForm(r, validateMessageID(r.FormValue("msgID")))
+		if !checkDraftSize(w, draft, userID) {
+			return
+		}
+		if err := CreateDraft(userID.EmailAddress, draft); err != nil {
+			storeError(w, err)
+			return
+		}
+		writeDraftSaveResponse(w, draft)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		draft, err := LoadDraft(userID.EmailAddress, id)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		resJSON, err := json.Marshal(draft)
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resJSON)
+	case "PUT":
+		draft := parseDraftForm(r, id)
+		version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		draft.Version = version
+		if !checkDraftSize(w, draft, userID) {
+			return
+		}
+		if err := UpdateDraft(userID.EmailAddress, draft); err != nil {
+			storeError(w, err)
+			return
+		}
+		writeDraftSaveResponse(w, draft)
+	case "DELETE":
+		if err := DeleteDraft(userID.EmailAddress, id); err != nil {
+			storeError(w, err)
+		}
+	default:
+		http.Error(w, "Expected GET, PUT or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// Reads a draft like emailSendHandler reads an encrypted email
+func parseDraftForm(r *http.Request, messageID string) *Draft {
+	draft := &Draft{MessageID: messageID, ThreadID: messageID}
+	if r.FormValue("threadID") != "" {
+		draft.ThreadID = validateMessageID(r.FormValue("threadID"))
+	}
+	draft.AncestorIDs = ParseAngledEmailAddresses(r.FormValue("ancestorIDs"), " ").
+		AngledStringCappedToBytes(" ", GetConfig().AncestorIDsMaxBytes)
+	draft.To = r.FormValue("to")
+	draft.CipherSubject = validateMessageArmor(r.FormValue("cipherSubject"))
+	draft.CipherBody = validateMessageArmor(r.FormValue("cipherBody"))
+	draft.UnixTime = time.Now().Unix()
+	return draft
+}
+
+// Drafts are held to the same limits as the email they become.
+// A save replaces the draft's old body, which is in the usage already.
+func checkDraftSize(w http.ResponseWriter, draft *Draft, userID *UserID) bool {
+	if len(draft.CipherBody) > GetConfig().MaxEmailSize {
+		http.Error(w, "Draft too big", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	user, err := LoadUser(userID.Token)
+	var usage *StorageUsage
+	if err == nil {
+		usage, err = LoadStorageUsage(user)
+	}
+	var replaced int64
+	if err == nil {
+		replaced, err = loadDraftSize(userID.EmailAddress, draft.MessageID)
+	}
+	if err != nil {
+		storeError(w, err)
+		return false
+	}
+	if !usage.HasRoomFor(int64(len(draft.CipherBody)) - replaced) {
+		http.Error(w, "Your mailbox is full. Delete some mail and try again.",
+			http.StatusInsufficientStorage)
+		return false
+	}
+	return true
+}
+
+// The size of the body of a saved draft, or 0 if there's no such draft
+func loadDraftSize(address string, messageID string) (int64, error) {
+	draft, err := LoadDraft(address, messageID)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(len(draft.CipherBody)), nil
+}
+
+func writeDraftSaveResponse(w http.ResponseWriter, draft *Draft) {
+	resJSON, err := json.Marshal(DraftSaveResponse{draft.Version})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJSON)
+}
+
+//
+// SEARCH ROUTE
+//
+
+// How many tokens a message can have, about as many distinct words
+const maxSearchTokens = 2000
+
+// How many tokens a search can have
+const maxSearchTerms = 20
+
+// PUT /search/<id> replaces the search tokens of one of the user's messages,
+// one token= per distinct word. GET /search/?token= lists the threads with a
+// message that has every token, like /box/ does, as the box "search".
+//
+// A token is the hex HMAC-SHA256 of a word, keyed with a secret only the
+// user's client has, so the server can match words without knowing them.
+func searchHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
+	id := r.URL.Path[len("/search/"):]
+	r.ParseForm()
+	if id != "" {
+		if r.Method != "PUT" {
+			http.Error(w, "Expected PUT", http.StatusMethodNotAllowed)
+			return
+		}
+		tokens := r.PostForm["token"]
+		if len(tokens) > maxSearchTokens {
+			http.Error(w, fmt.Sprintf("Expected at most %d tokens", maxSearchTokens), http.StatusBadRequest)
+			return
+		}
+		for _, token := range tokens {
+			validateSearchToken(token)
+		}
+		if err := SaveSearchTokens(userID.EmailAddress, validateMessageID(id), tokens); err != nil {
+			storeError(w, err)
+		}
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	tokens := r.URL.Query()["token"]
+	if len(tokens) == 0 || len(tokens) > maxSearchTerms {
+		http.Error(w, fmt.Sprintf("Expected 1 to %d tokens", maxSearchTerms), http.StatusBadRequest)
+		return
+	}
+	for _, token := range tokens {
+		validateSearchToken(token)
+	}
+	useOffset, offset, limit, after, ok := parseBoxPage(w, r)
+	if !ok {
+		return
+	}
+
+	var emailHeaders []EmailHeader
+	var next *BoxCursor
+	var err error
+	if useOffset {
+		emailHeaders, err = SearchByThread(userID.EmailAddress, tokens, offset, limit)
+	} else {
+		emailHeaders, next, err = SearchByThreadAfter(userID.EmailAddress, tokens, after, limit)
+	}
+	var total int
+	if err == nil {
+		total, err = CountSearch(userID.EmailAddress, tokens)
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeBoxSummary(w, userID, "search", offset, limit, total, emailHeaders, next)
+}
+
 //
 // NGINX
 //
@@ -413,9 +1540,14 @@ func notaryHandler(w http.ResponseWriter, r *http.Request) {
 
 // Handler for receiving new address & hashes from other Scramble servers.
 // This is how this notary knows what the pubHash is for a given address.
+// A name keeps its first hash, only the tombstone of a deleted account
+// replaces it.
 func publicKeySeedHandler(w http.ResponseWriter, r *http.Request) {
 	address := ParseEmailAddress(r.FormValue("address"))
-	pubHash := validateHash(r.FormValue("pubHash"))
+	pubHash := r.FormValue("pubHash")
+	if pubHash != TombstoneHash {
+		validateHash(pubHash)
+	}
 	timestamp, err := strconv.ParseInt(r.FormValue("timestamp"), 10, 64)
 	if err != nil {
 		panic(errors.New("invalid timestamp"))
@@ -429,7 +1561,11 @@ func publicKeySeedHandler(w http.ResponseWriter, r *http.Request) {
 		log.Panicf("Cannot seed address %v, mx lookup failed.", address.String())
 	}
 
-	mxHostInfo := GetMxHostInfo(mxHost)
+	mxHostInfo, err := GetMxHostInfo(mxHost)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		storeError(w, err)
+		return
+	}
 	if mxHostInfo == nil || mxHostInfo.NotaryPublicKey == "" {
 		resp, err := http.Get("https://" + mxHost + "/publickeys/notary")
 		if err != nil {
@@ -448,14 +1584,26 @@ func publicKeySeedHandler(w http.ResponseWriter, r *http.Request) {
 			log.Panicf("Cannot seed address %v,"+
 				" could not parse mx host notary info. %v", address.String(), err)
 		}
-		mxHostInfo = SetMxHostInfo(mxHost, true, parsed.PubKey)
+		mxHostInfo, err = SetMxHostInfo(mxHost, true, parsed.PubKey)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
 	}
 
 	signed := StringForNotaryToSign(address.Name, address.Host, pubHash, timestamp)
 	ok := VerifySignature(mxHostInfo.NotaryPublicKey, signed, signature)
 
 	if ok {
-		AddNameResolution(address.Name, address.Host, pubHash)
+		if pubHash == TombstoneHash {
+			err = SetNameResolution(address.Name, address.Host, pubHash)
+		} else {
+			err = AddNameResolution(address.Name, address.Host, pubHash)
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
 		// TODO respond with our own signature to speed up user account creation.
 	} else {
 		log.Panicf("Cannot seed address %v, bad signature!", address.String())
@@ -526,7 +1674,12 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 	// Prepare MxHostInfos
 	mxHostInfos := map[string]*MxHostInfo{}
 	for mxHost := range needPubKeyByMxHost {
-		mxHostInfos[mxHost] = GetMxHostInfo(mxHost)
+		mxHostInfo, err := GetMxHostInfo(mxHost)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			storeError(w, err)
+			return
+		}
+		mxHostInfos[mxHost] = mxHostInfo
 	}
 
 	// Prepare response structure
@@ -574,7 +1727,12 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 				signedResults := map[string]*NotarySignedResult{}
 				thisResult := &NotaryResultError{signedResults, ""}
 				for _, addr := range request.NeedResolution {
-					pubHash := ResolveName(addr.Name, addr.Host)
+					pubHash, err := ResolveName(addr.Name, addr.Host)
+					if err != nil {
+						log.Printf("Name resolution for %v failed: %v", addr.String(), err)
+						thisResult = &NotaryResultError{nil, "Name resolution failed. Please try again."}
+						break
+					}
 					// pubHash may be "", and that's a ok.
 					signedResults[addr.String()] = &NotarySignedResult{
 						pubHash,
@@ -586,13 +1744,19 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			// Second, handle pubkey lookup
 			for _, addr := range request.NeedPubKey {
-				pubHash := LoadPubHash(addr.Name, addr.Host)
-				if pubHash == "" {
+				pubHash, err := LoadPubHash(addr.Name, addr.Host)
+				var pubKey string
+				if err == nil {
+					pubKey, err = LoadPubKey(pubHash)
+				}
+				if errors.Is(err, ErrNotFound) {
 					res.PublicKeys[addr.String()] = &PublicKeysPubKeyError{PublicKeysStatusNoSuchUser, "", "Unknown address " + addr.String()}
-					continue
+				} else if err != nil {
+					log.Printf("Public key lookup for %v failed: %v", addr.String(), err)
+					res.PublicKeys[addr.String()] = &PublicKeysPubKeyError{PublicKeysStatusError, "", "Failed to retrieve public key"}
+				} else {
+					res.PublicKeys[addr.String()] = &PublicKeysPubKeyError{PublicKeysStatusOK, pubKey, ""}
 				}
-				pubKey := LoadPubKey(pubHash)
-				res.PublicKeys[addr.String()] = &PublicKeysPubKeyError{PublicKeysStatusOK, pubKey, ""}
 			}
 		} else {
 			// Make secondary request
@@ -632,7 +1796,7 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 					// Yahoo's mxHost times out like this.
 					// Assume the mxHost isn't a scramble host.
 					if mxHostInfos[mxHost] == nil {
-						mxHostInfos[mxHost] = TrySetMxHostInfo(mxHost, false, "")
+						mxHostInfos[mxHost] = trySetMxHostInfoLogged(mxHost, false)
 					}
 					continue
 				}
@@ -648,14 +1812,14 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					// Assume the mxHost isn't a scramble host.
 					if mxHostInfos[mxHost] == nil {
-						mxHostInfos[mxHost] = TrySetMxHostInfo(mxHost, false, "")
+						mxHostInfos[mxHost] = trySetMxHostInfoLogged(mxHost, false)
 					}
 					log.Println("Error in /publickeys/query json parse: %s", err.Error())
 					continue
 				} else {
 					// Hey, a scramble host.
 					if mxHostInfos[mxHost] == nil {
-						mxHostInfos[mxHost] = TrySetMxHostInfo(mxHost, true, "")
+						mxHostInfos[mxHost] = trySetMxHostInfoLogged(mxHost, true)
 					}
 				}
 				// aggregate notary responses
@@ -725,7 +1889,7 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 					// Gmail's mxHost times out like this.
 					// Assume the mxHost isn't a scramble host.
 					if mxHostInfos[mxHostRespErr.MxHost] == nil {
-						TrySetMxHostInfo(mxHostRespErr.MxHost, false, "")
+						trySetMxHostInfoLogged(mxHostRespErr.MxHost, false)
 					}
 					continue
 				}
@@ -735,6 +1899,17 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
+// Remembers whether an mx host runs Scramble, if we didn't know yet.
+// A database error just means we'll find out again next time.
+func trySetMxHostInfoLogged(mxHost string, isScramble bool) *MxHostInfo {
+	mxHostInfo, err := TrySetMxHostInfo(mxHost, isScramble, "")
+	if err != nil {
+		log.Printf("Could not save mx host info for %s: %v", mxHost, err)
+		return nil
+	}
+	return mxHostInfo
+}
+
 // POST /publickeys/reverse to lookup name from pubhash
 // This exists to upgrade legacy contacts lists.
 func reverseQueryHandler(w http.ResponseWriter, r *http.Request, userID *UserID) {
@@ -744,7 +1919,11 @@ func reverseQueryHandler(w http.ResponseWriter, r *http.Request, userID *UserID)
 		if pubHash == "" {
 			continue
 		}
-		address := LoadAddressFromPubHash(pubHash)
+		address, err := LoadAddressFromPubHash(pubHash)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			storeError(w, err)
+			return
+		}
 		res[pubHash] = address
 	}
 	resJSON, err := json.Marshal(res)
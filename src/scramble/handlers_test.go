@@ -2,12 +2,15 @@ package scramble
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -47,12 +50,20 @@ OewXcIuOdtHovjU05JwUjYcg30lZ
 
 	DeleteUser(user.Token)
 	DeleteNameResolution(user.Token, user.EmailHost)
-	SaveUser(user)
-	AddNameResolution(user.Token, user.EmailHost, user.PublicHash)
+	if err := SaveUser(user); err != nil {
+		panic(err)
+	}
+	if err := AddNameResolution(user.Token, user.EmailHost, user.PublicHash); err != nil {
+		panic(err)
+	}
 }
 
 func loadTestUser() *User {
-	return LoadUser("test")
+	user, err := LoadUser("test")
+	if err != nil {
+		panic(err)
+	}
+	return user
 }
 
 func requestLoggedIn(handler http.HandlerFunc, method string, path string, form url.Values) *httptest.ResponseRecorder {
@@ -123,3 +134,319 @@ func TestPublicKeysHandler(t *testing.T) {
 	}
 
 }
+
+func TestStoreError(t *testing.T) {
+	for err, code := range map[error]int{
+		ErrNotFound:                       http.StatusNotFound,
+		fmt.Errorf("%w: x", ErrDuplicate): http.StatusConflict,
+		fmt.Errorf("%w: x", ErrConflict):  http.StatusConflict,
+		errors.New("connection refused"):  http.StatusServiceUnavailable,
+	} {
+		record := httptest.NewRecorder()
+		storeError(record, err)
+		if record.Code != code {
+			t.Errorf("storeError(%v) sent %d, expected %d", err, record.Code, code)
+		}
+	}
+}
+
+func TestBoxCursor(t *testing.T) {
+	cursor := &BoxCursor{1380000000, "thread id with spaces@example.com"}
+	decoded, err := decodeBoxCursor(encodeBoxCursor(cursor))
+	if err != nil || *decoded != *cursor {
+		t.Errorf("Expected %v, got %v, %v", cursor, decoded, err)
+	}
+	if _, err := decodeBoxCursor("not a cursor"); err == nil {
+		t.Error("Expected an error decoding garbage")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	handler := auth(sessionsHandler)
+	request := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		handler(record, req)
+		return record
+	}
+	passHeaders := map[string]string{
+		"x-scramble-token":    "test",
+		"x-scramble-passHash": "5026f031ceea00023da878da2be4660ae85040e8",
+	}
+
+	record := request("POST", "/user/me/sessions", passHeaders)
+	var created NewSessionResponse
+	if err := json.Unmarshal(record.Body.Bytes(), &created); err != nil || created.Session == "" {
+		t.Fatalf("Expected a new session, got %d %s", record.Code, record.Body.String())
+	}
+	sessionHeaders := map[string]string{"x-scramble-session": created.Session}
+
+	record = request("GET", "/user/me/sessions", sessionHeaders)
+	var sessions []SessionResponse
+	json.Unmarshal(record.Body.Bytes(), &sessions)
+	found := false
+	for _, session := range sessions {
+		found = found || (session.ID == created.ID && session.IsCurrent)
+	}
+	if record.Code != http.StatusOK || !found {
+		t.Errorf("Expected the session to be listed as current, got %d %s", record.Code, record.Body.String())
+	}
+	if record = request("POST", "/user/me/sessions", sessionHeaders); record.Code != http.StatusForbidden {
+		t.Errorf("Expected a session not to start another one, got %d", record.Code)
+	}
+
+	path := fmt.Sprintf("/user/me/sessions/%d", created.ID)
+	if record = request("DELETE", path, sessionHeaders); record.Code != http.StatusOK {
+		t.Errorf("Expected the session to end, got %d %s", record.Code, record.Body.String())
+	}
+	if record = request("GET", "/user/me/sessions", sessionHeaders); record.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an ended session to be refused, got %d", record.Code)
+	}
+	if record = request("GET", "/user/me/sessions", passHeaders); record.Code != http.StatusOK {
+		t.Errorf("Expected the passphrase hash to still work, got %d", record.Code)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	handler := auth(twoFactorHandler)
+	request := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("x-scramble-token", "test")
+		req.Header.Set("x-scramble-passHash", "5026f031ceea00023da878da2be4660ae85040e8")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		handler(record, req)
+		return record
+	}
+	defer DeleteTwoFactor("test")
+
+	// a session alone can't turn two-factor on
+	_, secret, err := createSession("test", "192.0.2.1", "test", time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/user/me/twofactor", nil)
+	req.Header.Set("x-scramble-session", secret)
+	handler(record, req)
+	if record.Code != http.StatusForbidden {
+		t.Errorf("Expected enrolling without the passphrase to be refused, got %d", record.Code)
+	}
+	if _, err := LoadTwoFactor("test"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected no enrollment, got %v", err)
+	}
+
+	record = request("POST", "/user/me/twofactor?passHash=5026f031ceea00023da878da2be4660ae85040e8", nil)
+	var enroll TwoFactorEnrollResponse
+	if err := json.Unmarshal(record.Body.Bytes(), &enroll); err != nil || enroll.Secret == "" {
+		t.Fatalf("Expected a new secret, got %d %s", record.Code, record.Body.String())
+	}
+	key, _ := totpEncoding.DecodeString(enroll.Secret)
+	step := time.Now().Unix() / totpStepSecs
+	record = request("PUT", "/user/me/twofactor?code="+totpCode(key, step), nil)
+	var recovery RecoveryCodesResponse
+	if err := json.Unmarshal(record.Body.Bytes(), &recovery); err != nil || len(recovery.RecoveryCodes) == 0 {
+		t.Fatalf("Expected recovery codes, got %d %s", record.Code, record.Body.String())
+	}
+
+	record = request("GET", "/user/me/twofactor", nil)
+	if record.Code != http.StatusUnauthorized || record.Header().Get("X-Scramble-Two-Factor") != "needed" {
+		t.Errorf("Expected the passphrase hash alone to be refused, got %d", record.Code)
+	}
+	code := map[string]string{"x-scramble-code": totpCode(key, step+1)}
+	if record = request("GET", "/user/me/twofactor", code); record.Code != http.StatusOK {
+		t.Errorf("Expected a fresh code to log in, got %d %s", record.Code, record.Body.String())
+	}
+	if record = request("GET", "/user/me/twofactor", code); record.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a code not to work twice, got %d", record.Code)
+	}
+	recoveryCode := map[string]string{"x-scramble-code": recovery.RecoveryCodes[0]}
+	if record = request("GET", "/user/me/twofactor", recoveryCode); record.Code != http.StatusOK {
+		t.Errorf("Expected a recovery code to log in, got %d %s", record.Code, record.Body.String())
+	}
+	if record = request("GET", "/user/me/twofactor", recoveryCode); record.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a recovery code not to work twice, got %d", record.Code)
+	}
+
+	// guessing the code to turn it off is throttled like logins
+	defer recordLoginSuccess("test")
+	for i := 0; i <= accountLimits.freeFailures; i++ {
+		record = httptest.NewRecorder()
+		req = httptest.NewRequest("DELETE", "/user/me/twofactor?code=000000", nil)
+		req.RemoteAddr = "198.51.100.8:1234"
+		req.Header.Set("x-scramble-session", secret)
+		handler(record, req)
+	}
+	if record.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected guessing codes to be throttled, got %d %s", record.Code, record.Body.String())
+	}
+	recordLoginSuccess("test")
+
+	path := "/user/me/twofactor?code=" + recovery.RecoveryCodes[2]
+	if record = request("DELETE", path, map[string]string{"x-scramble-code": recovery.RecoveryCodes[1]}); record.Code != http.StatusOK {
+		t.Errorf("Expected two-factor to turn off, got %d %s", record.Code, record.Body.String())
+	}
+	if record = request("GET", "/user/me/twofactor", nil); record.Code != http.StatusOK {
+		t.Errorf("Expected the passphrase hash alone to work again, got %d", record.Code)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	handler := auth(deleteAccountHandler)
+	request := func(passHash string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		form := url.Values{"passHash": {passHash}}
+		req := httptest.NewRequest("POST", "/user/me/delete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-scramble-token", "test")
+		req.Header.Set("x-scramble-passHash", "5026f031ceea00023da878da2be4660ae85040e8")
+		handler(record, req)
+		return record
+	}
+	defer createTestUser()
+	user := loadTestUser()
+
+	if record := request("wrong"); record.Code != http.StatusForbidden {
+		t.Errorf("Expected a wrong passphrase to be refused, got %d", record.Code)
+	}
+	if _, err := LoadUser("test"); err != nil {
+		t.Fatalf("Expected the user to stay, got %v", err)
+	}
+	if record := request("5026f031ceea00023da878da2be4660ae85040e8"); record.Code != http.StatusOK {
+		t.Fatalf("Expected the account to be deleted, got %d %s", record.Code, record.Body.String())
+	}
+	if _, err := LoadUser("test"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the user to be gone, got %v", err)
+	}
+	if hash, err := ResolveName("test", GetConfig().SMTPMxHost); err != nil || hash != TombstoneHash {
+		t.Errorf("Expected the name to resolve to the tombstone, got %q, %v", hash, err)
+	}
+
+	// nobody gets the name again
+	form := url.Values{
+		"token":            {"test"},
+		"passHash":         {user.PasswordHash},
+		"publicKey":        {user.PublicKey},
+		"cipherPrivateKey": {user.CipherPrivateKey},
+	}
+	record := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/user/new", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = GetConfig().SMTPMxHost
+	createHandler(record, req)
+	if record.Code != http.StatusBadRequest || !strings.Contains(record.Body.String(), "taken") {
+		t.Errorf("Expected the name to be taken, got %d %s", record.Code, record.Body.String())
+	}
+	if _, err := LoadUser("test"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected no new user, got %v", err)
+	}
+}
+
+func TestChangePassphraseTwoFactor(t *testing.T) {
+	passHash := "5026f031ceea00023da878da2be4660ae85040e8"
+	twoFactor := func(method, path string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("x-scramble-token", "test")
+		req.Header.Set("x-scramble-passHash", passHash)
+		auth(twoFactorHandler)(record, req)
+		return record
+	}
+	defer createTestUser()
+	defer DeleteTwoFactor("test")
+	user := loadTestUser()
+
+	var enroll TwoFactorEnrollResponse
+	json.Unmarshal(twoFactor("POST", "/user/me/twofactor?passHash="+passHash).Body.Bytes(), &enroll)
+	key, _ := totpEncoding.DecodeString(enroll.Secret)
+	code := totpCode(key, time.Now().Unix()/totpStepSecs)
+	record := twoFactor("PUT", "/user/me/twofactor?code="+code)
+	var recovery RecoveryCodesResponse
+	if err := json.Unmarshal(record.Body.Bytes(), &recovery); err != nil || len(recovery.RecoveryCodes) < 5 {
+		t.Fatalf("Expected recovery codes, got %d %s", record.Code, record.Body.String())
+	}
+
+	// logged in with the second factor, changing to the same passphrase
+	request := func(loginCode, code string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		form := url.Values{
+			"oldPassHash":      {passHash},
+			"passHash":         {passHash},
+			"cipherPrivateKey": {user.CipherPrivateKey},
+			"code":             {code},
+		}
+		req := httptest.NewRequest("POST", "/user/me/passphrase", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-scramble-token", "test")
+		req.Header.Set("x-scramble-passHash", passHash)
+		req.Header.Set("x-scramble-code", loginCode)
+		auth(passphraseHandler)(record, req)
+		return record
+	}
+	if record = request(recovery.RecoveryCodes[0], ""); record.Code != http.StatusForbidden {
+		t.Errorf("Expected a change without a code to be refused, got %d", record.Code)
+	}
+	if record = request(recovery.RecoveryCodes[1], "wrong"); record.Code != http.StatusForbidden {
+		t.Errorf("Expected a change with a wrong code to be refused, got %d", record.Code)
+	}
+	if record = request(recovery.RecoveryCodes[2], recovery.RecoveryCodes[3]); record.Code != http.StatusOK {
+		t.Errorf("Expected a change with a code to work, got %d %s", record.Code, record.Body.String())
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	ip := "198.51.100.7"
+	defer recordLoginSuccess("test")
+	for i := 0; i < accountLimits.lockoutFailures; i++ {
+		recordLoginFailure("test", ip)
+	}
+	record := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/user/me/twofactor", nil)
+	req.RemoteAddr = ip + ":1234"
+	req.Header.Set("x-scramble-token", "test")
+	req.Header.Set("x-scramble-passHash", "5026f031ceea00023da878da2be4660ae85040e8")
+	auth(twoFactorHandler)(record, req)
+	if record.Code != http.StatusTooManyRequests || record.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the account to be locked out, got %d %s", record.Code, record.Body.String())
+	}
+}
+
+func TestJanitorStats(t *testing.T) {
+	request := func() *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/admin/janitor", nil)
+		req.Header.Set("x-scramble-token", "test")
+		req.Header.Set("x-scramble-passHash", "5026f031ceea00023da878da2be4660ae85040e8")
+		auth(janitorStatsHandler)(record, req)
+		return record
+	}
+	if record := request(); record.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admins to be refused, got %d", record.Code)
+	}
+
+	conf := GetConfig()
+	defer func(admins []string, dryRun bool) {
+		conf.AdminEmails, conf.JanitorDryRun = admins, dryRun
+	}(conf.AdminEmails, conf.JanitorDryRun)
+	conf.AdminEmails = []string{loadTestUser().EmailAddress}
+	conf.JanitorDryRun = true
+	before := GetJanitorStats()
+	janitorRunSafe()
+
+	record := request()
+	var stats JanitorStats
+	if err := json.Unmarshal(record.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Expected the stats, got %d %s", record.Code, record.Body.String())
+	}
+	if stats.Runs != before.Runs+1 || stats.LastRun == 0 {
+		t.Errorf("Expected one more run, got %+v", stats)
+	}
+	if _, ok := stats.Deleted["sessions"]; !ok {
+		t.Errorf("Expected counts by rule, got %v", stats.Deleted)
+	}
+}
@@ -0,0 +1,171 @@
+/**
+ * Deletes what has outlived the retention settings in the config:
+ * mail trashed more than TrashRetentionDays ago, sent mail older than
+ * SentRetentionDays, emails no box refers to anymore, blobs no email
+ * refers to, search tokens of mail that's gone, stale mx_hosts probes,
+ * and expired sessions.
+ *
+ * Runs in the background every JanitorIntervalMins.
+ * With JanitorDryRun, only counts and logs what it would delete.
+ * Users in AdminEmails see the counts at GET /admin/janitor.
+ */
+
+package scramble
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Selects box rows for the janitor to delete
+type BoxPurge struct {
+	Box       string
+	Before    int64    // unix time, newer rows are kept
+	Addresses []string // only these addresses, or everyone if empty
+	Except    []string // never these addresses
+}
+
+// An email stays around this long after its last box row is gone,
+// so that a message being delivered is never deleted halfway
+const orphanEmailGraceSecs = 24 * 60 * 60
+
+// What the janitor deleted since startup, by rule.
+// In a dry run, what it would have deleted.
+type JanitorStats struct {
+	Runs    int
+	Errors  int
+	LastRun int64 // unix time
+	Deleted map[string]int64
+}
+
+var janitorStats = JanitorStats{Deleted: map[string]int64{}}
+var janitorStatsMutex sync.Mutex
+
+// Returns a copy of the janitor's counters
+func GetJanitorStats() JanitorStats {
+	janitorStatsMutex.Lock()
+	defer janitorStatsMutex.Unlock()
+	stats := janitorStats
+	stats.Deleted = map[string]int64{}
+	for rule, count := range janitorStats.Deleted {
+		stats.Deleted[rule] = count
+	}
+	return stats
+}
+
+func StartJanitor() {
+	interval := GetConfig().JanitorIntervalMins
+	if interval == 0 {
+		log.Printf("Janitor is off, set JanitorIntervalMins in config to purge old mail")
+		return
+	}
+	go func() {
+		for {
+			janitorRunSafe()
+			time.Sleep(time.Duration(interval) * time.Minute)
+		}
+	}()
+}
+
+// wrap in func to Recover per run, such that the janitor never dies
+func janitorRunSafe() {
+	defer Recover()
+	conf := GetConfig()
+	now := time.Now().Unix()
+	deleted, errs := runJanitor(getStore(), blobs, conf, now)
+
+	janitorStatsMutex.Lock()
+	janitorStats.Runs++
+	janitorStats.Errors += len(errs)
+	janitorStats.LastRun = now
+	for rule, count := range deleted {
+		janitorStats.Deleted[rule] += count
+	}
+	janitorStatsMutex.Unlock()
+
+	verb := "deleted"
+	if conf.JanitorDryRun {
+		verb = "would delete (dry run)"
+	}
+	log.Printf("Janitor %s %s", verb, formatJanitorCounts(deleted))
+	for _, err := range errs {
+		log.Printf("Janitor error: %v", err)
+	}
+}
+
+// Applies each retention rule once. A rule that fails doesn't stop the rest.
+// Returns the number of rows deleted by each rule.
+func runJanitor(s Store, b BlobStore, conf *Config, now int64) (map[string]int64, []error) {
+	deleted := map[string]int64{}
+	var errs []error
+	dryRun := conf.JanitorDryRun
+	daysAgo := func(days int) int64 {
+		return now - int64(days)*24*60*60
+	}
+	tally := func(rule string, count int64, err error) {
+		deleted[rule] += count
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rule, err))
+		}
+	}
+
+	if conf.TrashRetentionDays > 0 {
+		count, err := s.PurgeTrash(daysAgo(conf.TrashRetentionDays), dryRun)
+		tally("trash", count, err)
+	}
+
+	// users who chose their own sent retention, then everyone else
+	overrides, err := s.LoadSentRetentionDays()
+	tally("sent", 0, err)
+	if err == nil {
+		var addresses []string
+		for address, days := range overrides {
+			addresses = append(addresses, address)
+			count, err := s.PurgeBox(BoxPurge{
+				Box:       "sent",
+				Before:    daysAgo(days),
+				Addresses: []string{address},
+			}, dryRun)
+			tally("sent", count, err)
+		}
+		if conf.SentRetentionDays > 0 {
+			count, err := s.PurgeBox(BoxPurge{
+				Box:    "sent",
+				Before: daysAgo(conf.SentRetentionDays),
+				Except: addresses,
+			}, dryRun)
+			tally("sent", count, err)
+		}
+	}
+
+	// in a dry run, this only counts emails that are orphans already
+	count, err := s.PurgeOrphanEmails(now-orphanEmailGraceSecs, dryRun)
+	tally("emails", count, err)
+	count, err = collectBlobs(b, s.IsBlobReferenced,
+		time.Unix(now-orphanEmailGraceSecs, 0), dryRun)
+	tally("blobs", count, err)
+	count, err = s.PurgeOrphanSearchTokens(dryRun)
+	tally("search_tokens", count, err)
+
+	if conf.MxHostRetentionDays > 0 {
+		count, err := s.PurgeMxHosts(daysAgo(conf.MxHostRetentionDays), dryRun)
+		tally("mx_hosts", count, err)
+	}
+	count, err = s.PurgeSessions(now, dryRun)
+	tally("sessions", count, err)
+	return deleted, errs
+}
+
+// eg "emails=2 sent=0 trash=14"
+func formatJanitorCounts(counts map[string]int64) string {
+	var parts []string
+	for rule, count := range counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", rule, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,71 @@
+package scramble
+
+import (
+	"strings"
+	"testing"
+)
+
+const day = 24 * 60 * 60
+
+func TestJanitor(t *testing.T) {
+	s := newMemoryStore()
+	now := int64(100 * day)
+	for _, token := range []string{"alice", "bob"} {
+		user := &User{UserID: UserID{Token: token, PublicHash: token + "bbbbccccdddd", EmailHost: "local.scramble.io"}}
+		if err := s.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetSentRetentionDays("alice", 5)
+	alice, bob := "alice@local.scramble.io", "bob@local.scramble.io"
+	for _, delivery := range []struct {
+		id  string
+		age int64
+		box MessageBox
+	}{
+		{"trash-old@x.com", 40, MessageBox{bob, "trash"}},
+		{"trash-new@x.com", 20, MessageBox{bob, "trash"}},
+		{"alice-sent@x.com", 7, MessageBox{alice, "sent"}},
+		{"bob-sent@x.com", 7, MessageBox{bob, "sent"}},
+	} {
+		e := newTestEmail(delivery.id, delivery.id, now-delivery.age*day)
+		if err := s.DeliverMessage(e, []MessageBox{delivery.box}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveSearchTokens(bob, "trash-old@x.com", []string{strings.Repeat("a", 64)}); err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{TrashRetentionDays: 30, SentRetentionDays: 10, JanitorDryRun: true}
+
+	deleted, errs := runJanitor(s, newMemoryBlobStore(), conf, now)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if deleted["trash"] != 1 || deleted["sent"] != 1 || deleted["emails"] != 0 {
+		t.Errorf("Expected a dry run to find trash=1 sent=1, got %s", formatJanitorCounts(deleted))
+	}
+	if _, err := s.LoadMessage("trash-old@x.com"); err != nil {
+		t.Errorf("Expected a dry run not to delete anything, got %v", err)
+	}
+
+	conf.JanitorDryRun = false
+	deleted, errs = runJanitor(s, newMemoryBlobStore(), conf, now)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	// the purged rows were the last references to their emails
+	if deleted["trash"] != 1 || deleted["sent"] != 1 || deleted["emails"] != 2 || deleted["search_tokens"] != 1 {
+		t.Errorf("Expected trash=1 sent=1 emails=2 search_tokens=1, got %s", formatJanitorCounts(deleted))
+	}
+	for id, kept := range map[string]bool{
+		"trash-old@x.com":  false,
+		"trash-new@x.com":  true,
+		"alice-sent@x.com": false, // alice keeps sent mail 5 days
+		"bob-sent@x.com":   true,  // everyone else 10
+	} {
+		if _, err := s.LoadMessage(id); (err == nil) != kept {
+			t.Errorf("Expected %s kept=%v, got %v", id, kept, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/**
+ * Migrating by hand, for scramble-migrate.
+ *
+ * By default every process that uses this package brings the database up
+ * to date when it first opens the store, see openStore. With
+ * DbManualMigrations set it only connects, and the servers refuse to start
+ * while migrations are pending. scramble-migrate always sets it.
+ */
+
+package scramble
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// A migration in the code, in the database, or both
+type MigrationStatus struct {
+	Version  int // the database is at this version once it ran
+	Name     string
+	Applied  bool
+	UnixTime int64 // when it was applied, or when an older database recorded it
+
+	SQL         []string
+	HasCode     bool // also runs Go code, which SQL doesn't show
+	DownSQL     []string
+	HasDownCode bool
+	CanRollBack bool
+
+	// why the history doesn't match the code, if it doesn't
+	Problem string
+}
+
+// The migrations for the kind of database s is
+func (s *sqlStore) migrations() []migration {
+	switch s.dialect.(type) {
+	case postgresDialect:
+		return postgresMigrations
+	case sqliteDialect:
+		return sqliteMigrations
+	}
+	return mysqlMigrations
+}
+
+func migrationStore() (*sqlStore, error) {
+	s, ok := getStore().(*sqlStore)
+	if !ok {
+		return nil, errors.New("the memory store has no migrations")
+	}
+	return s, nil
+}
+
+// Loads every migration the code or the database knows, oldest first
+func LoadMigrationStatus() ([]MigrationStatus, error) {
+	s, err := migrationStore()
+	if err != nil {
+		return nil, err
+	}
+	migrations := s.migrations()
+	var statuses []MigrationStatus
+	err = withMigrationLock(s.db, s.dialect, migrations, func(_ *sql.Conn, history []appliedMigration) error {
+		statuses = migrationStatuses(history, migrations)
+		return nil
+	})
+	return statuses, err
+}
+
+func migrationStatuses(history []appliedMigration, migrations []migration) []MigrationStatus {
+	var statuses []MigrationStatus
+	for i := 0; i < len(history) || i < len(migrations); i++ {
+		status := MigrationStatus{Version: i + 1}
+		if i < len(migrations) {
+			m := migrations[i]
+			status.Name = m.name
+			status.SQL = m.sql
+			status.HasCode = m.code != nil
+			status.DownSQL = m.down
+			status.HasDownCode = m.downCode != nil
+			status.CanRollBack = m.canRollBack()
+		}
+		if i < len(history) {
+			applied := history[i]
+			status.Applied = true
+			status.UnixTime = applied.unixTime
+			if i >= len(migrations) {
+				status.Name = applied.name
+				status.Problem = "not in the code"
+			} else if applied.name != status.Name {
+				status.Problem = fmt.Sprintf("the database ran %s", applied.name)
+			} else if applied.checksum != migrations[i].checksum() {
+				status.Problem = "changed since it ran"
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Runs the pending migrations
+func Migrate() error {
+	s, err := migrationStore()
+	if err != nil {
+		return err
+	}
+	return runMigrations(s.db, s.dialect, s.migrations())
+}
+
+// Rolls back the last steps migrations, newest first
+func RollBackMigrations(steps int) error {
+	s, err := migrationStore()
+	if err != nil {
+		return err
+	}
+	return rollBackMigrations(s.db, s.dialect, s.migrations(), steps)
+}
+
+// Returns an error if the database isn't up to date with the code.
+// With DbManualMigrations set, a server must not run until it is.
+func CheckMigrations() error {
+	s, ok := getStore().(*sqlStore)
+	if !ok {
+		return nil
+	}
+	migrations := s.migrations()
+	return withMigrationLock(s.db, s.dialect, migrations, func(_ *sql.Conn, history []appliedMigration) error {
+		if err := checkMigrationHistory(history, migrations); err != nil {
+			return err
+		}
+		if pending := len(migrations) - len(history); pending > 0 {
+			return fmt.Errorf("%d migrations are pending, run scramble-migrate up", pending)
+		}
+		return nil
+	})
+}
@@ -1,69 +1,353 @@
 package scramble
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"strings"
+	"time"
 )
 
-var migrations = []func() error{
-	migrateCreateUser,
-	migrateCreateEmail,
-	migrateAddContacts,
-	migratePasswordHash,
-	migrateEmailRefactor,
-	migrateLengthenSubject,
-	migrateShortenToken,
-	migrateAddUserEmailAddress,
-	migrateCreateNameResolution,
-	migrateMakeNameResolutionUnique,
-	migrateEmailThreading,
-	migrateBoxAddForeignKey,
-	migrateBoxAddError,
-	migrateCreateMxHosts,
-	migrateAddNotaryKey,
-	migrateAddNameResolutionTimestamp,
-	migrateBoxRemoveError,
-	migrateAddUserSecondaryEmail,
-	migrateAddUnreadEmail,
-	migrateAddUserBan,
-}
-
-func migrateDb() {
-	// create the table, if needed
-	_, err := db.Exec(`create table if not exists migration (
-        version int not null
-    ) collate=ascii_bin`)
-	if err != nil {
+var mysqlMigrations = []migration{
+	{name: "migrateCreateUser", sql: migrateCreateUser},
+	{name: "migrateCreateEmail", sql: migrateCreateEmail},
+	{name: "migrateAddContacts", sql: migrateAddContacts},
+	{name: "migratePasswordHash", sql: migratePasswordHash},
+	{name: "migrateEmailRefactor", code: migrateEmailRefactor},
+	{name: "migrateLengthenSubject", sql: migrateLengthenSubject},
+	{name: "migrateShortenToken", sql: migrateShortenToken},
+	{name: "migrateAddUserEmailAddress", code: migrateAddUserEmailAddress},
+	{name: "migrateCreateNameResolution", code: migrateCreateNameResolution},
+	{name: "migrateMakeNameResolutionUnique", sql: migrateMakeNameResolutionUnique},
+	{name: "migrateEmailThreading", code: migrateEmailThreading},
+	{name: "migrateBoxAddForeignKey", sql: migrateBoxAddForeignKey},
+	{name: "migrateBoxAddError", sql: migrateBoxAddError},
+	{name: "migrateCreateMxHosts", sql: migrateCreateMxHosts},
+	{name: "migrateAddNotaryKey", sql: migrateAddNotaryKey},
+	{name: "migrateAddNameResolutionTimestamp", sql: migrateAddNameResolutionTimestamp},
+	{name: "migrateBoxRemoveError", sql: migrateBoxRemoveError},
+	{name: "migrateAddUserSecondaryEmail", sql: migrateAddUserSecondaryEmail},
+	{name: "migrateAddUnreadEmail", sql: migrateAddUnreadEmail},
+	{name: "migrateAddUserBan", sql: migrateAddUserBan},
+	{name: "migrateAddRetention", sql: migrateAddRetention, down: migrateAddRetentionDown},
+	{name: "migrateAddUserQuota", sql: migrateAddUserQuota, down: migrateAddUserQuotaDown},
+	{name: "migrateAddEmailBodyRef", sql: migrateAddEmailBodyRef, down: migrateAddEmailBodyRefDown},
+	{name: "migrateMoveBodiesToBlobs", code: migrateMoveBodiesToBlobs,
+		down: migrateMoveBodiesToBlobsDown, downCode: migrateMoveBodiesFromBlobs},
+	{name: "migrateAddTrash", sql: migrateAddTrash, down: migrateAddTrashDown},
+	{name: "migrateAddLabels", sql: migrateAddLabels, down: migrateAddLabelsDown},
+	{name: "migrateAddDrafts", sql: migrateAddDrafts, down: migrateAddDraftsDown},
+	{name: "migrateAddFlags", sql: migrateAddFlags, down: migrateAddFlagsDown},
+	{name: "migrateAddSearchTokens", sql: migrateAddSearchTokens, down: migrateAddSearchTokensDown},
+	{name: "migrateAddSessions", sql: migrateAddSessions, down: migrateAddSessionsDown},
+	{name: "migrateAddTwoFactor", sql: migrateAddTwoFactor, down: migrateAddTwoFactorDown},
+}
+
+// One step in bringing a database up to date: sql runs first, then code.
+// Each step runs in a transaction of its own.
+//
+// Rolling a step back runs down, then downCode. Steps without either
+// can't be rolled back, see rollBackMigrations.
+type migration struct {
+	name     string
+	sql      []string
+	code     func(db migrationDB) error
+	down     []string
+	downCode func(db migrationDB) error
+}
+
+// What migrations run against, a *sql.DB or *sql.Tx
+type migrationDB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Hashes the name and SQL of a migration, so that a database whose history
+// doesn't match the code is noticed. Changes to Go code aren't covered,
+// nor are down steps, which can be added after a migration ran.
+func (m migration) checksum() string {
+	hash := sha256.Sum256([]byte(m.name + "\x00" + strings.Join(m.sql, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+func (m migration) canRollBack() bool {
+	return m.down != nil || m.downCode != nil
+}
+
+// A migration the database has seen, from the migration_history table
+type appliedMigration struct {
+	version  int
+	name     string
+	checksum string
+	unixTime int64
+}
+
+// Brings a database up to date by running the migrations it hasn't seen yet.
+// Each backend has its own list of migrations.
+func migrateDb(db *sql.DB, dialect sqlDialect, migrations []migration) {
+	if err := runMigrations(db, dialect, migrations); err != nil {
 		panic(err)
 	}
+}
 
-	// what version are we at? lock it
-	var version int
-	err = db.QueryRow("select version from migration").Scan(&version)
-	if err == sql.ErrNoRows {
-		version = 0
-	} else if err != nil {
-		panic(err)
+// Runs the pending migrations while holding the migration lock, so that
+// processes starting at the same time (scramble and scramble-notify, say)
+// don't both apply them. Refuses to run anything if the history recorded
+// in the database doesn't match the migrations in the code.
+func runMigrations(db *sql.DB, dialect sqlDialect, migrations []migration) error {
+	return withMigrationLock(db, dialect, migrations, func(conn *sql.Conn, history []appliedMigration) error {
+		if err := checkMigrationHistory(history, migrations); err != nil {
+			return err
+		}
+		for version := len(history); version < len(migrations); version++ {
+			err := inMigrationStep(conn, func(tx *sql.Tx) error {
+				return applyMigration(tx, dialect, migrations[version], version)
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d, %s: %w", version+1, migrations[version].name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Rolls back the last steps migrations, newest first. Refuses to if
+// any of them has no down step, or if the history doesn't match the code.
+func rollBackMigrations(db *sql.DB, dialect sqlDialect, migrations []migration, steps int) error {
+	return withMigrationLock(db, dialect, migrations, func(conn *sql.Conn, history []appliedMigration) error {
+		if err := checkMigrationHistory(history, migrations); err != nil {
+			return err
+		}
+		if steps > len(history) {
+			return fmt.Errorf("can't roll back %d migrations, the database has seen %d",
+				steps, len(history))
+		}
+		for version := len(history); version > len(history)-steps; version-- {
+			if !migrations[version-1].canRollBack() {
+				return fmt.Errorf("can't roll back migration %d, %s has no down step",
+					version, migrations[version-1].name)
+			}
+		}
+		for version := len(history); version > len(history)-steps; version-- {
+			err := inMigrationStep(conn, func(tx *sql.Tx) error {
+				return rollBackMigration(tx, dialect, migrations[version-1], version)
+			})
+			if err != nil {
+				return fmt.Errorf("rolling back migration %d, %s: %w",
+					version, migrations[version-1].name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Takes the migration lock, makes sure the migration tables exist,
+// then calls fn with the history. Steps that fn runs have to use conn,
+// which holds the lock.
+func withMigrationLock(db *sql.DB, dialect sqlDialect, migrations []migration,
+	fn func(conn *sql.Conn, history []appliedMigration) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	unlock, err := dialect.lockMigrations(conn)
+	if err != nil {
+		return fmt.Errorf("locking migrations: %w", err)
+	}
+	defer unlock()
+
+	for _, query := range []string{
+		`create table if not exists migration (
+            version int not null
+        )`,
+		`create table if not exists migration_history (
+            version int not null primary key,
+            name varchar(255) not null,
+            checksum varchar(64) not null,
+            unix_time bigint not null
+        )`,
+	} {
+		if _, err = conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	err = inMigrationStep(conn, func(tx *sql.Tx) error {
+		return initMigrationHistory(tx, dialect, migrations)
+	})
+	if err != nil {
+		return err
 	}
 
-	// apply migrations
-	for ; version < len(migrations); version++ {
-		log.Printf("Migrating DB version %d to %d\n", version, version+1)
-		err = migrations[version]()
-		if err != nil {
-			panic(err)
+	history, err := loadMigrationHistory(conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, history)
+}
+
+// Returns an error if the migrations the database has seen
+// aren't the first ones in the code
+func checkMigrationHistory(history []appliedMigration, migrations []migration) error {
+	if len(history) > len(migrations) {
+		return fmt.Errorf("database has seen %d migrations, the code only knows %d. "+
+			"Is this an older version of scramble?", len(history), len(migrations))
+	}
+	for i, applied := range history {
+		m := migrations[i]
+		if applied.version != i+1 || applied.name != m.name || applied.checksum != m.checksum() {
+			return fmt.Errorf("migration %d in the database is %s (%s), "+
+				"the code has %s (%s)", i+1, applied.name, applied.checksum, m.name, m.checksum())
 		}
-		if version == 0 {
-			_, err = db.Exec("insert into migration(version) values (?)", version+1)
-		} else {
-			_, err = db.Exec("update migration set version=?", version+1)
+	}
+	return nil
+}
+
+// Runs fn in a transaction on conn. The transaction starts by writing to
+// the migration table, which takes SQLite's write lock before anything
+// is read.
+//
+// MySQL commits implicitly after DDL, so a failed step there can leave
+// part of its changes behind. Its version isn't recorded, though.
+func inMigrationStep(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("update migration set version = version")
+	if err == nil {
+		err = fn(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Makes sure the migration table has its row. Databases migrated before
+// there was a history get one, trusting that they ran the migrations
+// the code has now.
+func initMigrationHistory(tx *sql.Tx, dialect sqlDialect, migrations []migration) error {
+	var rows, recorded int
+	err := tx.QueryRow("select count(*) from migration").Scan(&rows)
+	if err == nil && rows == 0 {
+		_, err = tx.Exec("insert into migration (version) values (0)")
+	}
+	if err == nil {
+		err = tx.QueryRow("select count(*) from migration_history").Scan(&recorded)
+	}
+	if err != nil || recorded > 0 {
+		return err
+	}
+	version, err := loadMigrationVersion(tx)
+	if err != nil || version == 0 {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at migration version %d, the code only knows %d",
+			version, len(migrations))
+	}
+	log.Printf("Recording the history of %d earlier migrations\n", version)
+	for i, m := range migrations[:version] {
+		if err = recordMigration(tx, dialect, m, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies migration m, which brings the database from version to version+1,
+// unless another process got there first
+func applyMigration(tx *sql.Tx, dialect sqlDialect, m migration, version int) error {
+	current, err := loadMigrationVersion(tx)
+	if err != nil || current > version {
+		return err
+	}
+	log.Printf("Migrating DB version %d to %d, %s\n", version, version+1, m.name)
+	for _, query := range m.sql {
+		if _, err = tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	if m.code != nil {
+		if err = m.code(tx); err != nil {
+			return err
+		}
+	}
+	if err = recordMigration(tx, dialect, m, version+1); err != nil {
+		return err
+	}
+	_, err = tx.Exec(dialect.rebind("update migration set version = ?"), version+1)
+	return err
+}
+
+// Rolls back migration m, which brought the database from version-1
+// to version, unless another process rolled it back first
+func rollBackMigration(tx *sql.Tx, dialect sqlDialect, m migration, version int) error {
+	current, err := loadMigrationVersion(tx)
+	if err != nil || current != version {
+		return err
+	}
+	log.Printf("Rolling back DB version %d to %d, %s\n", version, version-1, m.name)
+	for _, query := range m.down {
+		if _, err = tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	if m.downCode != nil {
+		if err = m.downCode(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(dialect.rebind("delete from migration_history where version = ?"), version)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(dialect.rebind("update migration set version = ?"), version-1)
+	return err
+}
+
+func recordMigration(tx *sql.Tx, dialect sqlDialect, m migration, version int) error {
+	_, err := tx.Exec(dialect.rebind("insert into migration_history "+
+		"(version, name, checksum, unix_time) values (?, ?, ?, ?)"),
+		version, m.name, m.checksum(), time.Now().Unix())
+	return err
+}
+
+func loadMigrationHistory(conn *sql.Conn) ([]appliedMigration, error) {
+	rows, err := conn.QueryContext(context.Background(),
+		"select version, name, checksum, unix_time from migration_history order by version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []appliedMigration
+	for rows.Next() {
+		var applied appliedMigration
+		if err = rows.Scan(&applied.version, &applied.name, &applied.checksum, &applied.unixTime); err != nil {
+			return nil, err
 		}
+		history = append(history, applied)
 	}
+	return history, rows.Err()
 }
 
-func migrateCreateUser() error {
-	_, err := db.Exec(`create table if not exists user (
+// Returns how many migrations the database has seen
+func loadMigrationVersion(db migrationDB) (version int, err error) {
+	err = db.QueryRow("select version from migration").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+var migrateCreateUser = []string{`create table if not exists user (
         token varchar(100) not null,
         password_hash char(40) not null,
         public_hash char(40) not null,
@@ -72,12 +356,9 @@ func migrateCreateUser() error {
 
         primary key (token),
         unique index (public_hash)
-    ) collate=ascii_bin`)
-	return err
-}
+    ) collate=ascii_bin`}
 
-func migrateCreateEmail() error {
-	_, err := db.Exec(`create table if not exists email (
+var migrateCreateEmail = []string{`create table if not exists email (
         message_id char(40) not null,
         unix_time bigint not null,
         box enum ('inbox','outbox','sent','archive','trash') not null,
@@ -93,27 +374,18 @@ func migrateCreateEmail() error {
         primary key (message_id, pub_hash_to),
         index (pub_hash_to, box),
         index (pub_hash_from)
-    ) collate=ascii_bin`)
-	return err
-}
+    ) collate=ascii_bin`}
 
-func migrateAddContacts() error {
-	_, err := db.Exec(`alter table user add column cipher_contacts longtext`)
-	return err
-}
+var migrateAddContacts = []string{`alter table user add column cipher_contacts longtext`}
 
-func migratePasswordHash() error {
-	_, err := db.Exec(`alter table user 
+var migratePasswordHash = []string{
+	`alter table user 
         add column password_hash_old char(160) not null default "" 
-        after password_hash`)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec(`update user set password_hash_old=password_hash, password_hash=""`)
-	return err
+        after password_hash`,
+	`update user set password_hash_old=password_hash, password_hash=""`,
 }
 
-func migrateEmailRefactor() error {
+func migrateEmailRefactor(db migrationDB) error {
 
 	// Migration of existing data
 	// Load everything onto memory, wipe table, then reinsert.
@@ -249,17 +521,11 @@ func migrateEmailRefactor() error {
 	return err
 }
 
-func migrateLengthenSubject() error {
-	_, err := db.Exec(`ALTER TABLE email MODIFY cipher_subject TEXT`)
-	return err
-}
+var migrateLengthenSubject = []string{`ALTER TABLE email MODIFY cipher_subject TEXT`}
 
-func migrateShortenToken() error {
-	_, err := db.Exec(`ALTER TABLE user MODIFY token VARCHAR(64)`)
-	return err
-}
+var migrateShortenToken = []string{`ALTER TABLE user MODIFY token VARCHAR(64)`}
 
-func migrateAddUserEmailAddress() error {
+func migrateAddUserEmailAddress(db migrationDB) error {
 	_, err := db.Exec(`ALTER TABLE user ADD COLUMN email_host VARCHAR(254) NOT NULL DEFAULT ""`)
 	if err != nil {
 		return err
@@ -268,7 +534,7 @@ func migrateAddUserEmailAddress() error {
 	return err
 }
 
-func migrateCreateNameResolution() error {
+func migrateCreateNameResolution(db migrationDB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS name_resolution (
 		name           VARCHAR(64),
 		host           VARCHAR(255),
@@ -294,11 +560,14 @@ func migrateCreateNameResolution() error {
 		log.Printf("%s@%s > %s@%s", pubHash, emailHost, token, emailHost)
 		convertMap[pubHash+"@"+emailHost] = token + "@" + emailHost
 	}
-	// Convert all address rows in box
+	// Convert all address rows in box.
+	// Migrations run in a transaction, on a single connection,
+	// so all rows are read before any of them are updated.
 	rows, err = db.Query(`SELECT id, address FROM box`)
 	if err != nil {
 		return err
 	}
+	boxUpdates := [][]interface{}{}
 	for rows.Next() {
 		var id, address string
 		err := rows.Scan(&id, &address)
@@ -310,8 +579,10 @@ func migrateCreateNameResolution() error {
 			log.Printf("Could not translate address in box: %s %s", id, address)
 			continue
 		}
-		_, err = db.Exec(`UPDATE box SET address=? WHERE id=?`,
-			newAddress, id)
+		boxUpdates = append(boxUpdates, []interface{}{newAddress, id})
+	}
+	for _, update := range boxUpdates {
+		_, err = db.Exec(`UPDATE box SET address=? WHERE id=?`, update...)
 		if err != nil {
 			return err
 		}
@@ -321,6 +592,7 @@ func migrateCreateNameResolution() error {
 	if err != nil {
 		return err
 	}
+	emailUpdates := [][]interface{}{}
 	for rows.Next() {
 		var id, fromEmail, toEmail string
 		err := rows.Scan(&id, &fromEmail, &toEmail)
@@ -342,8 +614,10 @@ func migrateCreateNameResolution() error {
 			newToEmailArray = append(newToEmailArray, newToEmail)
 		}
 		var newToEmail = strings.Join(newToEmailArray, ",")
-		_, err = db.Exec(`UPDATE email SET from_email=?, to_email=? WHERE message_id=?`,
-			newFromEmail, newToEmail, id)
+		emailUpdates = append(emailUpdates, []interface{}{newFromEmail, newToEmail, id})
+	}
+	for _, update := range emailUpdates {
+		_, err = db.Exec(`UPDATE email SET from_email=?, to_email=? WHERE message_id=?`, update...)
 		if err != nil {
 			return err
 		}
@@ -352,17 +626,13 @@ func migrateCreateNameResolution() error {
 	return err
 }
 
-func migrateMakeNameResolutionUnique() error {
-	// some MySQL versions will crap out when dropping/adding the same index in one line.
-	_, err := db.Exec(`ALTER TABLE name_resolution DROP INDEX host`)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec(`ALTER TABLE name_resolution ADD UNIQUE INDEX (host, name)`)
-	return err
+// some MySQL versions will crap out when dropping/adding the same index in one line.
+var migrateMakeNameResolutionUnique = []string{
+	`ALTER TABLE name_resolution DROP INDEX host`,
+	`ALTER TABLE name_resolution ADD UNIQUE INDEX (host, name)`,
 }
 
-func migrateEmailThreading() error {
+func migrateEmailThreading(db migrationDB) error {
 	_, err := db.Exec(`ALTER TABLE email ` +
 		`MODIFY message_id VARCHAR(255) NOT NULL, ` +
 		`ADD COLUMN ancestor_ids VARCHAR(10240) NOT NULL, ` +
@@ -401,59 +671,298 @@ func migrateEmailThreading() error {
 	return err
 }
 
-func migrateBoxAddForeignKey() error {
-	_, err := db.Exec(`ALTER TABLE box ADD FOREIGN KEY (message_id) REFERENCES email(message_id)`)
-	return err
-}
+var migrateBoxAddForeignKey = []string{`ALTER TABLE box ADD FOREIGN KEY (message_id) REFERENCES email(message_id)`}
 
-func migrateBoxAddError() error {
-	_, err := db.Exec(`ALTER TABLE box ADD COLUMN error TEXT`)
-	return err
-}
+var migrateBoxAddError = []string{`ALTER TABLE box ADD COLUMN error TEXT`}
 
-func migrateCreateMxHosts() error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS mx_hosts (
+var migrateCreateMxHosts = []string{`CREATE TABLE IF NOT EXISTS mx_hosts (
         host         VARCHAR(254) NOT NULL,
         is_scramble  BOOL NOT NULL,
         unix_time    BIGINT NOT NULL,
 
         PRIMARY KEY (host)
-    ) collate=ascii_bin`)
-	return err
+    ) collate=ascii_bin`}
+
+var migrateAddNotaryKey = []string{`ALTER TABLE mx_hosts ADD COLUMN notary_public_key TEXT`}
+
+var migrateAddNameResolutionTimestamp = []string{`ALTER TABLE name_resolution ADD COLUMN unix_time BIGINT NOT NULL`}
+
+var migrateBoxRemoveError = []string{`ALTER TABLE box DROP COLUMN error`}
+
+var migrateAddUserSecondaryEmail = []string{`ALTER TABLE user ADD COLUMN
+        secondary_email VARCHAR(254) NOT NULL
+	`}
+
+var migrateAddUnreadEmail = []string{`ALTER TABLE box ADD COLUMN
+		is_read BOOLEAN NOT NULL DEFAULT FALSE;
+	`}
+
+var migrateAddUserBan = []string{`ALTER TABLE user ADD COLUMN
+		is_banned BOOLEAN NOT NULL DEFAULT FALSE;
+	`}
+
+var migrateAddRetention = []string{
+	`ALTER TABLE user ADD COLUMN
+		sent_retention_days INT NOT NULL DEFAULT 0;
+	`,
+	// the janitor purges by box across all users
+	`ALTER TABLE box ADD INDEX box_box_time (box, unix_time)`,
 }
 
-func migrateAddNotaryKey() error {
-	_, err := db.Exec(`ALTER TABLE mx_hosts ADD COLUMN notary_public_key TEXT`)
-	return err
+var migrateAddRetentionDown = []string{
+	`ALTER TABLE box DROP INDEX box_box_time`,
+	`ALTER TABLE user DROP COLUMN sent_retention_days`,
 }
 
-func migrateAddNameResolutionTimestamp() error {
-	_, err := db.Exec(`ALTER TABLE name_resolution ADD COLUMN unix_time BIGINT NOT NULL`)
+var migrateAddUserQuota = []string{`ALTER TABLE user ADD COLUMN
+		quota_bytes BIGINT NOT NULL DEFAULT 0;
+	`}
+
+var migrateAddUserQuotaDown = []string{`ALTER TABLE user DROP COLUMN quota_bytes`}
+
+var migrateAddEmailBodyRef = []string{`ALTER TABLE email
+		ADD COLUMN body_ref CHAR(64) NOT NULL DEFAULT '',
+		ADD COLUMN body_size BIGINT NOT NULL DEFAULT 0,
+		ADD INDEX email_body_ref (body_ref);
+	`}
+
+var migrateAddEmailBodyRefDown = []string{`ALTER TABLE email
+		DROP INDEX email_body_ref,
+		DROP COLUMN body_ref,
+		DROP COLUMN body_size
+	`}
+
+func migrateMoveBodiesToBlobs(db migrationDB) error {
+	err := moveBodiesToBlobs(db, mysqlDialect{})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE email DROP COLUMN cipher_body`)
 	return err
 }
 
-func migrateBoxRemoveError() error {
-	_, err := db.Exec(`ALTER TABLE box DROP COLUMN error`)
-	return err
+var migrateMoveBodiesToBlobsDown = []string{`ALTER TABLE email ADD COLUMN
+		cipher_body LONGTEXT NOT NULL`}
+
+func migrateMoveBodiesFromBlobs(db migrationDB) error {
+	return moveBodiesFromBlobs(db, mysqlDialect{})
 }
 
-func migrateAddUserSecondaryEmail() error {
-	_, err := db.Exec(`ALTER TABLE user ADD COLUMN
-        secondary_email VARCHAR(254) NOT NULL
-	`)
-	return err
+// Trash used to delete right away, so anything in it got there directly.
+// The janitor purges trash by trashed_time.
+var migrateAddTrash = []string{
+	`ALTER TABLE box
+		ADD COLUMN trashed_from VARCHAR(20) NOT NULL DEFAULT '',
+		ADD COLUMN trashed_time BIGINT NOT NULL DEFAULT 0
+	`,
+	`UPDATE box SET trashed_time = unix_time WHERE box = 'trash'`,
 }
 
-func migrateAddUnreadEmail() error {
-	_, err := db.Exec(`ALTER TABLE box ADD COLUMN
-		is_read BOOLEAN NOT NULL DEFAULT FALSE;
-	`)
-	return err
+var migrateAddTrashDown = []string{`ALTER TABLE box
+		DROP COLUMN trashed_from,
+		DROP COLUMN trashed_time
+	`}
+
+// Label names are encrypted by the client, like subjects.
+// Labels go on box rows, so they are per user and per message.
+var migrateAddLabels = []string{
+	`CREATE TABLE IF NOT EXISTS label (
+        id          BIGINT NOT NULL AUTO_INCREMENT,
+        address     VARCHAR(254) NOT NULL,
+        cipher_name TEXT NOT NULL,
+        unix_time   BIGINT NOT NULL,
+
+        PRIMARY KEY (id),
+        INDEX label_address (address)
+    ) collate=ascii_bin`,
+	`CREATE TABLE IF NOT EXISTS box_label (
+        box_id   BIGINT NOT NULL,
+        label_id BIGINT NOT NULL,
+
+        PRIMARY KEY (box_id, label_id),
+        INDEX box_label_label (label_id),
+        FOREIGN KEY (box_id) REFERENCES box(id) ON DELETE CASCADE,
+        FOREIGN KEY (label_id) REFERENCES label(id) ON DELETE CASCADE
+    ) collate=ascii_bin`,
 }
 
-func migrateAddUserBan() error {
-	_, err := db.Exec(`ALTER TABLE user ADD COLUMN
-		is_banned BOOLEAN NOT NULL DEFAULT FALSE;
-	`)
-	return err
+var migrateAddLabelsDown = []string{
+	`DROP TABLE box_label`,
+	`DROP TABLE label`,
+}
+
+// Drafts are rewritten on every autosave, so their bodies stay
+// in the table rather than in the content-addressed blob store.
+var migrateAddDrafts = []string{`CREATE TABLE IF NOT EXISTS draft (
+        address        VARCHAR(254) NOT NULL,
+        message_id     VARCHAR(255) NOT NULL,
+        thread_id      VARCHAR(255) NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT NOT NULL,
+        cipher_body    LONGTEXT NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        version        BIGINT NOT NULL,
+
+        PRIMARY KEY (address, message_id),
+        INDEX draft_address_time (address, unix_time)
+    ) collate=ascii_bin`}
+
+var migrateAddDraftsDown = []string{`DROP TABLE draft`}
+
+// A bit set, see Flags
+var migrateAddFlags = []string{`ALTER TABLE box ADD COLUMN
+		flags INT NOT NULL DEFAULT 0;
+	`}
+
+var migrateAddFlagsDown = []string{`ALTER TABLE box DROP COLUMN flags`}
+
+// Keyed hashes of the words in messages, made by the client,
+// so the server can search without seeing the words
+var migrateAddSearchTokens = []string{`CREATE TABLE IF NOT EXISTS search_token (
+        address    VARCHAR(254) NOT NULL,
+        token      CHAR(64) NOT NULL,
+        message_id VARCHAR(255) NOT NULL,
+
+        PRIMARY KEY (address, token, message_id),
+        INDEX search_token_message (address, message_id)
+    ) collate=ascii_bin`}
+
+var migrateAddSearchTokensDown = []string{`DROP TABLE search_token`}
+
+// Logins that stand in for the passphrase hash, see auth.go.
+// hash is the SHA-256 of the secret the client holds.
+var migrateAddSessions = []string{`CREATE TABLE IF NOT EXISTS session (
+        id           BIGINT NOT NULL AUTO_INCREMENT,
+        hash         CHAR(64) NOT NULL,
+        token        VARCHAR(100) NOT NULL,
+        ip           VARCHAR(45) NOT NULL,
+        user_agent   VARCHAR(255) NOT NULL,
+        created_time BIGINT NOT NULL,
+        expires_time BIGINT NOT NULL,
+
+        PRIMARY KEY (id),
+        UNIQUE INDEX session_hash (hash),
+        INDEX session_token (token),
+        INDEX session_expires (expires_time)
+    ) collate=ascii_bin`}
+
+var migrateAddSessionsDown = []string{`DROP TABLE session`}
+
+// TOTP second factors, see totp.go. enabled_time stays 0 until the user
+// confirms a code. Recovery codes are kept as SHA-256 hashes.
+var migrateAddTwoFactor = []string{
+	`CREATE TABLE IF NOT EXISTS two_factor (
+        token        VARCHAR(100) NOT NULL,
+        secret       VARCHAR(64) NOT NULL,
+        enabled_time BIGINT NOT NULL,
+        last_step    BIGINT NOT NULL,
+
+        PRIMARY KEY (token)
+    ) collate=ascii_bin`,
+	`CREATE TABLE IF NOT EXISTS recovery_code (
+        token VARCHAR(100) NOT NULL,
+        hash  CHAR(64) NOT NULL,
+
+        PRIMARY KEY (token, hash)
+    ) collate=ascii_bin`,
+}
+
+var migrateAddTwoFactorDown = []string{
+	`DROP TABLE recovery_code`,
+	`DROP TABLE two_factor`,
+}
+
+// Moves cipher bodies into the blob store, one batch at a time,
+// so that the email table never has to fit in memory.
+// Safe to run again if it fails part-way.
+func moveBodiesToBlobs(db migrationDB, dialect sqlDialect) error {
+	moved := 0
+	for {
+		rows, err := db.Query(`SELECT message_id, cipher_body FROM email
+			WHERE body_ref = '' LIMIT 100`)
+		if err != nil {
+			return err
+		}
+		var ids, bodies []string
+		for rows.Next() {
+			var id, body string
+			if err := rows.Scan(&id, &body); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			bodies = append(bodies, body)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			log.Printf("Moved %d bodies to the blob store\n", moved)
+			return nil
+		}
+
+		for i, id := range ids {
+			ref, err := blobs.Put([]byte(bodies[i]))
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec(dialect.rebind(`UPDATE email
+				SET body_ref = ?, body_size = ?, cipher_body = ''
+				WHERE message_id = ?`), ref, len(bodies[i]), id)
+			if err != nil {
+				return err
+			}
+		}
+		moved += len(ids)
+		log.Printf("Moved %d bodies to the blob store so far\n", moved)
+	}
+}
+
+// Undoes moveBodiesToBlobs, for rolling back to a version of scramble
+// without the blob store. The blobs aren't deleted, so that migrating
+// up again doesn't have to write them all.
+func moveBodiesFromBlobs(db migrationDB, dialect sqlDialect) error {
+	moved := 0
+	for {
+		rows, err := db.Query(`SELECT message_id, body_ref FROM email
+			WHERE body_ref != '' LIMIT 100`)
+		if err != nil {
+			return err
+		}
+		var ids, refs []string
+		for rows.Next() {
+			var id, ref string
+			if err := rows.Scan(&id, &ref); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			refs = append(refs, ref)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			log.Printf("Moved %d bodies back from the blob store\n", moved)
+			return nil
+		}
+
+		for i, id := range ids {
+			body, err := blobs.Get(refs[i])
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec(dialect.rebind(`UPDATE email
+				SET cipher_body = ?, body_ref = '', body_size = 0
+				WHERE message_id = ?`), string(body), id)
+			if err != nil {
+				return err
+			}
+		}
+		moved += len(ids)
+		log.Printf("Moved %d bodies back from the blob store so far\n", moved)
+	}
 }
@@ -0,0 +1,239 @@
+package scramble
+
+// Like sqliteMigrations, the first migration creates the schema
+// that mysqlMigrations build up, later ones must keep them in step.
+//
+// "user" is a reserved word in Postgres, so it is always quoted.
+// CHAR columns become VARCHAR, Postgres would pad them with spaces.
+// Message and thread IDs use the C collation so that they sort
+// byte for byte, like collate=ascii_bin.
+var postgresMigrations = []migration{
+	{name: "postgresMigrateCreateSchema", sql: postgresMigrateCreateSchema},
+	{name: "postgresMigrateAddRetention", sql: postgresMigrateAddRetention, down: postgresMigrateAddRetentionDown},
+	{name: "postgresMigrateAddUserQuota", sql: postgresMigrateAddUserQuota, down: postgresMigrateAddUserQuotaDown},
+	{name: "postgresMigrateAddEmailBodyRef", sql: postgresMigrateAddEmailBodyRef, down: postgresMigrateAddEmailBodyRefDown},
+	{name: "postgresMigrateMoveBodiesToBlobs", code: postgresMigrateMoveBodiesToBlobs,
+		down: postgresMigrateMoveBodiesToBlobsDown, downCode: postgresMigrateMoveBodiesFromBlobs},
+	{name: "postgresMigrateAddTrash", sql: postgresMigrateAddTrash, down: postgresMigrateAddTrashDown},
+	{name: "postgresMigrateAddLabels", sql: postgresMigrateAddLabels, down: postgresMigrateAddLabelsDown},
+	{name: "postgresMigrateAddDrafts", sql: postgresMigrateAddDrafts, down: postgresMigrateAddDraftsDown},
+	{name: "postgresMigrateAddFlags", sql: postgresMigrateAddFlags, down: postgresMigrateAddFlagsDown},
+	{name: "postgresMigrateAddSearchTokens", sql: postgresMigrateAddSearchTokens, down: postgresMigrateAddSearchTokensDown},
+	{name: "postgresMigrateAddSessions", sql: postgresMigrateAddSessions, down: postgresMigrateAddSessionsDown},
+	{name: "postgresMigrateAddTwoFactor", sql: postgresMigrateAddTwoFactor, down: postgresMigrateAddTwoFactorDown},
+}
+
+var postgresMigrateCreateSchema = []string{
+	`CREATE TABLE IF NOT EXISTS "user" (
+        token              VARCHAR(64) NOT NULL,
+        password_hash      VARCHAR(40) NOT NULL,
+        password_hash_old  VARCHAR(160) NOT NULL DEFAULT '',
+        public_hash        VARCHAR(40) NOT NULL,
+        public_key         VARCHAR(4000) NOT NULL,
+        cipher_private_key VARCHAR(4000) NOT NULL,
+        cipher_contacts    TEXT,
+        email_host         VARCHAR(254) NOT NULL DEFAULT '',
+        secondary_email    VARCHAR(254) NOT NULL,
+        is_banned          BOOLEAN NOT NULL DEFAULT FALSE,
+
+        PRIMARY KEY (token),
+        UNIQUE (public_hash)
+    )`,
+	`CREATE TABLE IF NOT EXISTS email (
+        message_id     VARCHAR(255) COLLATE "C" NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        from_email     VARCHAR(254) NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT,
+        cipher_body    TEXT NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        thread_id      VARCHAR(255) COLLATE "C" NOT NULL,
+
+        PRIMARY KEY (message_id)
+    )`,
+	`CREATE TABLE IF NOT EXISTS box (
+        id         BIGSERIAL PRIMARY KEY,
+        message_id VARCHAR(255) COLLATE "C" NOT NULL REFERENCES email(message_id),
+        address    VARCHAR(254) NOT NULL,
+        box        TEXT NOT NULL CHECK (box IN ('inbox','outbox','sent','archive','trash','outbox-sent','outbox-processing')),
+        unix_time  BIGINT NOT NULL,
+        thread_id  VARCHAR(255) COLLATE "C" NOT NULL,
+        is_read    BOOLEAN NOT NULL DEFAULT FALSE
+    )`,
+	`CREATE INDEX IF NOT EXISTS box_address_box_time ON box (address, box, unix_time)`,
+	`CREATE INDEX IF NOT EXISTS box_address_message ON box (address, message_id)`,
+	`CREATE INDEX IF NOT EXISTS box_address_box_thread ON box (address, box, thread_id, unix_time)`,
+	`CREATE TABLE IF NOT EXISTS name_resolution (
+        name      VARCHAR(64),
+        host      VARCHAR(255),
+        hash      VARCHAR(16),
+        unix_time BIGINT NOT NULL,
+
+        UNIQUE (host, name)
+    )`,
+	`CREATE TABLE IF NOT EXISTS mx_hosts (
+        host              VARCHAR(254) NOT NULL,
+        is_scramble       BOOLEAN NOT NULL,
+        unix_time         BIGINT NOT NULL,
+        notary_public_key TEXT,
+
+        PRIMARY KEY (host)
+    )`,
+}
+
+// the janitor purges by box across all users, and looks for
+// emails no box row references. MySQL indexes foreign keys itself.
+var postgresMigrateAddRetention = []string{
+	`ALTER TABLE "user" ADD COLUMN
+        sent_retention_days INT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS box_box_time ON box (box, unix_time)`,
+	`CREATE INDEX IF NOT EXISTS box_message ON box (message_id)`,
+}
+
+var postgresMigrateAddRetentionDown = []string{
+	`DROP INDEX IF EXISTS box_message`,
+	`DROP INDEX IF EXISTS box_box_time`,
+	`ALTER TABLE "user" DROP COLUMN sent_retention_days`,
+}
+
+var postgresMigrateAddUserQuota = []string{`ALTER TABLE "user" ADD COLUMN
+        quota_bytes BIGINT NOT NULL DEFAULT 0`}
+
+var postgresMigrateAddUserQuotaDown = []string{`ALTER TABLE "user" DROP COLUMN quota_bytes`}
+
+var postgresMigrateAddEmailBodyRef = []string{
+	`ALTER TABLE email
+        ADD COLUMN body_ref VARCHAR(64) NOT NULL DEFAULT '',
+        ADD COLUMN body_size BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS email_body_ref ON email (body_ref)`,
+}
+
+var postgresMigrateAddEmailBodyRefDown = []string{
+	`DROP INDEX IF EXISTS email_body_ref`,
+	`ALTER TABLE email DROP COLUMN body_ref`,
+	`ALTER TABLE email DROP COLUMN body_size`,
+}
+
+func postgresMigrateMoveBodiesToBlobs(db migrationDB) error {
+	err := moveBodiesToBlobs(db, postgresDialect{})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE email DROP COLUMN cipher_body`)
+	return err
+}
+
+var postgresMigrateMoveBodiesToBlobsDown = []string{`ALTER TABLE email ADD COLUMN
+		cipher_body TEXT NOT NULL DEFAULT ''`}
+
+func postgresMigrateMoveBodiesFromBlobs(db migrationDB) error {
+	return moveBodiesFromBlobs(db, postgresDialect{})
+}
+
+var postgresMigrateAddTrash = []string{
+	`ALTER TABLE box ADD COLUMN trashed_from VARCHAR(20) NOT NULL DEFAULT ''`,
+	`ALTER TABLE box ADD COLUMN trashed_time BIGINT NOT NULL DEFAULT 0`,
+	`UPDATE box SET trashed_time = unix_time WHERE box = 'trash'`,
+}
+
+var postgresMigrateAddTrashDown = []string{
+	`ALTER TABLE box DROP COLUMN trashed_from`,
+	`ALTER TABLE box DROP COLUMN trashed_time`,
+}
+
+var postgresMigrateAddLabels = []string{
+	`CREATE TABLE IF NOT EXISTS label (
+        id          BIGSERIAL PRIMARY KEY,
+        address     VARCHAR(254) NOT NULL,
+        cipher_name TEXT NOT NULL,
+        unix_time   BIGINT NOT NULL
+    )`,
+	`CREATE INDEX IF NOT EXISTS label_address ON label (address)`,
+	`CREATE TABLE IF NOT EXISTS box_label (
+        box_id   BIGINT NOT NULL REFERENCES box(id) ON DELETE CASCADE,
+        label_id BIGINT NOT NULL REFERENCES label(id) ON DELETE CASCADE,
+
+        PRIMARY KEY (box_id, label_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS box_label_label ON box_label (label_id)`,
+}
+
+var postgresMigrateAddLabelsDown = []string{
+	`DROP TABLE box_label`,
+	`DROP TABLE label`,
+}
+
+var postgresMigrateAddDrafts = []string{
+	`CREATE TABLE IF NOT EXISTS draft (
+        address        VARCHAR(254) NOT NULL,
+        message_id     VARCHAR(255) COLLATE "C" NOT NULL,
+        thread_id      VARCHAR(255) COLLATE "C" NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT NOT NULL,
+        cipher_body    TEXT NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        version        BIGINT NOT NULL,
+
+        PRIMARY KEY (address, message_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS draft_address_time ON draft (address, unix_time)`,
+}
+
+var postgresMigrateAddDraftsDown = []string{`DROP TABLE draft`}
+
+var postgresMigrateAddFlags = []string{`ALTER TABLE box ADD COLUMN flags INT NOT NULL DEFAULT 0`}
+
+var postgresMigrateAddFlagsDown = []string{`ALTER TABLE box DROP COLUMN flags`}
+
+var postgresMigrateAddSearchTokens = []string{
+	`CREATE TABLE IF NOT EXISTS search_token (
+        address    VARCHAR(254) NOT NULL,
+        token      CHAR(64) COLLATE "C" NOT NULL,
+        message_id VARCHAR(255) COLLATE "C" NOT NULL,
+
+        PRIMARY KEY (address, token, message_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS search_token_message ON search_token (address, message_id)`,
+}
+
+var postgresMigrateAddSearchTokensDown = []string{`DROP TABLE search_token`}
+
+var postgresMigrateAddSessions = []string{
+	`CREATE TABLE IF NOT EXISTS session (
+        id           BIGSERIAL PRIMARY KEY,
+        hash         CHAR(64) COLLATE "C" NOT NULL,
+        token        VARCHAR(64) NOT NULL,
+        ip           VARCHAR(45) NOT NULL,
+        user_agent   VARCHAR(255) NOT NULL,
+        created_time BIGINT NOT NULL,
+        expires_time BIGINT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS session_hash ON session (hash)`,
+	`CREATE INDEX IF NOT EXISTS session_token ON session (token)`,
+	`CREATE INDEX IF NOT EXISTS session_expires ON session (expires_time)`,
+}
+
+var postgresMigrateAddSessionsDown = []string{`DROP TABLE session`}
+
+var postgresMigrateAddTwoFactor = []string{
+	`CREATE TABLE IF NOT EXISTS two_factor (
+        token        VARCHAR(64) NOT NULL,
+        secret       VARCHAR(64) NOT NULL,
+        enabled_time BIGINT NOT NULL,
+        last_step    BIGINT NOT NULL,
+
+        PRIMARY KEY (token)
+    )`,
+	`CREATE TABLE IF NOT EXISTS recovery_code (
+        token VARCHAR(64) NOT NULL,
+        hash  CHAR(64) COLLATE "C" NOT NULL,
+
+        PRIMARY KEY (token, hash)
+    )`,
+}
+
+var postgresMigrateAddTwoFactorDown = []string{
+	`DROP TABLE recovery_code`,
+	`DROP TABLE two_factor`,
+}
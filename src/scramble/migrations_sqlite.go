@@ -0,0 +1,237 @@
+package scramble
+
+// SQLite databases are always new, so there is no legacy data to convert.
+// The first migration creates the schema that mysqlMigrations build up,
+// later ones must keep the two in step.
+//
+// ENUM columns become TEXT with a CHECK.
+// SQLite compares TEXT byte for byte, same as collate=ascii_bin.
+var sqliteMigrations = []migration{
+	{name: "sqliteMigrateCreateSchema", sql: sqliteMigrateCreateSchema},
+	{name: "sqliteMigrateAddRetention", sql: sqliteMigrateAddRetention, down: sqliteMigrateAddRetentionDown},
+	{name: "sqliteMigrateAddUserQuota", sql: sqliteMigrateAddUserQuota, down: sqliteMigrateAddUserQuotaDown},
+	{name: "sqliteMigrateAddEmailBodyRef", sql: sqliteMigrateAddEmailBodyRef, down: sqliteMigrateAddEmailBodyRefDown},
+	{name: "sqliteMigrateMoveBodiesToBlobs", code: sqliteMigrateMoveBodiesToBlobs,
+		down: sqliteMigrateMoveBodiesToBlobsDown, downCode: sqliteMigrateMoveBodiesFromBlobs},
+	{name: "sqliteMigrateAddTrash", sql: sqliteMigrateAddTrash, down: sqliteMigrateAddTrashDown},
+	{name: "sqliteMigrateAddLabels", sql: sqliteMigrateAddLabels, down: sqliteMigrateAddLabelsDown},
+	{name: "sqliteMigrateAddDrafts", sql: sqliteMigrateAddDrafts, down: sqliteMigrateAddDraftsDown},
+	{name: "sqliteMigrateAddFlags", sql: sqliteMigrateAddFlags, down: sqliteMigrateAddFlagsDown},
+	{name: "sqliteMigrateAddSearchTokens", sql: sqliteMigrateAddSearchTokens, down: sqliteMigrateAddSearchTokensDown},
+	{name: "sqliteMigrateAddSessions", sql: sqliteMigrateAddSessions, down: sqliteMigrateAddSessionsDown},
+	{name: "sqliteMigrateAddTwoFactor", sql: sqliteMigrateAddTwoFactor, down: sqliteMigrateAddTwoFactorDown},
+}
+
+var sqliteMigrateCreateSchema = []string{
+	`CREATE TABLE IF NOT EXISTS user (
+        token              VARCHAR(64) NOT NULL,
+        password_hash      CHAR(40) NOT NULL,
+        password_hash_old  CHAR(160) NOT NULL DEFAULT '',
+        public_hash        CHAR(40) NOT NULL,
+        public_key         VARCHAR(4000) NOT NULL,
+        cipher_private_key VARCHAR(4000) NOT NULL,
+        cipher_contacts    TEXT,
+        email_host         VARCHAR(254) NOT NULL DEFAULT '',
+        secondary_email    VARCHAR(254) NOT NULL,
+        is_banned          BOOLEAN NOT NULL DEFAULT FALSE,
+
+        PRIMARY KEY (token),
+        UNIQUE (public_hash)
+    )`,
+	`CREATE TABLE IF NOT EXISTS email (
+        message_id     VARCHAR(255) NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        from_email     VARCHAR(254) NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT,
+        cipher_body    TEXT NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        thread_id      VARCHAR(255) NOT NULL,
+
+        PRIMARY KEY (message_id)
+    )`,
+	`CREATE TABLE IF NOT EXISTS box (
+        id         INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id VARCHAR(255) NOT NULL REFERENCES email(message_id),
+        address    VARCHAR(254) NOT NULL,
+        box        TEXT NOT NULL CHECK (box IN ('inbox','outbox','sent','archive','trash','outbox-sent','outbox-processing')),
+        unix_time  BIGINT NOT NULL,
+        thread_id  VARCHAR(255) NOT NULL,
+        is_read    BOOLEAN NOT NULL DEFAULT FALSE
+    )`,
+	`CREATE INDEX IF NOT EXISTS box_address_box_time ON box (address, box, unix_time)`,
+	`CREATE INDEX IF NOT EXISTS box_address_message ON box (address, message_id)`,
+	`CREATE INDEX IF NOT EXISTS box_address_box_thread ON box (address, box, thread_id, unix_time)`,
+	`CREATE TABLE IF NOT EXISTS name_resolution (
+        name      VARCHAR(64),
+        host      VARCHAR(255),
+        hash      CHAR(16),
+        unix_time BIGINT NOT NULL,
+
+        UNIQUE (host, name)
+    )`,
+	`CREATE TABLE IF NOT EXISTS mx_hosts (
+        host              VARCHAR(254) NOT NULL,
+        is_scramble       BOOLEAN NOT NULL,
+        unix_time         BIGINT NOT NULL,
+        notary_public_key TEXT,
+
+        PRIMARY KEY (host)
+    )`,
+}
+
+// the janitor purges by box across all users, and looks for
+// emails no box row references. MySQL indexes foreign keys itself.
+var sqliteMigrateAddRetention = []string{
+	`ALTER TABLE user ADD COLUMN
+        sent_retention_days INT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS box_box_time ON box (box, unix_time)`,
+	`CREATE INDEX IF NOT EXISTS box_message ON box (message_id)`,
+}
+
+var sqliteMigrateAddRetentionDown = []string{
+	`DROP INDEX IF EXISTS box_message`,
+	`DROP INDEX IF EXISTS box_box_time`,
+	`ALTER TABLE user DROP COLUMN sent_retention_days`,
+}
+
+var sqliteMigrateAddUserQuota = []string{`ALTER TABLE user ADD COLUMN
+        quota_bytes BIGINT NOT NULL DEFAULT 0`}
+
+var sqliteMigrateAddUserQuotaDown = []string{`ALTER TABLE user DROP COLUMN quota_bytes`}
+
+var sqliteMigrateAddEmailBodyRef = []string{
+	`ALTER TABLE email ADD COLUMN body_ref CHAR(64) NOT NULL DEFAULT ''`,
+	`ALTER TABLE email ADD COLUMN body_size BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS email_body_ref ON email (body_ref)`,
+}
+
+var sqliteMigrateAddEmailBodyRefDown = []string{
+	`DROP INDEX IF EXISTS email_body_ref`,
+	`ALTER TABLE email DROP COLUMN body_ref`,
+	`ALTER TABLE email DROP COLUMN body_size`,
+}
+
+func sqliteMigrateMoveBodiesToBlobs(db migrationDB) error {
+	err := moveBodiesToBlobs(db, sqliteDialect{})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE email DROP COLUMN cipher_body`)
+	return err
+}
+
+var sqliteMigrateMoveBodiesToBlobsDown = []string{`ALTER TABLE email ADD COLUMN
+		cipher_body TEXT NOT NULL DEFAULT ''`}
+
+func sqliteMigrateMoveBodiesFromBlobs(db migrationDB) error {
+	return moveBodiesFromBlobs(db, sqliteDialect{})
+}
+
+var sqliteMigrateAddTrash = []string{
+	`ALTER TABLE box ADD COLUMN trashed_from VARCHAR(20) NOT NULL DEFAULT ''`,
+	`ALTER TABLE box ADD COLUMN trashed_time BIGINT NOT NULL DEFAULT 0`,
+	`UPDATE box SET trashed_time = unix_time WHERE box = 'trash'`,
+}
+
+var sqliteMigrateAddTrashDown = []string{
+	`ALTER TABLE box DROP COLUMN trashed_from`,
+	`ALTER TABLE box DROP COLUMN trashed_time`,
+}
+
+var sqliteMigrateAddLabels = []string{
+	`CREATE TABLE IF NOT EXISTS label (
+        id          INTEGER PRIMARY KEY AUTOINCREMENT,
+        address     VARCHAR(254) NOT NULL,
+        cipher_name TEXT NOT NULL,
+        unix_time   BIGINT NOT NULL
+    )`,
+	`CREATE INDEX IF NOT EXISTS label_address ON label (address)`,
+	`CREATE TABLE IF NOT EXISTS box_label (
+        box_id   BIGINT NOT NULL REFERENCES box(id) ON DELETE CASCADE,
+        label_id BIGINT NOT NULL REFERENCES label(id) ON DELETE CASCADE,
+
+        PRIMARY KEY (box_id, label_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS box_label_label ON box_label (label_id)`,
+}
+
+var sqliteMigrateAddLabelsDown = []string{
+	`DROP TABLE box_label`,
+	`DROP TABLE label`,
+}
+
+var sqliteMigrateAddDrafts = []string{
+	`CREATE TABLE IF NOT EXISTS draft (
+        address        VARCHAR(254) NOT NULL,
+        message_id     VARCHAR(255) NOT NULL,
+        thread_id      VARCHAR(255) NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT NOT NULL,
+        cipher_body    TEXT NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        version        BIGINT NOT NULL,
+
+        PRIMARY KEY (address, message_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS draft_address_time ON draft (address, unix_time)`,
+}
+
+var sqliteMigrateAddDraftsDown = []string{`DROP TABLE draft`}
+
+var sqliteMigrateAddFlags = []string{`ALTER TABLE box ADD COLUMN flags INT NOT NULL DEFAULT 0`}
+
+var sqliteMigrateAddFlagsDown = []string{`ALTER TABLE box DROP COLUMN flags`}
+
+var sqliteMigrateAddSearchTokens = []string{
+	`CREATE TABLE IF NOT EXISTS search_token (
+        address    VARCHAR(254) NOT NULL,
+        token      CHAR(64) NOT NULL,
+        message_id VARCHAR(255) NOT NULL,
+
+        PRIMARY KEY (address, token, message_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS search_token_message ON search_token (address, message_id)`,
+}
+
+var sqliteMigrateAddSearchTokensDown = []string{`DROP TABLE search_token`}
+
+var sqliteMigrateAddSessions = []string{
+	`CREATE TABLE IF NOT EXISTS session (
+        id           INTEGER PRIMARY KEY AUTOINCREMENT,
+        hash         CHAR(64) NOT NULL,
+        token        VARCHAR(64) NOT NULL,
+        ip           VARCHAR(45) NOT NULL,
+        user_agent   VARCHAR(255) NOT NULL,
+        created_time BIGINT NOT NULL,
+        expires_time BIGINT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS session_hash ON session (hash)`,
+	`CREATE INDEX IF NOT EXISTS session_token ON session (token)`,
+	`CREATE INDEX IF NOT EXISTS session_expires ON session (expires_time)`,
+}
+
+var sqliteMigrateAddSessionsDown = []string{`DROP TABLE session`}
+
+var sqliteMigrateAddTwoFactor = []string{
+	`CREATE TABLE IF NOT EXISTS two_factor (
+        token        VARCHAR(64) NOT NULL,
+        secret       VARCHAR(64) NOT NULL,
+        enabled_time BIGINT NOT NULL,
+        last_step    BIGINT NOT NULL,
+
+        PRIMARY KEY (token)
+    )`,
+	`CREATE TABLE IF NOT EXISTS recovery_code (
+        token VARCHAR(64) NOT NULL,
+        hash  CHAR(64) NOT NULL,
+
+        PRIMARY KEY (token, hash)
+    )`,
+}
+
+var sqliteMigrateAddTwoFactorDown = []string{
+	`DROP TABLE recovery_code`,
+	`DROP TABLE two_factor`,
+}
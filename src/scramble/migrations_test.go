@@ -0,0 +1,217 @@
+package scramble
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Counts how many times the last step ran
+var testMigrations = []migration{
+	{name: "createCounter", sql: []string{
+		`create table counter (n int not null)`,
+		`insert into counter (n) values (0)`,
+	}},
+	{name: "countRuns", code: func(db migrationDB) error {
+		_, err := db.Exec(`update counter set n = n + 1`)
+		return err
+	}},
+}
+
+func openTestSQLite(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+path+
+		"?_foreign_keys=1&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func loadTestCounter(t *testing.T, db *sql.DB) int {
+	var n int
+	if err := db.QueryRow(`select n from counter`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMigrationHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := openTestSQLite(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+
+	if err := runMigrations(db, sqliteDialect{}, sqliteMigrations); err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := db.Conn(context.Background())
+	history, err := loadMigrationHistory(conn)
+	conn.Close()
+	if err != nil || len(history) != len(sqliteMigrations) {
+		t.Fatalf("Expected every migration in the history, got %v, %v", history, err)
+	}
+	for i, applied := range history {
+		if applied.name != sqliteMigrations[i].name || applied.checksum != sqliteMigrations[i].checksum() {
+			t.Errorf("Expected %s in the history, got %v", sqliteMigrations[i].name, applied)
+		}
+	}
+	// nothing left to do
+	if err := runMigrations(db, sqliteDialect{}, sqliteMigrations); err != nil {
+		t.Errorf("Expected running the migrations again to work, got %v", err)
+	}
+
+	// the code no longer knows the last migration
+	err = runMigrations(db, sqliteDialect{}, sqliteMigrations[:len(sqliteMigrations)-1])
+	if err == nil || !strings.Contains(err.Error(), "older version") {
+		t.Errorf("Expected a newer database to be refused, got %v", err)
+	}
+
+	// a migration was edited after it ran
+	db.Exec(`update migration_history set checksum = 'edited' where version = 2`)
+	err = runMigrations(db, sqliteDialect{}, sqliteMigrations)
+	if err == nil || !strings.Contains(err.Error(), "migration 2 in the database") {
+		t.Errorf("Expected a changed migration to be refused, got %v", err)
+	}
+}
+
+// Databases migrated before the history existed only have a version
+func TestMigrationHistoryBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := openTestSQLite(t, filepath.Join(dir, "test.db"))
+	defer db.Close()
+	for _, query := range append(testMigrations[0].sql,
+		`create table migration (version int not null)`,
+		`insert into migration (version) values (1)`) {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runMigrations(db, sqliteDialect{}, testMigrations); err != nil {
+		t.Fatal(err)
+	}
+	var recorded int
+	db.QueryRow(`select count(*) from migration_history`).Scan(&recorded)
+	if recorded != 2 {
+		t.Errorf("Expected the earlier migration to be recorded too, got %d", recorded)
+	}
+	if n := loadTestCounter(t, db); n != 1 {
+		t.Errorf("Expected only the new migration to run, got %d runs", n)
+	}
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+	// the database exists, as when a new version starts up.
+	// Connections to a brand new file race to switch it to WAL.
+	db := openTestSQLite(t, path)
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		db := openTestSQLite(t, path)
+		defer db.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- runMigrations(db, sqliteDialect{}, testMigrations)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if n := loadTestCounter(t, db); n != 1 {
+		t.Errorf("Expected the migration to run once, got %d runs", n)
+	}
+}
+
+func TestRollBackMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scramble-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedBlobs := blobs
+	defer func() { blobs = savedBlobs }()
+	blobs = newMemoryBlobStore()
+
+	s := migrated(newSQLiteStore(filepath.Join(dir, "test.db")))
+	e := newTestEmail("r1@x.com", "r1@x.com", 100)
+	e.CipherBody = "body of r1@x.com"
+	if err := s.DeliverMessage(e, []MessageBox{{"bob@x.com", "inbox"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// back to before the blob store
+	steps := len(sqliteMigrations) - 1
+	if err := rollBackMigrations(s.db, s.dialect, sqliteMigrations, steps+1); err == nil ||
+		!strings.Contains(err.Error(), "no down step") {
+		t.Errorf("Expected rolling back the schema to be refused, got %v", err)
+	}
+	if err := rollBackMigrations(s.db, s.dialect, sqliteMigrations, steps); err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	err = s.db.QueryRow(`SELECT cipher_body FROM email WHERE message_id = 'r1@x.com'`).Scan(&body)
+	if err != nil || body != e.CipherBody {
+		t.Errorf("Expected the body back in the email table, got %q, %v", body, err)
+	}
+	if version, _ := loadMigrationVersion(s.db); version != 1 {
+		t.Errorf("Expected to be at version 1, got %d", version)
+	}
+
+	// and forward again
+	if err := runMigrations(s.db, s.dialect, sqliteMigrations); err != nil {
+		t.Fatal(err)
+	}
+	if email, err := s.LoadMessage("r1@x.com"); err != nil || email.CipherBody != e.CipherBody {
+		t.Errorf("Expected the body to survive the round trip, got %v, %v", email, err)
+	}
+}
+
+func TestMigrationStatuses(t *testing.T) {
+	history := []appliedMigration{
+		{1, "createCounter", testMigrations[0].checksum(), 100},
+		{2, "countRuns", "edited", 200},
+		{3, "gone", "", 300},
+	}
+	statuses := migrationStatuses(history, testMigrations)
+	if len(statuses) != 3 || statuses[0].Problem != "" || !statuses[0].Applied {
+		t.Fatalf("Expected the first migration to be fine, got %v", statuses)
+	}
+	if statuses[1].Problem != "changed since it ran" || !statuses[1].HasCode {
+		t.Errorf("Expected the second migration to have changed, got %v", statuses[1])
+	}
+	if statuses[2].Name != "gone" || statuses[2].Problem != "not in the code" {
+		t.Errorf("Expected the third migration not to be in the code, got %v", statuses[2])
+	}
+	if statuses := migrationStatuses(history[:1], testMigrations); statuses[1].Applied {
+		t.Errorf("Expected the second migration to be pending, got %v", statuses[1])
+	}
+}
@@ -1,5 +1,11 @@
 package scramble
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
 // User represents a single user, email address, and key pair
 // The email address is <public key hash>@<host>
 type User struct {
@@ -7,6 +13,11 @@ type User struct {
 	PublicKey        string
 	CipherPrivateKey string
 	SecondaryEmail   string
+	// Sent mail is deleted after this many days,
+	// 0 means the server's SentRetentionDays applies
+	SentRetentionDays int
+	// 0 means the server's DefaultQuotaBytes applies, see Config.StorageQuota
+	QuotaBytes int64
 }
 
 // UserID represents a single user's identifying info
@@ -21,6 +32,37 @@ type UserID struct {
 	IsBanned	bool
 }
 
+// PassphraseChange is what changes along with a user's passphrase,
+// see ChangePassphrase. The hashes are the client's, see auth.go.
+type PassphraseChange struct {
+	OldPassHash      string
+	OldPassHashOld   string
+	PassHash         string
+	CipherPrivateKey string
+	CipherContacts   *string // encrypted with the new passphrase too, nil keeps them
+}
+
+// Session is a login that stands in for the passphrase hash until it expires.
+// The client holds a random secret, the server only its SHA-256 hash,
+// so a leaked session table can't be used to log in.
+type Session struct {
+	ID          int64
+	Token       string // the user's
+	Hash        string // hex
+	IP          string
+	UserAgent   string
+	CreatedTime int64
+	ExpiresTime int64
+}
+
+// TwoFactor is a user's TOTP second factor, see totp.go
+type TwoFactor struct {
+	Token       string
+	Secret      string // base32, the way authenticator apps take it
+	EnabledTime int64  // 0 until the user confirms a code
+	LastStep    int64  // of the last code used, so that none is used twice
+}
+
 // EmailHeader has standard headers and an PGP-encrypted subject. No body.
 type EmailHeader struct {
 	MessageID     string
@@ -29,6 +71,7 @@ type EmailHeader struct {
 	From          string
 	To            string
 	IsRead        bool
+	Flags         Flags
 	CipherSubject string
 }
 
@@ -39,6 +82,13 @@ type Email struct {
 	AncestorIDs string
 }
 
+// MessageBox is one user's box that a message is delivered to,
+// e.g. the sender's "sent" box or a recipient's "inbox"
+type MessageBox struct {
+	Address string
+	Box     string
+}
+
 // Represents an email on the way out.
 // Plaintext should never hit the db (or disk)
 type OutgoingEmail struct {
@@ -58,6 +108,110 @@ type BoxSummary struct {
 	Limit        int
 	Total        int
 	EmailHeaders []EmailHeader
+	// Opaque, pass it back as ?cursor= to get the next page.
+	// Empty on the last page.
+	NextCursor string
+}
+
+// BoxCursor is a position in a box, listed by thread.
+// Threads are sorted by their latest UnixTime, then ThreadID, both descending,
+// and the page after a cursor starts with the thread that sorts after it.
+type BoxCursor struct {
+	UnixTime int64
+	ThreadID string
+}
+
+// BoxCount is how many threads are in a box, or have a label,
+// and how many of those have unread mail. See LoadBoxCounts.
+type BoxCount struct {
+	Total  int
+	Unread int
+}
+
+// Label is a user's own label or folder for threads.
+// The name is PGP-encrypted by the client, like subjects.
+// A folder is a label on archived mail.
+type Label struct {
+	ID         int64
+	CipherName string
+	UnixTime   int64
+}
+
+// Draft is an email that hasn't been sent yet, saved as the user writes it.
+// Subject and body are PGP-encrypted by the client, for the user only.
+// It gets sent with its MessageID, which removes it from the drafts.
+type Draft struct {
+	MessageID     string
+	ThreadID      string
+	AncestorIDs   string
+	To            string
+	CipherSubject string
+	CipherBody    string
+	UnixTime      int64 // last saved
+	// goes up with every save, so that saves from two tabs don't clash
+	Version int64
+}
+
+// BulkOp is one change made to many threads at once, or with
+// MessageOnly set to just the messages. Labels go on whole threads.
+type BulkOp struct {
+	Action       string // move, restore, read, unread, delete or label
+	Box          string // where move moves to, the trash included
+	AddLabels    []int64
+	RemoveLabels []int64
+	MessageOnly  bool
+}
+
+// Flags are what a user marks their copy of a message with,
+// as a bit set. A thread has the flags of any of its messages.
+type Flags int
+
+const (
+	FlagStarred Flags = 1 << iota
+	FlagImportant
+	FlagAnswered
+	FlagForwarded
+
+	allFlags = FlagStarred | FlagImportant | FlagAnswered | FlagForwarded
+)
+
+// In bit order
+var flagNames = []string{"starred", "important", "answered", "forwarded"}
+
+// Parses a comma separated list of flag names, eg "starred,answered"
+func ParseFlags(str string) (Flags, error) {
+	var flags Flags
+	if str == "" {
+		return flags, nil
+	}
+	for _, name := range strings.Split(str, ",") {
+		flag := Flags(0)
+		for i, flagName := range flagNames {
+			if name == flagName {
+				flag = 1 << uint(i)
+			}
+		}
+		if flag == 0 {
+			return 0, fmt.Errorf("unknown flag %q", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+func (flags Flags) Names() []string {
+	names := []string{}
+	for i, name := range flagNames {
+		if flags&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Clients see flags by name
+func (flags Flags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(flags.Names())
 }
 
 // MxHostInfo represents info from DNS (or from cache)
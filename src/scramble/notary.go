@@ -3,6 +3,7 @@
 package scramble
 
 import (
+	"errors"
 	"golang.org/x/crypto/openpgp"
 	"io/ioutil"
 	"log"
@@ -45,9 +46,14 @@ func init() {
 	loadNotaries()
 }
 
+// The notary's private and public key, created on first start
+func notaryKeyFile() string {
+	return os.Getenv("HOME") + "/.scramble/notary_privkey"
+}
+
 func loadThisNotaryInfo() {
 	var privKeyArmor, pubKeyArmor string
-	keyFile := os.Getenv("HOME") + "/.scramble/notary_privkey"
+	keyFile := notaryKeyFile()
 	keyBytes, err := ioutil.ReadFile(keyFile)
 	if err != nil {
 		log.Printf("Creating new keyfiles for notary at %s\n", keyFile)
@@ -103,6 +109,12 @@ func loadNotaries() {
 	log.Printf("Notaries loaded: %v", strings.Join(notaryHosts, ","))
 }
 
+// Stands in for the pubHash of a deleted account. Notaries sign it like
+// any other hash, so that clients learn the address is gone, and keep it
+// so that nobody else can register the name. It can't be mistaken for
+// a real hash, those are 16 or 40 characters long.
+const TombstoneHash = "deleted"
+
 type NotarySignedResult struct {
 	PubHash   string `json:"pubHash,omitempty"`
 	Timestamp int64  `json:"timestamp"`
@@ -114,25 +126,31 @@ type NotaryResultError struct {
 	Error  string                         `json:"error,omitempty"`
 }
 
-// Returns the hash from name_resolution table.
-func ResolveName(name, host string) string {
+// Returns the hash from name_resolution table,
+// TombstoneHash if the account was deleted, or "" if the name is unknown.
+func ResolveName(name, host string) (string, error) {
 	addr := name + "@" + host
-	hash := GetNameResolution(name, host)
+	hash, err := GetNameResolution(name, host)
 
-	if hash == "" {
+	if errors.Is(err, ErrNotFound) {
 
 		mxHost, err := mxLookUp(host)
 		if err != nil {
-			return "" // whatever, we were going to return "" anyways
+			return "", nil // whatever, we were going to return "" anyways
 		}
 		if mxHost == GetConfig().SMTPMxHost {
 			log.Printf("Well, that's unexpected. Why didn't GetNameResolution pick up the hash for %v?\n"+
 				"Using user table instead. But really, this should be in the name_resolution table.", addr)
-			return LoadPubHash(name, host)
+			hash, err = LoadPubHash(name, host)
+			if errors.Is(err, ErrNotFound) {
+				return "", nil
+			}
+			return hash, err
 		}
+		return "", nil
 
 	}
-	return hash
+	return hash, err
 }
 
 func StringForNotaryToSign(name, host, pubHash string, timestamp int64) string {
@@ -146,11 +164,19 @@ func SignNotaryResponse(name, host, pubHash string, timestamp int64) string {
 
 // New accounts need to get their token & pubHash seeded.
 func SeedUserToNotaries(user *User) {
+	log.Println("Seeding new user " + user.EmailAddress + " to notaries")
+	seedToNotaries(user.Token, user.EmailHost, user.PublicHash)
+}
+
+// Deleted accounts get their name seeded again, with the tombstone.
+// Notaries keep the name taken, see publicKeySeedHandler.
+func SeedTombstoneToNotaries(user *User) {
+	log.Println("Seeding tombstone for " + user.EmailAddress + " to notaries")
+	seedToNotaries(user.Token, user.EmailHost, TombstoneHash)
+}
 
-	name := user.Token
-	host := user.EmailHost
-	address := user.EmailAddress
-	pubHash := user.PublicHash
+func seedToNotaries(name, host, pubHash string) {
+	address := name + "@" + host
 	timestamp := time.Now().Unix()
 	signature := SignNotaryResponse(name, host, pubHash, timestamp)
 
@@ -160,7 +186,6 @@ func SeedUserToNotaries(user *User) {
 		}
 		go func(notary string) {
 			defer Recover()
-			log.Println("Seeding new user " + user.EmailAddress + " to " + notary)
 			u := url.URL{}
 			u.Scheme = "https"
 			u.Host = notary
@@ -0,0 +1,27 @@
+package scramble
+
+// How much mail a user stores, against how much they may.
+// Usage is the size of the cipher bodies in their boxes and drafts.
+type StorageUsage struct {
+	UsedBytes  int64
+	QuotaBytes int64 // 0 for unlimited
+}
+
+// Loads how much of their quota a user has used up
+func LoadStorageUsage(user *User) (*StorageUsage, error) {
+	used, err := getStore().LoadStorageUsed(user.EmailAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageUsage{used, GetConfig().StorageQuota(user)}, nil
+}
+
+// Checks whether the user can store another email of the given size
+func (usage *StorageUsage) HasRoomFor(bytes int64) bool {
+	return usage.QuotaBytes == 0 || usage.UsedBytes+bytes <= usage.QuotaBytes
+}
+
+// Checks whether the user has no room left at all
+func (usage *StorageUsage) IsFull() bool {
+	return usage.QuotaBytes != 0 && usage.UsedBytes >= usage.QuotaBytes
+}
@@ -0,0 +1,83 @@
+package scramble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStorageQuota(t *testing.T) {
+	conf := &Config{DefaultQuotaBytes: 1000}
+	for quotaBytes, expected := range map[int64]int64{
+		0:   1000, // server default
+		500: 500,
+		-1:  0, // unlimited
+	} {
+		user := &User{QuotaBytes: quotaBytes}
+		if quota := conf.StorageQuota(user); quota != expected {
+			t.Errorf("Expected quota_bytes %d to give a quota of %d, got %d",
+				quotaBytes, expected, quota)
+		}
+	}
+
+	usage := &StorageUsage{UsedBytes: 900, QuotaBytes: 1000}
+	if !usage.HasRoomFor(100) || usage.HasRoomFor(101) || usage.IsFull() {
+		t.Errorf("Expected room for exactly 100 more bytes")
+	}
+	usage.UsedBytes = 1000
+	if !usage.IsFull() {
+		t.Errorf("Expected a mailbox at its quota to be full")
+	}
+	usage.QuotaBytes = 0
+	if !usage.HasRoomFor(1<<40) || usage.IsFull() {
+		t.Errorf("Expected an unlimited mailbox never to be full")
+	}
+}
+
+func TestDraftQuota(t *testing.T) {
+	request := func(method, path, msgID string, version int64) *httptest.ResponseRecorder {
+		form := url.Values{
+			"msgID":         {msgID},
+			"version":       {strconv.FormatInt(version, 10)},
+			"cipherSubject": {"-----BEGIN PGP MESSAGE-----\n-----END PGP MESSAGE-----"},
+			"cipherBody": {"-----BEGIN PGP MESSAGE-----\n" + strings.Repeat("a", 100) +
+				"\n-----END PGP MESSAGE-----"},
+		}
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-scramble-token", "test")
+		req.Header.Set("x-scramble-passHash", "5026f031ceea00023da878da2be4660ae85040e8")
+		auth(draftsHandler)(record, req)
+		return record
+	}
+	tUser := loadTestUser()
+	usage, err := LoadStorageUsage(tUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := GetConfig()
+	defer func(quota int64) { conf.DefaultQuotaBytes = quota }(conf.DefaultQuotaBytes)
+	// room for one draft, not two
+	conf.DefaultQuotaBytes = usage.UsedBytes + 200
+
+	first, second := "quota-draft-1@"+conf.SMTPMxHost, "quota-draft-2@"+conf.SMTPMxHost
+	record := request("POST", "/drafts/", first, 0)
+	var saved DraftSaveResponse
+	if err := json.Unmarshal(record.Body.Bytes(), &saved); err != nil {
+		t.Fatalf("Expected the first draft to fit, got %d %s", record.Code, record.Body.String())
+	}
+	defer DeleteDraft(tUser.EmailAddress, first)
+	if record := request("POST", "/drafts/", second, 0); record.Code != http.StatusInsufficientStorage {
+		DeleteDraft(tUser.EmailAddress, second)
+		t.Errorf("Expected a second draft not to fit, got %d", record.Code)
+	}
+	// saving over the first one replaces its body
+	if record := request("PUT", "/drafts/"+first, "", saved.Version); record.Code != http.StatusOK {
+		t.Errorf("Expected saving the draft again to fit, got %d %s", record.Code, record.Body.String())
+	}
+}
@@ -15,24 +15,29 @@ func Recover() {
 		stack := string(debug.Stack())
 		errorString := fmt.Sprintf("%s:\n%s", e, stack)
 		log.Println("<!> " + errorString)
-		messageID := GenerateMessageID().String()
-		if len(GetConfig().AdminEmails) > 0 {
-			go smtpSendSafe(&OutgoingEmail{
-				Email: Email{
-					EmailHeader: EmailHeader{
-						MessageID: messageID,
-						ThreadID:  messageID,
-						UnixTime:  time.Now().Unix(),
-						From:      "daemon@" + GetConfig().SMTPMxHost,
-						To:        strings.Join(GetConfig().AdminEmails, ","),
-					},
-				},
-				IsPlaintext:      true,
-				PlaintextSubject: "Panic from Scramble server " + GetConfig().SMTPMxHost,
-				PlaintextBody:    errorString,
-			})
-		} else {
-			log.Printf("Set AdminEmails: ['your_email@host',...] in config to receive alerts")
-		}
+		notifyAdmins("Panic from Scramble server "+GetConfig().SMTPMxHost, errorString)
 	}
 }
+
+// Emails the configured AdminEmails, in plain text
+func notifyAdmins(subject string, body string) {
+	if len(GetConfig().AdminEmails) == 0 {
+		log.Printf("Set AdminEmails: ['your_email@host',...] in config to receive alerts")
+		return
+	}
+	messageID := GenerateMessageID().String()
+	go smtpSendSafe(&OutgoingEmail{
+		Email: Email{
+			EmailHeader: EmailHeader{
+				MessageID: messageID,
+				ThreadID:  messageID,
+				UnixTime:  time.Now().Unix(),
+				From:      "daemon@" + GetConfig().SMTPMxHost,
+				To:        strings.Join(GetConfig().AdminEmails, ","),
+			},
+		},
+		IsPlaintext:      true,
+		PlaintextSubject: subject,
+		PlaintextBody:    body,
+	})
+}
@@ -1,201 +1,333 @@
 package scramble
 
-import "database/sql"
-import _ "github.com/go-sql-driver/mysql"
-
 import (
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"sync"
 	"time"
-	//"github.com/jaekwon/go-prelude/colors"
 )
 
-var db *sql.DB
+// Every Store reports these conditions the same way, whatever the backend.
+// The errors it returns may wrap the driver's error, so check with errors.Is.
+// Any other error means the database itself failed, and the caller
+// should treat it as temporary.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrDuplicate  = errors.New("duplicate key")
+	ErrConstraint = errors.New("constraint violation")
+	// a row changed since the caller loaded it, see UpdateDraft
+	ErrConflict = errors.New("changed concurrently")
+)
+
+// Store is everything Scramble persists: users, email, boxes,
+// name resolutions and mx host info. The package-level functions
+// below are the API the rest of Scramble uses, they all go through
+// the Store selected by DbDriver in the config.
+// Lookups of a single row return ErrNotFound if there is no such row.
+type Store interface {
+	// users
+	SaveUser(user *User) error
+	DeleteUser(token string) error
+	LoadUser(token string) (*User, error)
+	LoadUserID(token string) (*UserID, error)
+	LoadPubHash(token, emailHost string) (string, error)
+	LoadPubKey(publicHash string) (string, error)
+	LoadAddressFromPubHash(publicHash string) (string, error)
+	LoadContacts(token string) (*string, error)
+	SaveContacts(token string, cipherContacts string) error
+	ChangePassphrase(token string, change *PassphraseChange) error
+	DeleteAccount(token string) error
+
+	// sessions
+	CreateSession(session *Session) error
+	LoadSession(hash string) (*Session, error)
+	LoadSessions(token string, now int64) ([]Session, error)
+	DeleteSession(token string, id int64) error
+	DeleteSessions(token string) (int64, error)
+
+	// two-factor
+	SaveTwoFactor(tf *TwoFactor) error
+	LoadTwoFactor(token string) (*TwoFactor, error)
+	EnableTwoFactor(token string, step int64, now int64, recoveryHashes []string) error
+	UseTwoFactorStep(token string, step int64) error
+	UseRecoveryCode(token string, hash string) error
+	CountRecoveryCodes(token string) (int, error)
+	DeleteTwoFactor(token string) error
+
+	// email headers
+	LoadBox(address string, box string, offset, limit int) ([]EmailHeader, error)
+	LoadBoxByThread(address string, box string, offset, limit int) ([]EmailHeader, error)
+	LoadBoxByThreadAfter(address string, box string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error)
+	CountBox(address string, box string) (int, error)
+	LoadBoxCounts(address string) (map[string]BoxCount, error)
+	LoadStorageUsed(address string) (int64, error)
+
+	// email
+	SaveMessage(e *Email) error
+	DeliverMessage(e *Email, boxes []MessageBox) error
+	DeliverDraft(address string, e *Email, boxes []MessageBox) error
+	LoadMessage(id string) (Email, error)
+	LoadThread(address, threadID string) ([]Email, error)
+	LoadThreadIDsForMessageIDs(messageIDs []interface{}) ([]string, error)
+	AddMessageToBox(e *Email, address string, box string) error
+	DeleteFromBoxes(address string, id string) error
+	BoxesForMessage(address string, id string) ([]string, error)
+	MoveEmail(address string, messageID string, newBox string) error
+	MarkAsRead(address string, messageID string, isRead bool) error
+	TrashEmail(address string, messageID string, trashedTime int64) error
+	RestoreEmail(address string, messageID string) error
+	UpdateInBulk(address string, op BulkOp, messageIDs []string, now int64) ([]error, error)
+	MarkBoxAsRead(address string, box string) (int64, error)
+
+	// email threads
+	MoveThread(address string, messageID string, newBox string) error
+	ThreadMarkAsRead(address string, messageID string, isRead bool) error
+	GetUsersWithUnreadMail(minAgeMins int, maxAgeMins int) ([]string, error)
+	DeleteThreadFromBoxes(address string, messageID string) error
+	TrashThread(address string, messageID string, trashedTime int64) error
+	RestoreThread(address string, messageID string) error
+	EmptyTrash(address string) (int64, error)
+
+	// labels
+	CreateLabel(address string, cipherName string) (*Label, error)
+	LoadLabels(address string) ([]Label, error)
+	RenameLabel(address string, id int64, cipherName string) error
+	DeleteLabel(address string, id int64) error
+	LabelThread(address string, messageID string, add, remove []int64) error
+	LoadLabelByThread(address string, labelID int64, offset, limit int) ([]EmailHeader, error)
+	LoadLabelByThreadAfter(address string, labelID int64, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error)
+	CountLabel(address string, labelID int64) (int, error)
+
+	// flags
+	FlagThread(address string, messageID string, set, clear Flags) error
+	FlagMessage(address string, messageID string, set, clear Flags) error
+	LoadFlaggedByThread(address string, box string, flags Flags, offset, limit int) ([]EmailHeader, error)
+	LoadFlaggedByThreadAfter(address string, box string, flags Flags, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error)
+	CountFlagged(address string, box string, flags Flags) (int, error)
+
+	// drafts
+	CreateDraft(address string, draft *Draft) error
+	UpdateDraft(address string, draft *Draft) error
+	LoadDraft(address string, messageID string) (*Draft, error)
+	LoadDrafts(address string, offset, limit int) ([]EmailHeader, error)
+	CountDrafts(address string) (int, error)
+	DeleteDraft(address string, messageID string) error
+
+	// search
+	SaveSearchTokens(address string, messageID string, tokens []string) error
+	SearchByThread(address string, tokens []string, offset, limit int) ([]EmailHeader, error)
+	SearchByThreadAfter(address string, tokens []string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error)
+	CountSearch(address string, tokens []string) (int, error)
+
+	// notary
+	AddNameResolution(name, host, hash string) error
+	SetNameResolution(name, host, hash string) error
+	DeleteNameResolution(name, host string) error
+	GetNameResolution(name, host string) (string, error)
+	SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) (*MxHostInfo, error)
+	GetMxHostInfo(host string) (*MxHostInfo, error)
+
+	// retention, see janitor.go
+	SetSentRetentionDays(token string, days int) error
+	LoadSentRetentionDays() (map[string]int, error)
+	PurgeBox(purge BoxPurge, dryRun bool) (int64, error)
+	PurgeTrash(before int64, dryRun bool) (int64, error)
+	PurgeOrphanEmails(before int64, dryRun bool) (int64, error)
+	PurgeOrphanSearchTokens(dryRun bool) (int64, error)
+	PurgeMxHosts(before int64, dryRun bool) (int64, error)
+	PurgeSessions(before int64, dryRun bool) (int64, error)
+	IsBlobReferenced(ref string) (bool, error)
+}
+
+// Opened on first use rather than in init(), so that a command can
+// change the config first. scramble-migrate sets DbManualMigrations.
+var store Store
+var storeOnce sync.Once
 
 func init() {
-	conf := GetConfig()
-	mysqlHost := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?charset=utf8",
-		conf.DbUser,
-		conf.DbPassword,
-		conf.DbServer,
-		conf.DbCatalog)
-
-	// connect to the database, ping periodically to maintain the connection
-	log.Printf("Connecting to %s\n", mysqlHost)
-	var err error
-	db, err = sql.Open("mysql", mysqlHost)
-	if err != nil {
-		panic(err)
+	// migrations move message bodies into the blob store
+	blobs = openBlobStore(GetConfig())
+}
+
+// Returns the Store, opening it the first time
+func getStore() Store {
+	storeOnce.Do(func() {
+		store = openStore(GetConfig())
+	})
+	return store
+}
+
+// Opens the Store for the configured DbDriver.
+// For "mysql", "sqlite" and "postgres" this connects and migrates the database,
+// unless DbManualMigrations is set. Then scramble-migrate does that.
+func openStore(conf *Config) Store {
+	var s *sqlStore
+	switch conf.DbDriver {
+	case "", "mysql":
+		s = newMySQLStore(conf)
+	case "postgres":
+		s = newPostgresStore(postgresDataSource(conf))
+	case "sqlite":
+		s = newSQLiteStore(sqlitePath(conf))
+	case "memory":
+		log.Printf("Using the in-memory store. Nothing will be persisted!\n")
+		return newMemoryStore()
+	default:
+		log.Panicf("Unknown DbDriver %s", conf.DbDriver)
 	}
-	go ping()
-
-	// migrate the database
-	migrateDb()
-}
-
-func ping() {
-	defer Recover()
-	ticker := time.Tick(time.Minute)
-	for {
-		<-ticker
-		err := db.Ping()
-		if err != nil {
-			log.Printf("DB not ok: %v\n", err)
-		} else {
-			log.Printf("DB ok\n")
-		}
+	if conf.DbManualMigrations {
+		log.Printf("DbManualMigrations is set, not migrating the database\n")
+	} else {
+		migrateDb(s.db, s.dialect, s.migrations())
 	}
+	return s
 }
 
 //
 // USERS
 //
 
-func SaveUser(user *User) bool {
-	res, err := db.Exec("insert ignore into user"+
-		" (token, password_hash, public_hash, public_key, "+
-		"  cipher_private_key, email_host, secondary_email) "+
-		" values (?, ?, ?, ?, ?, ?, ?)",
-		user.Token, user.PasswordHash, user.PublicHash, user.PublicKey,
-		user.CipherPrivateKey, user.EmailHost, user.SecondaryEmail)
-	if err != nil {
-		panic(err)
-	}
-	nrows, err := res.RowsAffected()
-	if err != nil {
-		panic(err)
-	}
-	return nrows == 1
+// Creates a new user.
+// Returns ErrDuplicate if the token or public hash is already taken.
+func SaveUser(user *User) error {
+	return getStore().SaveUser(user)
 }
 
-func DeleteUser(token string) {
-	res, err := db.Exec("delete from user where token=?", token)
-	if err == nil {
-		return
-	}
-	count, err := res.RowsAffected()
-	if err != nil || count != 1 {
-		log.Panicf("Could not delete user %s: %v", token, err)
-	}
+func DeleteUser(token string) error {
+	return getStore().DeleteUser(token)
 }
 
-func LoadUser(token string) *User {
-	var user User
-	user.Token = token
-	err := db.QueryRow("select"+
-		" password_hash, password_hash_old, public_hash, "+
-		" public_key, cipher_private_key, email_host, secondary_email "+
-		" from user where token=?", token).Scan(
-		&user.PasswordHash,
-		&user.PasswordHashOld,
-		&user.PublicHash,
-		&user.PublicKey,
-		&user.CipherPrivateKey,
-		&user.EmailHost,
-		&user.SecondaryEmail,
-	)
-	user.EmailAddress = user.Token + "@" + user.EmailHost
-	if err == sql.ErrNoRows {
-		return nil
-	}
-	if err != nil {
-		panic(err)
-	}
-	return &user
-}
-
-func LoadUserID(token string) *UserID {
-	var user UserID
-	user.Token = token
-	err := db.QueryRow("select " +
-		" password_hash, password_hash_old, public_hash, email_host, is_banned" +
-		" from user where token=?", token).Scan(
-		&user.PasswordHash,
-		&user.PasswordHashOld,
-		&user.PublicHash,
-		&user.EmailHost,
-		&user.IsBanned)
-	user.EmailAddress = user.Token + "@" + user.EmailHost
-	if err == sql.ErrNoRows {
-		return nil
-	}
-	if err != nil {
-		panic(err)
-	}
-	return &user
+// Loads a user by token, or ErrNotFound if the user doesn't exist
+func LoadUser(token string) (*User, error) {
+	return getStore().LoadUser(token)
+}
+
+// Loads a user's identifying info by token, or ErrNotFound if the user doesn't exist
+func LoadUserID(token string) (*UserID, error) {
+	return getStore().LoadUserID(token)
 }
 
 // Loads a given public hash by a user's token (name) & email_host
-func LoadPubHash(token, emailHost string) string {
-	var hash string
-	err := db.QueryRow("SELECT public_hash "+
-		" FROM user WHERE token=? and email_host=?",
-		token, emailHost).Scan(&hash)
-	if err == sql.ErrNoRows {
-		return ""
-	}
-	if err != nil {
-		panic(err)
-	}
-	return hash
+func LoadPubHash(token, emailHost string) (string, error) {
+	return getStore().LoadPubHash(token, emailHost)
 }
 
 // Loads a given public key by it's hash
 // The client then verifies that the key is correct
-func LoadPubKey(publicHash string) string {
-	var publicKey string
-	err := db.QueryRow("SELECT public_key "+
-		"FROM user WHERE public_hash=?",
-		publicHash).Scan(&publicKey)
-	if err == sql.ErrNoRows {
-		return ""
-	}
-	if err != nil {
-		panic(err)
-	}
-	return publicKey
+func LoadPubKey(publicHash string) (string, error) {
+	return getStore().LoadPubKey(publicHash)
 }
 
 // Loads an address from a user's pubHash.
 // This exists to upgrade legacy contacts.
-func LoadAddressFromPubHash(publicHash string) string {
-	var token, emailHost string
-	err := db.QueryRow("SELECT token, email_host "+
-		"FROM user WHERE public_hash=?",
-		publicHash).Scan(&token, &emailHost)
-	if err == sql.ErrNoRows {
-		return ""
-	}
-	if err != nil {
-		panic(err)
-	}
-	return token + "@" + emailHost
-}
-
-// Loads a user's contacts, or nil if the user doesn't exist
-// Returns an encrypted blob for which only they have the key
-func LoadContacts(token string) *string {
-	var cipherContacts *string
-	err := db.QueryRow("SELECT cipher_contacts "+
-		"FROM user WHERE token=?", token).Scan(
-		&cipherContacts)
-	if err == sql.ErrNoRows {
-		return nil
-	}
-	if err != nil {
-		panic(err)
-	}
-	return cipherContacts
+func LoadAddressFromPubHash(publicHash string) (string, error) {
+	return getStore().LoadAddressFromPubHash(publicHash)
 }
 
-func SaveContacts(token string, cipherContacts string) {
-	_, err := db.Exec("UPDATE user "+
-		"SET cipher_contacts=? WHERE token=?",
-		cipherContacts, token)
-	if err != nil {
-		panic(err)
-	}
+// Loads a user's contacts, or ErrNotFound if the user doesn't exist.
+// Returns an encrypted blob for which only they have the key,
+// or nil if they haven't saved any contacts yet.
+func LoadContacts(token string) (*string, error) {
+	return getStore().LoadContacts(token)
+}
+
+func SaveContacts(token string, cipherContacts string) error {
+	return getStore().SaveContacts(token, cipherContacts)
+}
+
+// Sets a user's new passphrase hash, and their private key and contacts
+// encrypted with the new passphrase, in one statement. Clears the legacy
+// hash, so that x-scramble-passHashOld stops working, and ends all of their
+// sessions. Returns ErrNotFound unless OldPassHash or OldPassHashOld is
+// the user's current hash.
+func ChangePassphrase(token string, change *PassphraseChange) error {
+	return getStore().ChangePassphrase(token, change)
+}
+
+// Closes a user's account for good, in one transaction: deletes their
+// boxes, labels, drafts, search tokens, sessions, two-factor secret and
+// the user row with their contacts, and any email no one else has.
+// Then replaces their name resolution with a tombstone, see TombstoneHash,
+// so that the name can't be registered again.
+// Returns ErrNotFound if the user doesn't exist.
+func DeleteAccount(token string) error {
+	return getStore().DeleteAccount(token)
+}
+
+//
+// SESSIONS
+//
+
+// Saves a new session and sets its ID
+func CreateSession(session *Session) error {
+	return getStore().CreateSession(session)
+}
+
+// Loads a session by the hash of its secret, expired or not
+func LoadSession(hash string) (*Session, error) {
+	return getStore().LoadSession(hash)
+}
+
+// Loads a user's sessions that haven't expired by now, newest first
+func LoadSessions(token string, now int64) ([]Session, error) {
+	return getStore().LoadSessions(token, now)
+}
+
+// Ends one of a user's sessions.
+// Returns ErrNotFound if the user has no session with that ID.
+func DeleteSession(token string, id int64) error {
+	return getStore().DeleteSession(token, id)
+}
+
+// Ends all of a user's sessions, returns how many there were
+func DeleteSessions(token string) (int64, error) {
+	return getStore().DeleteSessions(token)
+}
+
+//
+// TWO-FACTOR
+//
+
+// Starts enrolling a user in two-factor login, replacing an enrollment
+// they didn't confirm. Returns ErrConflict if two-factor is on already.
+func SaveTwoFactor(tf *TwoFactor) error {
+	return getStore().SaveTwoFactor(tf)
+}
+
+// Loads a user's second factor, confirmed or not
+func LoadTwoFactor(token string) (*TwoFactor, error) {
+	return getStore().LoadTwoFactor(token)
+}
+
+// Turns two-factor on once the user confirmed a code from the given time step,
+// and replaces their recovery codes with the given hashes.
+// Returns ErrNotFound if the user isn't enrolling, or used that step already.
+func EnableTwoFactor(token string, step int64, now int64, recoveryHashes []string) error {
+	return getStore().EnableTwoFactor(token, step, now, recoveryHashes)
+}
+
+// Records that a code from the given time step was used.
+// Returns ErrConflict if that step, or a later one, was used already,
+// so that a code seen by someone else can't log in again.
+func UseTwoFactorStep(token string, step int64) error {
+	return getStore().UseTwoFactorStep(token, step)
+}
+
+// Uses up one of a user's recovery codes, by its hash.
+// Returns ErrNotFound if they don't have it, or used it already.
+func UseRecoveryCode(token string, hash string) error {
+	return getStore().UseRecoveryCode(token, hash)
+}
+
+func CountRecoveryCodes(token string) (int, error) {
+	return getStore().CountRecoveryCodes(token)
+}
+
+// Turns two-factor off and forgets the recovery codes.
+// Returns ErrNotFound if the user never enrolled.
+func DeleteTwoFactor(token string) error {
+	return getStore().DeleteTwoFactor(token)
 }
 
 //
@@ -205,71 +337,50 @@ func SaveContacts(token string, cipherContacts string) {
 // Loads all email headers in a certain box
 // For example, inbox or sent box
 // That are encrypted for a given user
-func LoadBox(address string, box string, offset, limit int) []EmailHeader {
-	rows, err := db.Query("SELECT m.message_id, m.unix_time, "+
-		" m.from_email, m.to_email, b.is_read, m.cipher_subject, m.thread_id "+
-		" FROM email AS m INNER JOIN box AS b "+
-		" ON b.message_id = m.message_id "+
-		" WHERE b.address = ? and b.box=? "+
-		" ORDER BY b.unix_time DESC"+
-		" LIMIT ?, ? ",
-		address, box,
-		offset, limit)
-	if err != nil {
-		panic(err)
-	}
-	return rowsToHeaders(rows)
+func LoadBox(address string, box string, offset, limit int) ([]EmailHeader, error) {
+	return getStore().LoadBox(address, box, offset, limit)
 }
 
 // Like LoadBox(), but only returns the latest mail in the box for each thread.
-func LoadBoxByThread(address string, box string, offset, limit int) []EmailHeader {
-	rows, err := db.Query("SELECT e.message_id, e.unix_time, "+
-		"e.from_email, e.to_email, m.is_read, e.cipher_subject, e.thread_id "+
-		"FROM email AS e INNER JOIN ( "+
-		"    SELECT MAX(message_id) as message_id, MIN(is_read) as is_read FROM box "+
-		"       WHERE address=? AND box=? "+
-		"       GROUP BY thread_id "+
-		"       ORDER BY MAX(unix_time) DESC "+
-		"       LIMIT ?, ? "+
-		") AS m ON e.message_id = m.message_id "+
-		"ORDER BY e.unix_time DESC ",
-		address, box,
-		offset, limit,
-	)
-	if err != nil {
-		panic(err)
-	}
-	return rowsToHeaders(rows)
+func LoadBoxByThread(address string, box string, offset, limit int) ([]EmailHeader, error) {
+	return getStore().LoadBoxByThread(address, box, offset, limit)
+}
+
+// Like LoadBoxByThread(), but pages with a cursor instead of an offset.
+// Pass a nil cursor for the first page. Returns the cursor for the next page,
+// or nil if this was the last one.
+// Unlike with offsets, new mail can't shift the next page around.
+func LoadBoxByThreadAfter(address string, box string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return getStore().LoadBoxByThreadAfter(address, box, after, limit)
 }
 
+// Counts the threads in a box
 func CountBox(address string, box string) (count int, err error) {
-	err = db.QueryRow("SELECT count(distinct thread_id) FROM box "+
-		" WHERE address = ? and box = ?",
-		address, box).Scan(&count)
-	return
-}
-
-func rowsToHeaders(rows *sql.Rows) []EmailHeader {
-	// collect a short description of each email
-	headers := make([]EmailHeader, 0)
-	for rows.Next() {
-		var header EmailHeader
-		err := rows.Scan(
-			&header.MessageID,
-			&header.UnixTime,
-			&header.From,
-			&header.To,
-			&header.IsRead,
-			&header.CipherSubject,
-			&header.ThreadID,
-		)
-		if err != nil {
-			panic(err)
-		}
-		headers = append(headers, header)
+	return getStore().CountBox(address, box)
+}
+
+// Counts the threads, and the threads with unread mail, of every one of
+// a user's boxes, drafts and labels, by the name /box/ takes for them,
+// eg "inbox" or "label/12". Empty boxes and labels are counted too.
+// Labels don't count trashed mail, and drafts are never unread.
+func LoadBoxCounts(address string) (map[string]BoxCount, error) {
+	return getStore().LoadBoxCounts(address)
+}
+
+// The boxes LoadBoxCounts counts, besides labels
+var countedBoxes = []string{"inbox", "sent", "drafts", "archive", "trash"}
+
+func newBoxCounts() map[string]BoxCount {
+	counts := map[string]BoxCount{}
+	for _, box := range countedBoxes {
+		counts[box] = BoxCount{}
 	}
+	return counts
+}
 
-	return headers
+// The name of a label's box, as /box/ takes it
+func labelBoxName(labelID int64) string {
+	return fmt.Sprintf("label/%d", labelID)
 }
 
 //
@@ -280,89 +391,35 @@ func rowsToHeaders(rows *sql.Rows) []EmailHeader {
 // A single mail server only needs one email for all recipients & sender.
 // Associating emails to boxes are done in a join table.
 // Outgoing emails for external servers also require an entry in the 'email' table.
+// Returns ErrDuplicate if the message ID already exists.
 func SaveMessage(e *Email) error {
-	_, err := db.Exec("insert into email "+
-		"(message_id, unix_time, from_email, to_email, "+
-		" cipher_subject, cipher_body, "+
-		" ancestor_ids, thread_id) "+
-		"values (?,?,?,?,?,?,?,?)",
-		e.MessageID,
-		e.UnixTime,
-		e.From,
-		e.To,
-		e.CipherSubject,
-		e.CipherBody,
-		e.AncestorIDs,
-		e.ThreadID,
-	)
-	return err
+	return getStore().SaveMessage(e)
+}
+
+// Saves an email and adds it to all of the given boxes, atomically.
+// Either everything is saved or nothing is, so if this returns an error
+// other than ErrDuplicate it's safe to call again with the same email.
+// Returns ErrDuplicate if the message ID already exists, in which
+// case the earlier delivery of that message is complete.
+func DeliverMessage(e *Email, boxes []MessageBox) error {
+	return getStore().DeliverMessage(e, boxes)
+}
+
+// Delivers a message like DeliverMessage, and in the same transaction
+// deletes the sender's draft with its message ID, if there is one.
+// Once it's sent, saving the draft again fails with ErrNotFound.
+func DeliverDraft(address string, e *Email, boxes []MessageBox) error {
+	return getStore().DeliverDraft(address, e, boxes)
 }
 
 // Retrieves a single message, by id
-func LoadMessage(id string) Email {
-	var email Email
-	err := db.QueryRow("SELECT "+
-		"unix_time, from_email, to_email, "+
-		"cipher_subject, cipher_body, "+
-		"ancestor_ids, thread_id "+
-		"FROM email WHERE message_id=?",
-		id).Scan(
-		&email.UnixTime,
-		&email.From,
-		&email.To,
-		&email.CipherSubject,
-		&email.CipherBody,
-		&email.AncestorIDs,
-		&email.ThreadID,
-	)
-	email.MessageID = id
-	if err != nil {
-		panic(err)
-	}
-	return email
+func LoadMessage(id string) (Email, error) {
+	return getStore().LoadMessage(id)
 }
 
 // Load emails for a given thread
-func LoadThread(address, threadID string) []Email {
-
-	rows, err := db.Query("SELECT "+
-		"e.message_id, e.unix_time, e.from_email, e.to_email, "+
-		"e.cipher_subject, e.cipher_body, "+
-		"e.ancestor_ids, e.thread_id "+
-		"FROM email AS e INNER JOIN box "+
-		"ON e.message_id = box.message_id "+
-		"WHERE box.address=? AND box.thread_id=? "+
-		"GROUP BY e.message_id "+
-		"ORDER BY e.unix_time ASC",
-		address,
-		threadID,
-	)
-	if err != nil {
-		panic(err)
-	}
-	return rowsToEmails(rows)
-}
-
-func rowsToEmails(rows *sql.Rows) []Email {
-	emails := []Email{}
-	for rows.Next() {
-		var email Email
-		err := rows.Scan(
-			&email.MessageID,
-			&email.UnixTime,
-			&email.From,
-			&email.To,
-			&email.CipherSubject,
-			&email.CipherBody,
-			&email.AncestorIDs,
-			&email.ThreadID,
-		)
-		if err != nil {
-			panic(err)
-		}
-		emails = append(emails, email)
-	}
-	return emails
+func LoadThread(address, threadID string) ([]Email, error) {
+	return getStore().LoadThread(address, threadID)
 }
 
 // Load thread_ids given message_ids.
@@ -370,106 +427,105 @@ func rowsToEmails(rows *sql.Rows) []Email {
 // Returns threadIDs in the same order as messageIDs.
 // e.g. [<id1>, <id1>, "", "", <id2>, ...]
 // messageIDs: an []interface{} of strings
-func LoadThreadIDsForMessageIDs(messageIDs []interface{}) []string {
-	messageIDsPH := "?" + strings.Repeat(",?", len(messageIDs)-1)
-	rows, err := db.Query("SELECT message_id, thread_id "+
-		"FROM email WHERE message_id IN ("+messageIDsPH+")",
-		messageIDs...,
-	)
-	if err != nil {
-		panic(err)
-	}
-	lookup := map[string]string{}
-	for rows.Next() {
-		var messageID, threadID string
-		err := rows.Scan(&messageID, &threadID)
-		if err != nil {
-			panic(err)
-		}
-		lookup[messageID] = threadID
-	}
-	threadIDs := []string{}
-	for _, messageID := range messageIDs {
-		threadIDs = append(threadIDs, lookup[messageID.(string)])
-	}
-	return threadIDs
+func LoadThreadIDsForMessageIDs(messageIDs []interface{}) ([]string, error) {
+	return getStore().LoadThreadIDsForMessageIDs(messageIDs)
 }
 
 // Associates a message to a box (e.g. inbox, archive)
 // Also used to queue outbox messages, in which case
 //  the address is just the host portion.
-func AddMessageToBox(e *Email, address string, box string) {
-	_, err := db.Exec("INSERT INTO box "+
-		"(message_id, unix_time, thread_id, address, box) "+
-		"VALUES (?,?,?,?,?)",
-		e.MessageID,
-		e.UnixTime,
-		e.ThreadID,
-		address,
-		box,
-	)
-	if err != nil {
-		panic(err)
-	}
+// Returns ErrConstraint if the message hasn't been saved.
+func AddMessageToBox(e *Email, address string, box string) error {
+	return getStore().AddMessageToBox(e, address, box)
 }
 
 // Deletes a message from any of a user's box.
 // If the email is no longer referenced, it gets deleted
 //  from the email table as well.
-func DeleteFromBoxes(address string, id string) {
-	res, err := db.Exec("DELETE FROM box "+
-		"WHERE address=? AND message_id=?",
-		address, id)
-	count, err := res.RowsAffected()
-	if err != nil || count == 0 {
-		log.Panicf("Could not delete message %s for %s: %v",
-			id, address, err)
-	}
-	// protected by foreign key constraints
-	db.Exec("DELETE FROM email WHERE message_id=?", id)
+// Returns ErrNotFound if the message wasn't in any of the user's boxes.
+func DeleteFromBoxes(address string, id string) error {
+	return getStore().DeleteFromBoxes(address, id)
 }
 
 // See which boxes message belongs in for user.
 // e.g. ["inbox", "sent"]
-func BoxesForMessage(address string, id string) []string {
-	rows, err := db.Query("select box from box "+
-		"where address=? and message_id=?",
-		address, id)
-	if err != nil {
-		panic(err)
-	}
-	boxes := []string{}
-	for rows.Next() {
-		var box string
-		err := rows.Scan(&box)
-		if err != nil {
-			panic(err)
-		}
-		boxes = append(boxes, box)
-	}
-	return boxes
+func BoxesForMessage(address string, id string) ([]string, error) {
+	return getStore().BoxesForMessage(address, id)
 }
 
 // Move the email to another box.
-// This function only works within the 'inbox'/'archive'/'trash' boxes
-func MoveEmail(address string, messageID string, newBox string) {
-	if newBox != "inbox" && newBox != "archive" && newBox != "trash" {
-		panic("MoveEmail() cannot move emails to " + newBox)
-	}
-	res, err := db.Exec("update box "+
-		"set box=? "+
-		"where address=? and message_id=? and box in ('inbox', 'archive', 'trash')",
-		newBox, address, messageID)
-	if err != nil {
-		panic(err)
-	}
-	rows, err := res.RowsAffected()
-	if err != nil {
-		panic(err)
+// Moves between 'inbox' and 'archive', and out of 'trash'.
+// Use TrashThread to move mail into the trash.
+func MoveEmail(address string, messageID string, newBox string) error {
+	return getStore().MoveEmail(address, messageID, newBox)
+}
+
+// Marks one email as read (or unread), in whatever box it is
+func MarkAsRead(address string, messageID string, isRead bool) error {
+	return getStore().MarkAsRead(address, messageID, isRead)
+}
+
+// Like TrashThread, for one email
+func TrashEmail(address string, messageID string) error {
+	return getStore().TrashEmail(address, messageID, time.Now().Unix())
+}
+
+// Like RestoreThread, for one email
+func RestoreEmail(address string, messageID string) error {
+	return getStore().RestoreEmail(address, messageID)
+}
+
+// Makes the same change to the threads of many messages, or to just
+// the messages, in one transaction. Delete deletes for good, moving
+// to the trash is a move. Returns an error for each message,
+// nil where the change worked, eg ErrNotFound for someone else's mail.
+// If the change itself is invalid, or the transaction fails,
+// returns an error instead and nothing changes.
+func UpdateInBulk(address string, op BulkOp, messageIDs []string) ([]error, error) {
+	return getStore().UpdateInBulk(address, op, messageIDs, time.Now().Unix())
+}
+
+// Marks everything in one of a user's boxes as read.
+// Returns how many messages were unread.
+func MarkBoxAsRead(address string, box string) (int64, error) {
+	return getStore().MarkBoxAsRead(address, box)
+}
+
+// Returns ErrConstraint if op isn't a change UpdateInBulk can make
+func (op BulkOp) check() error {
+	switch op.Action {
+	case "move":
+		if op.Box != "trash" {
+			return checkMovableBox(op.Box)
+		}
+	case "restore", "read", "unread", "delete":
+	case "label":
+		if op.MessageOnly {
+			return fmt.Errorf("%w: labels go on whole threads", ErrConstraint)
+		}
+	default:
+		return fmt.Errorf("%w: no bulk action %s", ErrConstraint, op.Action)
 	}
-	if rows != 1 {
-		log.Panicf("Expected to move one message (%v/%v), found %v", address, messageID, rows)
+	return nil
+}
+
+// The boxes that MoveEmail and MoveThread move out of
+func isMovableBox(box string) bool {
+	return box == "inbox" || box == "archive" || box == "trash"
+}
+
+// The boxes that MoveEmail and MoveThread move into.
+// Trash remembers where mail came from, so only TrashThread moves there.
+func checkMovableBox(box string) error {
+	if !isMovableBox(box) || box == "trash" {
+		return fmt.Errorf("%w: cannot move emails to %s", ErrConstraint, box)
 	}
+	return nil
+}
+
+// The boxes that TrashThread moves out of
+func isTrashableBox(box string) bool {
+	return box == "inbox" || box == "archive" || box == "sent"
 }
 
 //
@@ -477,196 +533,255 @@ func MoveEmail(address string, messageID string, newBox string) {
 //
 
 // Move emails in a thread to another box.
-// This function only works within the 'inbox'/'archive'/'trash' boxes
-func MoveThread(address string, messageID string, newBox string) {
-	if newBox != "inbox" && newBox != "archive" && newBox != "trash" {
-		panic("MoveEmail() cannot move emails to " + newBox)
-	}
-	res, err := db.Exec(
-		"UPDATE box AS b "+
-			"INNER JOIN ( "+
-			"SELECT thread_id, unix_time FROM email "+
-			"WHERE message_id = ? "+
-			") AS e ON "+
-			"b.thread_id = e.thread_id "+
-			"SET box = ? "+
-			"WHERE "+
-			"b.address = ? AND "+
-			"b.unix_time <= e.unix_time AND "+
-			"b.box IN ('inbox', 'archive', 'trash') ",
-		messageID, newBox, address)
-	if err != nil {
-		panic(err)
-	}
-	rows, err := res.RowsAffected()
-	if err != nil {
-		panic(err)
-	}
-	if rows == 0 {
-		log.Panicf("Expected to move at least one message (%v/%v), found none", address, messageID)
-	}
+// Moves between 'inbox' and 'archive', and out of 'trash'.
+// Use TrashThread to move mail into the trash.
+func MoveThread(address string, messageID string, newBox string) error {
+	return getStore().MoveThread(address, messageID, newBox)
 }
 
 // Marks a given set of emails as read (or unread)
-func ThreadMarkAsRead(address string, messageID string, isRead bool) {
-	_, err := db.Exec(
-		"UPDATE box AS b "+
-			"INNER JOIN ( "+
-			"SELECT thread_id, unix_time FROM email "+
-			"WHERE message_id = ? "+
-			") AS e ON "+
-			"b.thread_id = e.thread_id "+
-			"SET is_read = ? "+
-			"WHERE "+
-			"b.address = ? AND "+
-			"b.unix_time <= e.unix_time",
-		messageID, isRead, address)
-	if err != nil {
-		panic(err)
-	}
+func ThreadMarkAsRead(address string, messageID string, isRead bool) error {
+	return getStore().ThreadMarkAsRead(address, messageID, isRead)
 }
 
 // Finds users with new unread mail
 // Returns a list of all the secondary emails
-func GetUsersWithUnreadMail(minAgeMins int, maxAgeMins int) []string {
-	currentUnixTime := time.Now().UTC().Unix()
-	minUnixTime := currentUnixTime - int64(maxAgeMins)*60
-	maxUnixTime := currentUnixTime - int64(minAgeMins)*60
-	rows, err := db.Query(
-		"SELECT DISTINCT secondary_email FROM user u "+
-			"INNER JOIN box b ON b.address=CONCAT(u.token,'@',u.email_host) "+
-			"WHERE b.box='inbox' AND b.is_read=0 AND b.unix_time>? AND b.unix_time<?",
-		minUnixTime, maxUnixTime)
-	if err != nil {
-		panic(err)
-	}
-	emails := make([]string, 0)
-	for rows.Next() {
-		var email string
-		rows.Scan(&email)
-		emails = append(emails, email)
-	}
-	return emails
+func GetUsersWithUnreadMail(minAgeMins int, maxAgeMins int) ([]string, error) {
+	return getStore().GetUsersWithUnreadMail(minAgeMins, maxAgeMins)
 }
 
 // Deletes messages of a thread from any of a user's box.
 // If the email is no longer referenced, it gets deleted
 //  from the email table as well.
-func DeleteThreadFromBoxes(address string, messageID string) {
-	res, err := db.Exec(
-		"DELETE b FROM box AS b "+
-			"INNER JOIN ( "+
-			"SELECT thread_id, unix_time FROM email "+
-			"WHERE message_id = ? "+
-			") AS e ON "+
-			"b.thread_id = e.thread_id "+
-			"WHERE "+
-			"b.unix_time <= e.unix_time AND "+
-			"b.address = ? ",
-		messageID, address)
-	if err != nil {
-		panic(err)
-	}
-	count, err := res.RowsAffected()
-	if err != nil || count == 0 {
-		log.Panicf("Could not delete thread messages for message %s for %s: %v",
-			messageID, address, err)
+func DeleteThreadFromBoxes(address string, messageID string) error {
+	return getStore().DeleteThreadFromBoxes(address, messageID)
+}
+
+// Moves a thread's messages in the inbox, archive and sent boxes
+// to the trash, remembering which box each came from.
+// Returns ErrNotFound if there was nothing to move.
+func TrashThread(address string, messageID string) error {
+	return getStore().TrashThread(address, messageID, time.Now().Unix())
+}
+
+// Moves a thread's messages in the trash back where they came from.
+// Returns ErrNotFound if none of them are in the trash.
+func RestoreThread(address string, messageID string) error {
+	return getStore().RestoreThread(address, messageID)
+}
+
+// Deletes everything in a user's trash for good.
+// Returns the number of messages deleted.
+func EmptyTrash(address string) (int64, error) {
+	return getStore().EmptyTrash(address)
+}
+
+//
+// LABELS
+//
+
+// Creates a label for a user, with a name encrypted for them
+func CreateLabel(address string, cipherName string) (*Label, error) {
+	return getStore().CreateLabel(address, cipherName)
+}
+
+// Loads a user's labels, oldest first
+func LoadLabels(address string) ([]Label, error) {
+	return getStore().LoadLabels(address)
+}
+
+// Returns ErrNotFound if the user has no such label
+func RenameLabel(address string, id int64, cipherName string) error {
+	return getStore().RenameLabel(address, id, cipherName)
+}
+
+// Deletes a label and takes it off every thread. The mail stays.
+// Returns ErrNotFound if the user has no such label
+func DeleteLabel(address string, id int64) error {
+	return getStore().DeleteLabel(address, id)
+}
+
+// Adds and removes labels on the messages of a thread,
+// up to and including messageID, in whatever box they are.
+// Returns ErrNotFound if the user has no such thread or one of the labels
+// isn't theirs, in which case nothing changes.
+func LabelThread(address string, messageID string, add, remove []int64) error {
+	return getStore().LabelThread(address, messageID, add, remove)
+}
+
+// Like LoadBoxByThread(), but lists the threads with a label,
+// whichever box they are in except the trash
+func LoadLabelByThread(address string, labelID int64, offset, limit int) ([]EmailHeader, error) {
+	return getStore().LoadLabelByThread(address, labelID, offset, limit)
+}
+
+// Like LoadBoxByThreadAfter(), for a label
+func LoadLabelByThreadAfter(address string, labelID int64, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return getStore().LoadLabelByThreadAfter(address, labelID, after, limit)
+}
+
+// Counts the threads with a label, except in the trash
+func CountLabel(address string, labelID int64) (int, error) {
+	return getStore().CountLabel(address, labelID)
+}
+
+//
+// FLAGS
+//
+
+// Sets and clears flags on the messages of a thread,
+// up to and including messageID, in whatever box they are.
+// Returns ErrNotFound if the user has no such thread.
+func FlagThread(address string, messageID string, set, clear Flags) error {
+	return getStore().FlagThread(address, messageID, set, clear)
+}
+
+// Like FlagThread, but only for the one message
+func FlagMessage(address string, messageID string, set, clear Flags) error {
+	return getStore().FlagMessage(address, messageID, set, clear)
+}
+
+// Like LoadBoxByThread(), but only lists the threads of a box
+// with a message that has any of the flags
+func LoadFlaggedByThread(address string, box string, flags Flags, offset, limit int) ([]EmailHeader, error) {
+	return getStore().LoadFlaggedByThread(address, box, flags, offset, limit)
+}
+
+// Like LoadBoxByThreadAfter(), for flagged threads
+func LoadFlaggedByThreadAfter(address string, box string, flags Flags, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return getStore().LoadFlaggedByThreadAfter(address, box, flags, after, limit)
+}
+
+// Counts the threads of a box with a message that has any of the flags
+func CountFlagged(address string, box string, flags Flags) (int, error) {
+	return getStore().CountFlagged(address, box, flags)
+}
+
+//
+// DRAFTS
+//
+
+// Saves a new draft, at version 1.
+// Returns ErrDuplicate if the user has a draft with that message ID,
+// or a message with it was already sent.
+func CreateDraft(address string, draft *Draft) error {
+	return getStore().CreateDraft(address, draft)
+}
+
+// Saves over a draft, if it's still at draft.Version, and bumps the version.
+// Returns ErrConflict if it was saved since, eg from another tab,
+// or ErrNotFound if it was deleted or sent.
+func UpdateDraft(address string, draft *Draft) error {
+	return getStore().UpdateDraft(address, draft)
+}
+
+// Loads a draft, or ErrNotFound if the user has no such draft
+func LoadDraft(address string, messageID string) (*Draft, error) {
+	return getStore().LoadDraft(address, messageID)
+}
+
+// Loads the headers of a page of a user's drafts, last saved first.
+// Drafts aren't threaded, each is listed on its own.
+func LoadDrafts(address string, offset, limit int) ([]EmailHeader, error) {
+	return getStore().LoadDrafts(address, offset, limit)
+}
+
+func CountDrafts(address string) (int, error) {
+	return getStore().CountDrafts(address)
+}
+
+// Returns ErrNotFound if the user has no such draft
+func DeleteDraft(address string, messageID string) error {
+	return getStore().DeleteDraft(address, messageID)
+}
+
+// How a draft is listed in the drafts box
+func (draft *Draft) header(from string) EmailHeader {
+	return EmailHeader{
+		MessageID:     draft.MessageID,
+		ThreadID:      draft.ThreadID,
+		UnixTime:      draft.UnixTime,
+		From:          from,
+		To:            draft.To,
+		IsRead:        true,
+		CipherSubject: draft.CipherSubject,
 	}
-	// protected by foreign key constraints
-	db.Exec("DELETE FROM email WHERE message_id=?", messageID)
+}
+
+//
+// SEARCH
+//
+
+// Replaces the search tokens of one of a user's messages.
+// Tokens are keyed hashes of the words in the message, made by the client
+// after it decrypts it, so the server never sees the words themselves.
+// Returns ErrNotFound if the message isn't in any of the user's boxes.
+// The tokens go away once it isn't anymore.
+func SaveSearchTokens(address string, messageID string, tokens []string) error {
+	return getStore().SaveSearchTokens(address, messageID, tokens)
+}
+
+// Like LoadBoxByThread(), but lists the threads with a message that has
+// every one of the tokens, whichever box it is in except the trash.
+// Pass at least one token, none matches everything.
+func SearchByThread(address string, tokens []string, offset, limit int) ([]EmailHeader, error) {
+	return getStore().SearchByThread(address, tokens, offset, limit)
+}
+
+// Like LoadBoxByThreadAfter(), for a search
+func SearchByThreadAfter(address string, tokens []string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return getStore().SearchByThreadAfter(address, tokens, after, limit)
+}
+
+// Counts the threads a search lists
+func CountSearch(address string, tokens []string) (int, error) {
+	return getStore().CountSearch(address, tokens)
 }
 
 //
 // NOTARY
 //
 
-func AddNameResolution(name, host, hash string) {
-	_, err := db.Exec("INSERT INTO name_resolution "+
-		"(name, host, hash, unix_time) "+
-		"VALUES (?,?,?,?)",
-		name,
-		host,
-		hash,
-		time.Now().Unix(),
-	)
-	if err != nil {
-		panic(err)
-	}
+func AddNameResolution(name, host, hash string) error {
+	return getStore().AddNameResolution(name, host, hash)
 }
 
-func DeleteNameResolution(name, host string) {
-	_, err := db.Exec("DELETE FROM name_resolution "+
-		"WHERE name=? and host=?",
-		name,
-		host,
-	)
-	if err != nil {
-		panic(err)
-	}
+// Like AddNameResolution, but replaces the hash if the name has one.
+// Only tombstones replace a name's hash, see publicKeySeedHandler.
+func SetNameResolution(name, host, hash string) error {
+	return getStore().SetNameResolution(name, host, hash)
 }
 
-func GetNameResolution(name, host string) (hash string) {
-	err := db.QueryRow("SELECT "+
-		"hash FROM name_resolution WHERE "+
-		"name=? AND host=?",
-		name, host).Scan(
-		&hash)
-	if err == sql.ErrNoRows {
-		return ""
-	}
-	if err != nil {
-		panic(err)
-	}
-	return
+func DeleteNameResolution(name, host string) error {
+	return getStore().DeleteNameResolution(name, host)
+}
+
+func GetNameResolution(name, host string) (hash string, err error) {
+	return getStore().GetNameResolution(name, host)
 }
 
-func TrySetMxHostInfo(host string, isScramble bool, notaryPublicKey string) *MxHostInfo {
-	hostInfo := GetMxHostInfo(host)
-	if hostInfo == nil {
+func TrySetMxHostInfo(host string, isScramble bool, notaryPublicKey string) (*MxHostInfo, error) {
+	hostInfo, err := GetMxHostInfo(host)
+	if errors.Is(err, ErrNotFound) {
 		return SetMxHostInfo(host, isScramble, notaryPublicKey)
 	}
-	return hostInfo
-}
-
-func SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) *MxHostInfo {
-	now := time.Now().Unix()
-	_, err := db.Exec("INSERT INTO mx_hosts "+
-		"(host, is_scramble, notary_public_key, unix_time) "+
-		"VALUES (?,?,?,?) "+
-		"ON DUPLICATE KEY UPDATE "+
-		"is_scramble = VALUES(is_scramble), "+
-		"notary_public_key = VALUES(notary_public_key), "+
-		"unix_time = VALUES(unix_time)",
-		host,
-		isScramble,
-		sql.NullString{notaryPublicKey, notaryPublicKey != ""},
-		now,
-	)
-	if err != nil {
-		panic(err)
-	}
-	return &MxHostInfo{host, isScramble, notaryPublicKey, now}
-}
-
-func GetMxHostInfo(host string) *MxHostInfo {
-	var info MxHostInfo
-	var pubKeyNull sql.NullString
-	err := db.QueryRow("SELECT "+
-		"host, is_scramble, notary_public_key, unix_time "+
-		"FROM mx_hosts WHERE host=?",
-		host).Scan(
-		&info.Host,
-		&info.IsScramble,
-		&pubKeyNull,
-		&info.UnixTime,
-	)
-	switch {
-	case err == sql.ErrNoRows:
-		return nil
-	case err != nil:
-		panic(err)
-	default:
-		info.NotaryPublicKey = pubKeyNull.String
-		return &info
-	}
+	return hostInfo, err
+}
+
+func SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) (*MxHostInfo, error) {
+	return getStore().SetMxHostInfo(host, isScramble, notaryPublicKey)
+}
+
+func GetMxHostInfo(host string) (*MxHostInfo, error) {
+	return getStore().GetMxHostInfo(host)
+}
+
+//
+// RETENTION
+//
+
+// Sets how many days a user's sent mail is kept,
+// 0 to go back to the server default
+func SetSentRetentionDays(token string, days int) error {
+	return getStore().SetSentRetentionDays(token, days)
 }
@@ -0,0 +1,1624 @@
+package scramble
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in maps.
+// It mirrors the behavior of the SQL store, including the errors
+// it returns, so that tests can run without a database.
+// Nothing survives a restart.
+type memoryStore struct {
+	mutex sync.Mutex
+
+	users           map[string]*memoryUser // by token
+	emails          map[string]*Email      // by message id
+	boxes           []*memoryBoxRow
+	nextBoxID       int64
+	labels          map[int64]*memoryLabel // by id
+	nextLabelID     int64
+	sessions        map[int64]*Session // by id
+	nextSessionID   int64
+	twoFactors      map[string]*TwoFactor            // by token
+	recoveryCodes   map[string]map[string]bool       // by token, then hash
+	drafts          map[string]*memoryDraft          // by address and message id
+	searchTokens    map[string]*memorySearchTokens   // by address and message id
+	nameResolutions map[string]*memoryNameResolution // by name@host
+	mxHosts         map[string]*MxHostInfo           // by host
+}
+
+type memoryUser struct {
+	User
+	cipherContacts *string
+}
+
+type memoryBoxRow struct {
+	id        int64
+	messageID string
+	address   string
+	box       string
+	unixTime  int64
+	threadID  string
+	isRead    bool
+	flags     Flags
+
+	trashedFrom string
+	trashedTime int64
+
+	labels map[int64]bool // by label id
+}
+
+type memoryLabel struct {
+	Label
+	address string
+}
+
+type memoryDraft struct {
+	Draft
+	address string
+}
+
+type memorySearchTokens struct {
+	address   string
+	messageID string
+	tokens    map[string]bool
+}
+
+type memoryNameResolution struct {
+	hash     string
+	unixTime int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:           map[string]*memoryUser{},
+		emails:          map[string]*Email{},
+		labels:          map[int64]*memoryLabel{},
+		sessions:        map[int64]*Session{},
+		twoFactors:      map[string]*TwoFactor{},
+		recoveryCodes:   map[string]map[string]bool{},
+		drafts:          map[string]*memoryDraft{},
+		searchTokens:    map[string]*memorySearchTokens{},
+		nameResolutions: map[string]*memoryNameResolution{},
+		mxHosts:         map[string]*MxHostInfo{},
+	}
+}
+
+//
+// USERS
+//
+
+func (s *memoryStore) SaveUser(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.users[user.Token] != nil || s.findUserByPubHash(user.PublicHash) != nil {
+		return fmt.Errorf("%w: user %s", ErrDuplicate, user.Token)
+	}
+	// only the columns the SQL store inserts, the rest get their defaults
+	saved := &memoryUser{}
+	saved.Token = user.Token
+	saved.PasswordHash = user.PasswordHash
+	saved.PublicHash = user.PublicHash
+	saved.PublicKey = user.PublicKey
+	saved.CipherPrivateKey = user.CipherPrivateKey
+	saved.EmailHost = user.EmailHost
+	saved.SecondaryEmail = user.SecondaryEmail
+	saved.EmailAddress = user.Token + "@" + user.EmailHost
+	s.users[user.Token] = saved
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.users[token] == nil {
+		return fmt.Errorf("%w: user %s", ErrNotFound, token)
+	}
+	delete(s.users, token)
+	return nil
+}
+
+func (s *memoryStore) LoadUser(token string) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.users[token]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	copied := user.User
+	return &copied, nil
+}
+
+func (s *memoryStore) LoadUserID(token string) (*UserID, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.users[token]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	copied := user.UserID
+	return &copied, nil
+}
+
+func (s *memoryStore) LoadPubHash(token, emailHost string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.users[token]
+	if user == nil || user.EmailHost != emailHost {
+		return "", ErrNotFound
+	}
+	return user.PublicHash, nil
+}
+
+func (s *memoryStore) LoadPubKey(publicHash string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByPubHash(publicHash)
+	if user == nil {
+		return "", ErrNotFound
+	}
+	return user.PublicKey, nil
+}
+
+func (s *memoryStore) LoadAddressFromPubHash(publicHash string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByPubHash(publicHash)
+	if user == nil {
+		return "", ErrNotFound
+	}
+	return user.Token + "@" + user.EmailHost, nil
+}
+
+func (s *memoryStore) LoadContacts(token string) (*string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.users[token]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	return user.cipherContacts, nil
+}
+
+func (s *memoryStore) SaveContacts(token string, cipherContacts string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if user := s.users[token]; user != nil {
+		user.cipherContacts = &cipherContacts
+	}
+	return nil
+}
+
+func (s *memoryStore) ChangePassphrase(token string, change *PassphraseChange) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.users[token]
+	if user == nil ||
+		(change.OldPassHash == "" || change.OldPassHash != user.PasswordHash) &&
+			(change.OldPassHashOld == "" || change.OldPassHashOld != user.PasswordHashOld) {
+		return fmt.Errorf("%w: user %s with that passphrase", ErrNotFound, token)
+	}
+	user.PasswordHash = change.PassHash
+	user.PasswordHashOld = ""
+	user.CipherPrivateKey = change.CipherPrivateKey
+	if change.CipherContacts != nil {
+		contacts := *change.CipherContacts
+		user.cipherContacts = &contacts
+	}
+	for id, session := range s.sessions {
+		if session.Token == token {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteAccount(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.users[token]
+	if user == nil {
+		return fmt.Errorf("%w: user %s", ErrNotFound, token)
+	}
+	address := user.EmailAddress
+
+	messageIDs := map[string]bool{}
+	for _, row := range s.findBoxRows(func(row *memoryBoxRow) bool { return row.address == address }) {
+		messageIDs[row.messageID] = true
+	}
+	s.deleteBoxRows(func(row *memoryBoxRow) bool { return row.address == address })
+	for messageID := range messageIDs {
+		s.deleteEmailIfUnreferenced(messageID)
+	}
+	for id, label := range s.labels {
+		if label.address == address {
+			delete(s.labels, id)
+		}
+	}
+	for key, draft := range s.drafts {
+		if draft.address == address {
+			delete(s.drafts, key)
+		}
+	}
+	for key, saved := range s.searchTokens {
+		if saved.address == address {
+			delete(s.searchTokens, key)
+		}
+	}
+	for id, session := range s.sessions {
+		if session.Token == token {
+			delete(s.sessions, id)
+		}
+	}
+	delete(s.recoveryCodes, token)
+	delete(s.twoFactors, token)
+	delete(s.users, token)
+	s.nameResolutions[token+"@"+user.EmailHost] = &memoryNameResolution{TombstoneHash, time.Now().Unix()}
+	return nil
+}
+
+func (s *memoryStore) findUserByPubHash(publicHash string) *memoryUser {
+	for _, user := range s.users {
+		if user.PublicHash == publicHash {
+			return user
+		}
+	}
+	return nil
+}
+
+//
+// SESSIONS
+//
+
+func (s *memoryStore) CreateSession(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, other := range s.sessions {
+		if other.Hash == session.Hash {
+			return fmt.Errorf("%w: session hash", ErrDuplicate)
+		}
+	}
+	s.nextSessionID++
+	session.ID = s.nextSessionID
+	copied := *session
+	s.sessions[session.ID] = &copied
+	return nil
+}
+
+func (s *memoryStore) LoadSession(hash string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, session := range s.sessions {
+		if session.Hash == hash {
+			copied := *session
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) LoadSessions(token string, now int64) ([]Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		if session.Token == token && session.ExpiresTime > now {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedTime != sessions[j].CreatedTime {
+			return sessions[i].CreatedTime > sessions[j].CreatedTime
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (s *memoryStore) DeleteSession(token string, id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session := s.sessions[id]
+	if session == nil || session.Token != token {
+		return fmt.Errorf("%w: session %d for %s", ErrNotFound, id, token)
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memoryStore) DeleteSessions(token string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := int64(0)
+	for id, session := range s.sessions {
+		if session.Token == token {
+			delete(s.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+//
+// TWO-FACTOR
+//
+
+func (s *memoryStore) SaveTwoFactor(tf *TwoFactor) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old := s.twoFactors[tf.Token]; old != nil && old.EnabledTime != 0 {
+		return fmt.Errorf("%w: two-factor of %s is on already", ErrConflict, tf.Token)
+	}
+	copied := *tf
+	s.twoFactors[tf.Token] = &copied
+	return nil
+}
+
+func (s *memoryStore) LoadTwoFactor(token string) (*TwoFactor, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tf := s.twoFactors[token]
+	if tf == nil {
+		return nil, ErrNotFound
+	}
+	copied := *tf
+	return &copied, nil
+}
+
+func (s *memoryStore) EnableTwoFactor(token string, step int64, now int64, recoveryHashes []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tf := s.twoFactors[token]
+	if tf == nil || tf.EnabledTime != 0 || tf.LastStep >= step {
+		return fmt.Errorf("%w: two-factor enrollment of %s", ErrNotFound, token)
+	}
+	tf.EnabledTime = now
+	tf.LastStep = step
+	s.recoveryCodes[token] = map[string]bool{}
+	for _, hash := range recoveryHashes {
+		s.recoveryCodes[token][hash] = true
+	}
+	return nil
+}
+
+func (s *memoryStore) UseTwoFactorStep(token string, step int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tf := s.twoFactors[token]
+	if tf == nil || tf.LastStep >= step {
+		return fmt.Errorf("%w: code used already", ErrConflict)
+	}
+	tf.LastStep = step
+	return nil
+}
+
+func (s *memoryStore) UseRecoveryCode(token string, hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.recoveryCodes[token][hash] {
+		return fmt.Errorf("%w: recovery code of %s", ErrNotFound, token)
+	}
+	delete(s.recoveryCodes[token], hash)
+	return nil
+}
+
+func (s *memoryStore) CountRecoveryCodes(token string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.recoveryCodes[token]), nil
+}
+
+func (s *memoryStore) DeleteTwoFactor(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.twoFactors[token] == nil {
+		return fmt.Errorf("%w: two-factor of %s", ErrNotFound, token)
+	}
+	delete(s.twoFactors, token)
+	delete(s.recoveryCodes, token)
+	return nil
+}
+
+//
+// EMAIL HEADERS
+//
+
+func (s *memoryStore) LoadBox(address string, box string, offset, limit int) ([]EmailHeader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := s.findBoxRows(func(row *memoryBoxRow) bool {
+		return row.address == address && row.box == box
+	})
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].unixTime > rows[j].unixTime
+	})
+	headers := make([]EmailHeader, 0)
+	for _, row := range pageIndexes(len(rows), offset, limit) {
+		header := s.emails[rows[row].messageID].EmailHeader
+		header.IsRead = rows[row].isRead
+		header.Flags = rows[row].flags
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+func (s *memoryStore) LoadBoxByThread(address string, box string, offset, limit int) ([]EmailHeader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadThreads(inBox(address, box), offset, limit), nil
+}
+
+func (s *memoryStore) LoadBoxByThreadAfter(address string, box string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	headers, next := s.loadThreadsAfter(inBox(address, box), after, limit)
+	return headers, next, nil
+}
+
+func (s *memoryStore) CountBox(address string, box string) (count int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.findThreads(inBox(address, box))), nil
+}
+
+func (s *memoryStore) LoadBoxCounts(address string) (map[string]BoxCount, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counts := newBoxCounts()
+	for _, label := range s.labels {
+		if label.address == address {
+			counts[labelBoxName(label.ID)] = BoxCount{}
+		}
+	}
+	unread := map[string]map[string]bool{} // by box name, then thread id
+	count := func(box string, row *memoryBoxRow) {
+		if unread[box] == nil {
+			unread[box] = map[string]bool{}
+		}
+		unread[box][row.threadID] = unread[box][row.threadID] || !row.isRead
+	}
+	for _, row := range s.boxes {
+		if row.address != address {
+			continue
+		}
+		if _, ok := counts[row.box]; ok {
+			count(row.box, row)
+		}
+		if row.box != "trash" {
+			for labelID := range row.labels {
+				count(labelBoxName(labelID), row)
+			}
+		}
+	}
+	for box, threads := range unread {
+		boxCount := BoxCount{Total: len(threads)}
+		for _, isUnread := range threads {
+			if isUnread {
+				boxCount.Unread++
+			}
+		}
+		counts[box] = boxCount
+	}
+	counts["drafts"] = BoxCount{Total: len(s.findDrafts(address))}
+	return counts, nil
+}
+
+// Matches a user's box rows in a given box
+func inBox(address string, box string) func(*memoryBoxRow) bool {
+	return func(row *memoryBoxRow) bool {
+		return row.address == address && row.box == box
+	}
+}
+
+func (s *memoryStore) loadThreads(match func(*memoryBoxRow) bool, offset, limit int) []EmailHeader {
+	threads := s.findThreads(match)
+	page := []*memoryThread{}
+	for _, i := range pageIndexes(len(threads), offset, limit) {
+		page = append(page, threads[i])
+	}
+	headers := s.threadHeaders(page)
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].UnixTime > headers[j].UnixTime
+	})
+	return headers
+}
+
+func (s *memoryStore) loadThreadsAfter(match func(*memoryBoxRow) bool, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor) {
+	page := []*memoryThread{}
+	for _, thread := range s.findThreads(match) {
+		if len(page) == limit {
+			break
+		}
+		if after != nil && (thread.unixTime > after.UnixTime ||
+			thread.unixTime == after.UnixTime && thread.threadID >= after.ThreadID) {
+			continue
+		}
+		page = append(page, thread)
+	}
+	headers := s.threadHeaders(page)
+	if len(page) < limit {
+		return headers, nil
+	}
+	last := page[len(page)-1]
+	return headers, &BoxCursor{last.unixTime, last.threadID}
+}
+
+// A thread in a box, grouped by thread_id like the SQL store:
+// MAX(message_id), MIN(is_read), MAX(unix_time), any flags
+type memoryThread struct {
+	threadID  string
+	messageID string
+	isRead    bool
+	unixTime  int64
+	flags     Flags
+}
+
+// Finds the threads of the matching box rows, newest first
+func (s *memoryStore) findThreads(match func(*memoryBoxRow) bool) []*memoryThread {
+	byID := map[string]*memoryThread{}
+	threads := []*memoryThread{}
+	for _, row := range s.boxes {
+		if !match(row) {
+			continue
+		}
+		thread := byID[row.threadID]
+		if thread == nil {
+			thread = &memoryThread{row.threadID, row.messageID, row.isRead, row.unixTime, row.flags}
+			byID[row.threadID] = thread
+			threads = append(threads, thread)
+			continue
+		}
+		if row.messageID > thread.messageID {
+			thread.messageID = row.messageID
+		}
+		thread.isRead = thread.isRead && row.isRead
+		thread.flags |= row.flags
+		if row.unixTime > thread.unixTime {
+			thread.unixTime = row.unixTime
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		if threads[i].unixTime != threads[j].unixTime {
+			return threads[i].unixTime > threads[j].unixTime
+		}
+		return threads[i].threadID > threads[j].threadID
+	})
+	return threads
+}
+
+func (s *memoryStore) threadHeaders(threads []*memoryThread) []EmailHeader {
+	headers := make([]EmailHeader, 0)
+	for _, thread := range threads {
+		email := s.emails[thread.messageID]
+		if email == nil {
+			continue
+		}
+		header := email.EmailHeader
+		header.IsRead = thread.isRead
+		header.Flags = thread.flags
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+func (s *memoryStore) LoadStorageUsed(address string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counted := map[string]bool{}
+	used := int64(0)
+	for _, row := range s.boxes {
+		if row.address == address && !counted[row.messageID] {
+			counted[row.messageID] = true
+			used += int64(len(s.emails[row.messageID].CipherBody))
+		}
+	}
+	for _, draft := range s.findDrafts(address) {
+		used += int64(len(draft.CipherBody))
+	}
+	return used, nil
+}
+
+// Returns the indexes of a LIMIT offset, limit page of n rows
+func pageIndexes(n, offset, limit int) []int {
+	indexes := []int{}
+	for i := offset; i < n && i < offset+limit; i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+//
+// EMAIL
+//
+
+func (s *memoryStore) SaveMessage(e *Email) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.emails[e.MessageID] != nil {
+		return fmt.Errorf("%w: message %s", ErrDuplicate, e.MessageID)
+	}
+	saved := *e
+	saved.IsRead = false
+	s.emails[e.MessageID] = &saved
+	return nil
+}
+
+func (s *memoryStore) DeliverMessage(e *Email, boxes []MessageBox) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deliverMessage(e, boxes)
+}
+
+func (s *memoryStore) DeliverDraft(address string, e *Email, boxes []MessageBox) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.deliverMessage(e, boxes); err != nil {
+		return err
+	}
+	delete(s.drafts, messageKey(address, e.MessageID))
+	return nil
+}
+
+func (s *memoryStore) deliverMessage(e *Email, boxes []MessageBox) error {
+	if s.emails[e.MessageID] != nil {
+		return fmt.Errorf("%w: message %s", ErrDuplicate, e.MessageID)
+	}
+	// check everything first, so that nothing is saved on error
+	for _, box := range boxes {
+		if err := checkBoxName(box.Box); err != nil {
+			return err
+		}
+	}
+	saved := *e
+	saved.IsRead = false
+	s.emails[e.MessageID] = &saved
+	for _, box := range boxes {
+		s.addBoxRow(e, box.Address, box.Box)
+	}
+	return nil
+}
+
+func (s *memoryStore) LoadMessage(id string) (Email, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	email := s.emails[id]
+	if email == nil {
+		return Email{EmailHeader: EmailHeader{MessageID: id}}, ErrNotFound
+	}
+	return *email, nil
+}
+
+func (s *memoryStore) LoadThread(address, threadID string) ([]Email, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	emails := []Email{}
+	seen := map[string]int{} // index in emails, by message id
+	for _, row := range s.boxes {
+		if row.address != address || row.threadID != threadID {
+			continue
+		}
+		if i, ok := seen[row.messageID]; ok {
+			emails[i].Flags |= row.flags
+			continue
+		}
+		seen[row.messageID] = len(emails)
+		emails = append(emails, *s.emails[row.messageID])
+		emails[len(emails)-1].Flags = row.flags
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].UnixTime < emails[j].UnixTime
+	})
+	return emails, nil
+}
+
+func (s *memoryStore) LoadThreadIDsForMessageIDs(messageIDs []interface{}) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	threadIDs := []string{}
+	for _, messageID := range messageIDs {
+		threadID := ""
+		if email := s.emails[messageID.(string)]; email != nil {
+			threadID = email.ThreadID
+		}
+		threadIDs = append(threadIDs, threadID)
+	}
+	return threadIDs, nil
+}
+
+func (s *memoryStore) AddMessageToBox(e *Email, address string, box string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.emails[e.MessageID] == nil {
+		return fmt.Errorf("%w: no message %s to add to %s/%s",
+			ErrConstraint, e.MessageID, address, box)
+	}
+	if err := checkBoxName(box); err != nil {
+		return err
+	}
+	s.addBoxRow(e, address, box)
+	return nil
+}
+
+// Same as the ENUM (or CHECK) on the box column
+func checkBoxName(box string) error {
+	switch box {
+	case "inbox", "outbox", "sent", "archive", "trash", "outbox-sent", "outbox-processing":
+		return nil
+	}
+	return fmt.Errorf("%w: no box named %s", ErrConstraint, box)
+}
+
+func (s *memoryStore) addBoxRow(e *Email, address string, box string) {
+	s.nextBoxID++
+	row := &memoryBoxRow{
+		id:        s.nextBoxID,
+		messageID: e.MessageID,
+		address:   address,
+		box:       box,
+		unixTime:  e.UnixTime,
+		threadID:  e.ThreadID,
+	}
+	if box == "trash" {
+		row.trashedTime = e.UnixTime
+	}
+	s.boxes = append(s.boxes, row)
+}
+
+func (s *memoryStore) DeleteFromBoxes(address string, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.deleteRows(s.findMessageRows(address, id)) == 0 {
+		return fmt.Errorf("%w: message %s for %s", ErrNotFound, id, address)
+	}
+	return nil
+}
+
+func (s *memoryStore) BoxesForMessage(address string, id string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	boxes := []string{}
+	for _, row := range s.boxes {
+		if row.address == address && row.messageID == id {
+			boxes = append(boxes, row.box)
+		}
+	}
+	return boxes, nil
+}
+
+func (s *memoryStore) MoveEmail(address string, messageID string, newBox string) error {
+	if err := checkMovableBox(newBox); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if moveRows(s.findMessageRows(address, messageID), newBox) == 0 {
+		return fmt.Errorf("%w: message %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+// Moves the rows that are in the inbox, archive or trash to box.
+// Returns how many it moved.
+func moveRows(rows []*memoryBoxRow, box string) int {
+	count := 0
+	for _, row := range rows {
+		if isMovableBox(row.box) {
+			row.moveTo(box)
+			count++
+		}
+	}
+	return count
+}
+
+func (row *memoryBoxRow) moveTo(box string) {
+	row.box = box
+	row.trashedFrom = ""
+	row.trashedTime = 0
+}
+
+func (s *memoryStore) MarkAsRead(address string, messageID string, isRead bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, row := range s.findMessageRows(address, messageID) {
+		row.isRead = isRead
+	}
+	return nil
+}
+
+func (s *memoryStore) TrashEmail(address string, messageID string, trashedTime int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if trashRows(s.findMessageRows(address, messageID), trashedTime) == 0 {
+		return fmt.Errorf("%w: message %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+func (s *memoryStore) RestoreEmail(address string, messageID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if restoreRows(s.findMessageRows(address, messageID)) == 0 {
+		return fmt.Errorf("%w: trashed message %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateInBulk(address string, op BulkOp, messageIDs []string, now int64) ([]error, error) {
+	if err := op.check(); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	results := make([]error, len(messageIDs))
+	for i, messageID := range messageIDs {
+		results[i] = s.updateOne(address, op, messageID, now)
+	}
+	return results, nil
+}
+
+func (s *memoryStore) updateOne(address string, op BulkOp, messageID string, now int64) error {
+	if op.Action == "label" {
+		return s.labelThread(address, messageID, op.AddLabels, op.RemoveLabels)
+	}
+	rows := s.findThreadRows(address, messageID)
+	what := "thread of " + messageID + " for " + address
+	if op.MessageOnly {
+		rows = s.findMessageRows(address, messageID)
+		what = "message " + messageID + " for " + address
+	}
+	count := len(rows)
+	switch op.Action {
+	case "move":
+		if op.Box == "trash" {
+			count = trashRows(rows, now)
+		} else {
+			count = moveRows(rows, op.Box)
+		}
+	case "restore":
+		count = restoreRows(rows)
+		what = "trashed " + what
+	case "read", "unread":
+		for _, row := range rows {
+			row.isRead = op.Action == "read"
+		}
+	case "delete":
+		s.deleteRows(rows)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, what)
+	}
+	return nil
+}
+
+func (s *memoryStore) MarkBoxAsRead(address string, box string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := int64(0)
+	for _, row := range s.findBoxRows(inBox(address, box)) {
+		if !row.isRead {
+			row.isRead = true
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Finds the user's box rows of one message
+func (s *memoryStore) findMessageRows(address string, messageID string) []*memoryBoxRow {
+	return s.findBoxRows(func(row *memoryBoxRow) bool {
+		return row.address == address && row.messageID == messageID
+	})
+}
+
+//
+// EMAIL (THREADS)
+//
+
+func (s *memoryStore) MoveThread(address string, messageID string, newBox string) error {
+	if err := checkMovableBox(newBox); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if moveRows(s.findThreadRows(address, messageID), newBox) == 0 {
+		return fmt.Errorf("%w: thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+func (s *memoryStore) ThreadMarkAsRead(address string, messageID string, isRead bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, row := range s.findThreadRows(address, messageID) {
+		row.isRead = isRead
+	}
+	return nil
+}
+
+func (s *memoryStore) GetUsersWithUnreadMail(minAgeMins int, maxAgeMins int) ([]string, error) {
+	currentUnixTime := time.Now().UTC().Unix()
+	minUnixTime := currentUnixTime - int64(maxAgeMins)*60
+	maxUnixTime := currentUnixTime - int64(minAgeMins)*60
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	unread := map[string]bool{}
+	for _, row := range s.boxes {
+		if row.box == "inbox" && !row.isRead &&
+			row.unixTime > minUnixTime && row.unixTime < maxUnixTime {
+			unread[row.address] = true
+		}
+	}
+	seen := map[string]bool{}
+	emails := make([]string, 0)
+	for _, user := range s.users {
+		if unread[user.EmailAddress] && !seen[user.SecondaryEmail] {
+			seen[user.SecondaryEmail] = true
+			emails = append(emails, user.SecondaryEmail)
+		}
+	}
+	return emails, nil
+}
+
+func (s *memoryStore) DeleteThreadFromBoxes(address string, messageID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.deleteRows(s.findThreadRows(address, messageID)) == 0 {
+		return fmt.Errorf("%w: thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+// Deletes the rows, then their emails if no one else has them.
+// Returns how many rows it deleted.
+func (s *memoryStore) deleteRows(rows []*memoryBoxRow) int {
+	deleted := map[*memoryBoxRow]bool{}
+	for _, row := range rows {
+		deleted[row] = true
+	}
+	count := s.deleteBoxRows(func(row *memoryBoxRow) bool {
+		return deleted[row]
+	})
+	for _, row := range rows {
+		s.deleteEmailIfUnreferenced(row.messageID)
+		s.deleteSearchTokens(row.address, row.messageID)
+	}
+	return count
+}
+
+func (s *memoryStore) TrashThread(address string, messageID string, trashedTime int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if trashRows(s.findThreadRows(address, messageID), trashedTime) == 0 {
+		return fmt.Errorf("%w: thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+func (s *memoryStore) RestoreThread(address string, messageID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if restoreRows(s.findThreadRows(address, messageID)) == 0 {
+		return fmt.Errorf("%w: trashed thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	return nil
+}
+
+// Moves the rows that are in the inbox, archive or sent to the trash.
+// Returns how many it moved.
+func trashRows(rows []*memoryBoxRow, trashedTime int64) int {
+	count := 0
+	for _, row := range rows {
+		if isTrashableBox(row.box) {
+			row.trashedFrom = row.box
+			row.trashedTime = trashedTime
+			row.box = "trash"
+			count++
+		}
+	}
+	return count
+}
+
+// Moves the rows that are in the trash back where they came from.
+// Returns how many it moved.
+func restoreRows(rows []*memoryBoxRow) int {
+	count := 0
+	for _, row := range rows {
+		if row.box == "trash" {
+			from := row.trashedFrom
+			if from == "" {
+				from = "inbox"
+			}
+			row.moveTo(from)
+			count++
+		}
+	}
+	return count
+}
+
+func (s *memoryStore) EmptyTrash(address string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var messageIDs []string
+	count := s.deleteBoxRows(func(row *memoryBoxRow) bool {
+		if row.address == address && row.box == "trash" {
+			messageIDs = append(messageIDs, row.messageID)
+			return true
+		}
+		return false
+	})
+	for _, messageID := range messageIDs {
+		s.deleteEmailIfUnreferenced(messageID)
+		s.deleteSearchTokens(address, messageID)
+	}
+	return int64(count), nil
+}
+
+// Finds the user's box rows in the same thread as messageID,
+// up to and including messageID itself
+func (s *memoryStore) findThreadRows(address string, messageID string) []*memoryBoxRow {
+	email := s.emails[messageID]
+	if email == nil {
+		return nil
+	}
+	return s.findBoxRows(func(row *memoryBoxRow) bool {
+		return row.address == address &&
+			row.threadID == email.ThreadID &&
+			row.unixTime <= email.UnixTime
+	})
+}
+
+func (s *memoryStore) findBoxRows(match func(*memoryBoxRow) bool) []*memoryBoxRow {
+	rows := []*memoryBoxRow{}
+	for _, row := range s.boxes {
+		if match(row) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func (s *memoryStore) deleteBoxRows(match func(*memoryBoxRow) bool) int {
+	kept := s.boxes[:0]
+	count := 0
+	for _, row := range s.boxes {
+		if match(row) {
+			count++
+		} else {
+			kept = append(kept, row)
+		}
+	}
+	s.boxes = kept
+	return count
+}
+
+// Same as the SQL store, where the box foreign key
+// stops the email row from being deleted while it's in use
+func (s *memoryStore) deleteEmailIfUnreferenced(messageID string) {
+	for _, row := range s.boxes {
+		if row.messageID == messageID {
+			return
+		}
+	}
+	delete(s.emails, messageID)
+}
+
+//
+// LABELS
+//
+
+func (s *memoryStore) CreateLabel(address string, cipherName string) (*Label, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextLabelID++
+	label := &memoryLabel{Label{s.nextLabelID, cipherName, time.Now().Unix()}, address}
+	s.labels[label.ID] = label
+	copied := label.Label
+	return &copied, nil
+}
+
+func (s *memoryStore) LoadLabels(address string) ([]Label, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	labels := []Label{}
+	for _, label := range s.labels {
+		if label.address == address {
+			labels = append(labels, label.Label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].ID < labels[j].ID
+	})
+	return labels, nil
+}
+
+func (s *memoryStore) RenameLabel(address string, id int64, cipherName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	label := s.labels[id]
+	if label == nil || label.address != address {
+		return fmt.Errorf("%w: label %d for %s", ErrNotFound, id, address)
+	}
+	label.CipherName = cipherName
+	return nil
+}
+
+func (s *memoryStore) DeleteLabel(address string, id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	label := s.labels[id]
+	if label == nil || label.address != address {
+		return fmt.Errorf("%w: label %d for %s", ErrNotFound, id, address)
+	}
+	delete(s.labels, id)
+	for _, row := range s.boxes {
+		delete(row.labels, id)
+	}
+	return nil
+}
+
+func (s *memoryStore) LabelThread(address string, messageID string, add, remove []int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.labelThread(address, messageID, add, remove)
+}
+
+func (s *memoryStore) labelThread(address string, messageID string, add, remove []int64) error {
+	for _, id := range append(append([]int64{}, add...), remove...) {
+		if label := s.labels[id]; label == nil || label.address != address {
+			return fmt.Errorf("%w: label %d for %s", ErrNotFound, id, address)
+		}
+	}
+	rows := s.findThreadRows(address, messageID)
+	if len(rows) == 0 {
+		return fmt.Errorf("%w: thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	for _, row := range rows {
+		if row.labels == nil {
+			row.labels = map[int64]bool{}
+		}
+		for _, id := range add {
+			row.labels[id] = true
+		}
+		for _, id := range remove {
+			delete(row.labels, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) LoadLabelByThread(address string, labelID int64, offset, limit int) ([]EmailHeader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadThreads(withLabel(address, labelID), offset, limit), nil
+}
+
+func (s *memoryStore) LoadLabelByThreadAfter(address string, labelID int64, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	headers, next := s.loadThreadsAfter(withLabel(address, labelID), after, limit)
+	return headers, next, nil
+}
+
+func (s *memoryStore) CountLabel(address string, labelID int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.findThreads(withLabel(address, labelID))), nil
+}
+
+// Matches a user's box rows with a given label, except in the trash
+func withLabel(address string, labelID int64) func(*memoryBoxRow) bool {
+	return func(row *memoryBoxRow) bool {
+		return row.address == address && row.box != "trash" && row.labels[labelID]
+	}
+}
+
+//
+// FLAGS
+//
+
+func (s *memoryStore) FlagThread(address string, messageID string, set, clear Flags) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := s.findThreadRows(address, messageID)
+	if len(rows) == 0 {
+		return fmt.Errorf("%w: thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	setFlags(rows, set, clear)
+	return nil
+}
+
+func (s *memoryStore) FlagMessage(address string, messageID string, set, clear Flags) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := s.findMessageRows(address, messageID)
+	if len(rows) == 0 {
+		return fmt.Errorf("%w: %s for %s", ErrNotFound, messageID, address)
+	}
+	setFlags(rows, set, clear)
+	return nil
+}
+
+func setFlags(rows []*memoryBoxRow, set, clear Flags) {
+	for _, row := range rows {
+		row.flags = (row.flags | set) &^ clear
+	}
+}
+
+func (s *memoryStore) LoadFlaggedByThread(address string, box string, flags Flags, offset, limit int) ([]EmailHeader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadThreads(flaggedInBox(address, box, flags), offset, limit), nil
+}
+
+func (s *memoryStore) LoadFlaggedByThreadAfter(address string, box string, flags Flags, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	headers, next := s.loadThreadsAfter(flaggedInBox(address, box, flags), after, limit)
+	return headers, next, nil
+}
+
+func (s *memoryStore) CountFlagged(address string, box string, flags Flags) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.findThreads(flaggedInBox(address, box, flags))), nil
+}
+
+// Matches a user's box rows in a box with any of some flags
+func flaggedInBox(address string, box string, flags Flags) func(*memoryBoxRow) bool {
+	return func(row *memoryBoxRow) bool {
+		return row.address == address && row.box == box && row.flags&flags != 0
+	}
+}
+
+//
+// DRAFTS
+//
+
+// Keys a user's drafts and search tokens
+func messageKey(address string, messageID string) string {
+	return address + " " + messageID
+}
+
+func (s *memoryStore) CreateDraft(address string, draft *Draft) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := messageKey(address, draft.MessageID)
+	if s.drafts[key] != nil || s.emails[draft.MessageID] != nil {
+		return fmt.Errorf("%w: draft %s for %s", ErrDuplicate, draft.MessageID, address)
+	}
+	draft.Version = 1
+	s.drafts[key] = &memoryDraft{*draft, address}
+	return nil
+}
+
+func (s *memoryStore) UpdateDraft(address string, draft *Draft) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	saved := s.drafts[messageKey(address, draft.MessageID)]
+	if saved == nil {
+		return fmt.Errorf("%w: draft %s for %s", ErrNotFound, draft.MessageID, address)
+	}
+	if saved.Version != draft.Version {
+		return fmt.Errorf("%w: draft %s is at version %d, not %d",
+			ErrConflict, draft.MessageID, saved.Version, draft.Version)
+	}
+	draft.Version++
+	saved.Draft = *draft
+	return nil
+}
+
+func (s *memoryStore) LoadDraft(address string, messageID string) (*Draft, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	saved := s.drafts[messageKey(address, messageID)]
+	if saved == nil {
+		return nil, ErrNotFound
+	}
+	copied := saved.Draft
+	return &copied, nil
+}
+
+func (s *memoryStore) LoadDrafts(address string, offset, limit int) ([]EmailHeader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	drafts := s.findDrafts(address)
+	sort.Slice(drafts, func(i, j int) bool {
+		if drafts[i].UnixTime != drafts[j].UnixTime {
+			return drafts[i].UnixTime > drafts[j].UnixTime
+		}
+		return drafts[i].MessageID > drafts[j].MessageID
+	})
+	headers := make([]EmailHeader, 0)
+	for _, i := range pageIndexes(len(drafts), offset, limit) {
+		headers = append(headers, drafts[i].header(address))
+	}
+	return headers, nil
+}
+
+func (s *memoryStore) CountDrafts(address string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.findDrafts(address)), nil
+}
+
+func (s *memoryStore) findDrafts(address string) []*memoryDraft {
+	drafts := []*memoryDraft{}
+	for _, draft := range s.drafts {
+		if draft.address == address {
+			drafts = append(drafts, draft)
+		}
+	}
+	return drafts
+}
+
+func (s *memoryStore) DeleteDraft(address string, messageID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := messageKey(address, messageID)
+	if s.drafts[key] == nil {
+		return fmt.Errorf("%w: draft %s for %s", ErrNotFound, messageID, address)
+	}
+	delete(s.drafts, key)
+	return nil
+}
+
+//
+// SEARCH
+//
+
+func (s *memoryStore) SaveSearchTokens(address string, messageID string, tokens []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.findMessageRows(address, messageID)) == 0 {
+		return fmt.Errorf("%w: message %s for %s", ErrNotFound, messageID, address)
+	}
+	saved := &memorySearchTokens{address, messageID, map[string]bool{}}
+	for _, token := range tokens {
+		saved.tokens[token] = true
+	}
+	s.searchTokens[messageKey(address, messageID)] = saved
+	return nil
+}
+
+func (s *memoryStore) SearchByThread(address string, tokens []string, offset, limit int) ([]EmailHeader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadThreads(s.withTokens(address, tokens), offset, limit), nil
+}
+
+func (s *memoryStore) SearchByThreadAfter(address string, tokens []string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	headers, next := s.loadThreadsAfter(s.withTokens(address, tokens), after, limit)
+	return headers, next, nil
+}
+
+func (s *memoryStore) CountSearch(address string, tokens []string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.findThreads(s.withTokens(address, tokens))), nil
+}
+
+// Matches a user's box rows, except in the trash, of the messages
+// that have every one of the tokens
+func (s *memoryStore) withTokens(address string, tokens []string) func(*memoryBoxRow) bool {
+	return func(row *memoryBoxRow) bool {
+		if row.address != address || row.box == "trash" {
+			return false
+		}
+		saved := s.searchTokens[messageKey(address, row.messageID)]
+		for _, token := range tokens {
+			if saved == nil || !saved.tokens[token] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Deletes a user's search tokens for a message,
+// once the message is in none of their boxes
+func (s *memoryStore) deleteSearchTokens(address string, messageID string) {
+	if len(s.findMessageRows(address, messageID)) == 0 {
+		delete(s.searchTokens, messageKey(address, messageID))
+	}
+}
+
+//
+// NOTARY
+//
+
+func (s *memoryStore) AddNameResolution(name, host, hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := name + "@" + host
+	if s.nameResolutions[key] != nil {
+		return fmt.Errorf("%w: name resolution for %s", ErrDuplicate, key)
+	}
+	s.nameResolutions[key] = &memoryNameResolution{hash, time.Now().Unix()}
+	return nil
+}
+
+func (s *memoryStore) SetNameResolution(name, host, hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nameResolutions[name+"@"+host] = &memoryNameResolution{hash, time.Now().Unix()}
+	return nil
+}
+
+func (s *memoryStore) DeleteNameResolution(name, host string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.nameResolutions, name+"@"+host)
+	return nil
+}
+
+func (s *memoryStore) GetNameResolution(name, host string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resolution := s.nameResolutions[name+"@"+host]
+	if resolution == nil {
+		return "", ErrNotFound
+	}
+	return resolution.hash, nil
+}
+
+func (s *memoryStore) SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) (*MxHostInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := &MxHostInfo{host, isScramble, notaryPublicKey, time.Now().Unix()}
+	saved := *info
+	s.mxHosts[host] = &saved
+	return info, nil
+}
+
+func (s *memoryStore) GetMxHostInfo(host string) (*MxHostInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := s.mxHosts[host]
+	if info == nil {
+		return nil, ErrNotFound
+	}
+	copied := *info
+	return &copied, nil
+}
+
+//
+// RETENTION
+//
+
+func (s *memoryStore) SetSentRetentionDays(token string, days int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if user := s.users[token]; user != nil {
+		user.SentRetentionDays = days
+	}
+	return nil
+}
+
+func (s *memoryStore) LoadSentRetentionDays() (map[string]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	daysByAddress := map[string]int{}
+	for _, user := range s.users {
+		if user.SentRetentionDays > 0 {
+			daysByAddress[user.EmailAddress] = user.SentRetentionDays
+		}
+	}
+	return daysByAddress, nil
+}
+
+func (s *memoryStore) PurgeBox(purge BoxPurge, dryRun bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	match := func(row *memoryBoxRow) bool {
+		return row.box == purge.Box && row.unixTime < purge.Before &&
+			(len(purge.Addresses) == 0 || containsString(purge.Addresses, row.address)) &&
+			!containsString(purge.Except, row.address)
+	}
+	if dryRun {
+		return int64(len(s.findBoxRows(match))), nil
+	}
+	return int64(s.deleteBoxRows(match)), nil
+}
+
+func (s *memoryStore) PurgeTrash(before int64, dryRun bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	match := func(row *memoryBoxRow) bool {
+		return row.box == "trash" && row.trashedTime < before
+	}
+	if dryRun {
+		return int64(len(s.findBoxRows(match))), nil
+	}
+	return int64(s.deleteBoxRows(match)), nil
+}
+
+func (s *memoryStore) PurgeOrphanEmails(before int64, dryRun bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	referenced := map[string]bool{}
+	for _, row := range s.boxes {
+		referenced[row.messageID] = true
+	}
+	count := int64(0)
+	for id, email := range s.emails {
+		if email.UnixTime < before && !referenced[id] {
+			count++
+			if !dryRun {
+				delete(s.emails, id)
+			}
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) PurgeOrphanSearchTokens(dryRun bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := int64(0)
+	for key, saved := range s.searchTokens {
+		if len(s.findMessageRows(saved.address, saved.messageID)) == 0 {
+			count += int64(len(saved.tokens))
+			if !dryRun {
+				delete(s.searchTokens, key)
+			}
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) PurgeMxHosts(before int64, dryRun bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := int64(0)
+	for host, info := range s.mxHosts {
+		if info.UnixTime < before {
+			count++
+			if !dryRun {
+				delete(s.mxHosts, host)
+			}
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) PurgeSessions(before int64, dryRun bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := int64(0)
+	for id, session := range s.sessions {
+		if session.ExpiresTime < before {
+			count++
+			if !dryRun {
+				delete(s.sessions, id)
+			}
+		}
+	}
+	return count, nil
+}
+
+// Bodies are kept with the emails here, the blob store
+// is only consulted by the SQL stores
+func (s *memoryStore) IsBlobReferenced(ref string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, email := range s.emails {
+		if blobRef([]byte(email.CipherBody)) == ref {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func containsString(slice []string, elem string) bool {
+	for _, x := range slice {
+		if x == elem {
+			return true
+		}
+	}
+	return false
+}
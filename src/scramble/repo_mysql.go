@@ -0,0 +1,118 @@
+package scramble
+
+import "database/sql"
+import "github.com/go-sql-driver/mysql"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Connects to MySQL. See openStore for migrations.
+//
+// clientFoundRows makes an UPDATE report the rows it matched, like SQLite
+// and Postgres do, rather than only the ones it changed. Otherwise
+// expectRows would take an update to the current values for ErrNotFound.
+func newMySQLStore(conf *Config) *sqlStore {
+	mysqlHost := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?charset=utf8&clientFoundRows=true",
+		conf.DbUser,
+		conf.DbPassword,
+		conf.DbServer,
+		conf.DbCatalog)
+
+	// connect to the database, ping periodically to maintain the connection
+	log.Printf("Connecting to %s\n", mysqlHost)
+	db, err := sql.Open("mysql", mysqlHost)
+	if err != nil {
+		panic(err)
+	}
+	go ping(db)
+
+	return &sqlStore{db, mysqlDialect{}}
+}
+
+func ping(db *sql.DB) {
+	defer Recover()
+	ticker := time.Tick(time.Minute)
+	for {
+		<-ticker
+		err := db.Ping()
+		if err != nil {
+			log.Printf("DB not ok: %v\n", err)
+		} else {
+			log.Printf("DB ok\n")
+		}
+	}
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) upsert(key string, cols ...string) string {
+	sets := []string{}
+	for _, col := range cols {
+		sets = append(sets, col+" = VALUES("+col+")")
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+func (mysqlDialect) concat(exprs ...string) string {
+	return "CONCAT(" + strings.Join(exprs, ",") + ")"
+}
+
+func (mysqlDialect) mapError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return err
+	}
+	switch mysqlErr.Number {
+	case 1062, 1586: // ER_DUP_ENTRY, ER_DUP_ENTRY_WITH_KEY_NAME
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	case 1048, 1216, 1217, 1451, 1452, 3819: // not null, foreign key and check constraints
+		return fmt.Errorf("%w: %v", ErrConstraint, err)
+	case 1265: // data truncated, in strict mode that includes a value that's not in an ENUM
+		return fmt.Errorf("%w: %v", ErrConstraint, err)
+	}
+	return err
+}
+
+func (mysqlDialect) retryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT
+	return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+}
+
+func (mysqlDialect) resetSerial(table, column string) string {
+	return ""
+}
+
+func (mysqlDialect) returning(column string) string {
+	return ""
+}
+
+// A named lock, released when the connection closes if we crash.
+// Waits up to 10 minutes for another process to finish migrating.
+func (mysqlDialect) lockMigrations(conn *sql.Conn) (func(), error) {
+	var locked sql.NullInt64
+	err := conn.QueryRowContext(context.Background(),
+		"SELECT GET_LOCK('scramble_migrations', 600)").Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("timed out waiting for the migration lock")
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('scramble_migrations')")
+	}, nil
+}
@@ -0,0 +1,127 @@
+package scramble
+
+import "database/sql"
+import "github.com/lib/pq"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Connects to Postgres. See openStore for migrations.
+func newPostgresStore(dataSource string) *sqlStore {
+	log.Printf("Connecting to Postgres\n")
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		panic(err)
+	}
+	go ping(db)
+
+	return &sqlStore{db, postgresDialect{}}
+}
+
+// Builds a connection URL from the Db* config options.
+// DbServer may include a port, eg "db.example.com:5433"
+func postgresDataSource(conf *Config) string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(conf.DbUser, conf.DbPassword),
+		Host:     conf.DbServer,
+		Path:     "/" + conf.DbCatalog,
+		RawQuery: "sslmode=disable",
+	}
+	return u.String()
+}
+
+type postgresDialect struct{}
+
+// Postgres numbers its placeholders, $1, $2, ...
+// and quotes identifiers with "double quotes" instead of `backticks`
+func (postgresDialect) rebind(query string) string {
+	var buf strings.Builder
+	inString := false
+	n := 0
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+			buf.WriteRune(c)
+		case c == '?' && !inString:
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+		case c == '`' && !inString:
+			buf.WriteRune('"')
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+func (postgresDialect) upsert(key string, cols ...string) string {
+	sets := []string{}
+	for _, col := range cols {
+		sets = append(sets, col+" = excluded."+col)
+	}
+	return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+func (postgresDialect) concat(exprs ...string) string {
+	return "(" + strings.Join(exprs, " || ") + ")"
+}
+
+func (postgresDialect) mapError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	if pqErr.Code == "23505" { // unique_violation
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+	if pqErr.Code.Class() == "23" { // integrity_constraint_violation
+		return fmt.Errorf("%w: %v", ErrConstraint, err)
+	}
+	return err
+}
+
+func (postgresDialect) retryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	// serialization_failure, deadlock_detected
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
+
+// BIGSERIAL sequences don't notice ids that were inserted explicitly
+func (postgresDialect) resetSerial(table, column string) string {
+	return fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), "+
+		"(SELECT COALESCE(MAX(%s), 1) FROM %s))", table, column, column, table)
+}
+
+// lib/pq doesn't support LastInsertId
+func (postgresDialect) returning(column string) string {
+	return " RETURNING " + column
+}
+
+// Any number will do, as long as nothing else on the database uses it
+const postgresMigrationLockKey = 7263340951
+
+// A session-level advisory lock, released when the connection closes
+// if we crash. Waits for another process to finish migrating.
+func (postgresDialect) lockMigrations(conn *sql.Conn) (func(), error) {
+	_, err := conn.ExecContext(context.Background(),
+		"SELECT pg_advisory_lock($1)", postgresMigrationLockKey)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(),
+			"SELECT pg_advisory_unlock($1)", postgresMigrationLockKey)
+	}, nil
+}
@@ -0,0 +1,1775 @@
+package scramble
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// sqlStore is the Store backed by a *sql.DB.
+// The queries below are plain SQL that MySQL, SQLite and Postgres all accept,
+// with ? placeholders and `backtick` quoted identifiers.
+// Anything that can't be written that way goes through the dialect.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// sqlDialect covers the SQL that differs between databases.
+type sqlDialect interface {
+	// Rewrites placeholders and quoting for this database
+	rebind(query string) string
+	// Returns the clause that turns an INSERT into an update of cols
+	// when a row with the same key already exists
+	upsert(key string, cols ...string) string
+	// Concatenates string expressions
+	concat(exprs ...string) string
+	// Maps a driver error onto ErrDuplicate or ErrConstraint,
+	// other errors are returned as they are
+	mapError(err error) error
+	// Whether the database aborted a transaction because of a
+	// concurrent one, e.g. a deadlock, so that running it again may work
+	retryable(err error) bool
+	// Returns the statement that moves an auto-increment column's sequence
+	// past rows inserted with explicit ids, or "" if that happens by itself
+	resetSerial(table, column string) string
+	// Returns the clause that makes an INSERT return the auto-increment
+	// column's new value, or "" if the driver reports it as LastInsertId
+	returning(column string) string
+	// Keeps other processes from migrating the database until unlock
+	// is called. Held by conn, so migrations have to run on it too.
+	lockMigrations(conn *sql.Conn) (unlock func(), err error)
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := s.db.Exec(s.dialect.rebind(query), args...)
+	return res, s.mapError(err)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	return rows, s.mapError(err)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) sqlRow {
+	return sqlRow{s.db.QueryRow(s.dialect.rebind(query), args...), s}
+}
+
+// sqlRow is a *sql.Row whose Scan returns ErrNotFound instead of sql.ErrNoRows
+type sqlRow struct {
+	row   *sql.Row
+	store *sqlStore
+}
+
+func (r sqlRow) Scan(dest ...interface{}) error {
+	return r.store.mapError(r.row.Scan(dest...))
+}
+
+// How many times inTx runs a transaction that keeps being aborted
+const sqlTxAttempts = 3
+
+// Runs fn in a transaction, and commits if fn returns nil.
+// If the database aborts the transaction because of a concurrent one,
+// nothing fn did was saved, so it runs again, up to sqlTxAttempts times.
+func (s *sqlStore) inTx(fn func(tx sqlTx) error) error {
+	var err error
+	for attempt := 1; attempt <= sqlTxAttempts; attempt++ {
+		err = s.tryTx(fn)
+		if err == nil || !s.dialect.retryable(err) {
+			return err
+		}
+		log.Printf("Transaction aborted, attempt %d of %d: %v\n", attempt, sqlTxAttempts, err)
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+	return err
+}
+
+func (s *sqlStore) tryTx(fn func(tx sqlTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return s.mapError(err)
+	}
+	err = fn(sqlTx{tx, s})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return s.mapError(tx.Commit())
+}
+
+// sqlTx is a *sql.Tx that rebinds queries and maps errors like the store
+type sqlTx struct {
+	tx    *sql.Tx
+	store *sqlStore
+}
+
+func (t sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := t.tx.Exec(t.store.dialect.rebind(query), args...)
+	return res, t.store.mapError(err)
+}
+
+func (t sqlTx) query(query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := t.tx.Query(t.store.dialect.rebind(query), args...)
+	return rows, t.store.mapError(err)
+}
+
+func (t sqlTx) queryRow(query string, args ...interface{}) sqlRow {
+	return sqlRow{t.tx.QueryRow(t.store.dialect.rebind(query), args...), t.store}
+}
+
+func (t sqlTx) mapError(err error) error {
+	return t.store.mapError(err)
+}
+
+// Runs statements, either a *sqlStore or an sqlTx
+type sqlExecer interface {
+	exec(query string, args ...interface{}) (sql.Result, error)
+	query(query string, args ...interface{}) (*sql.Rows, error)
+	queryRow(query string, args ...interface{}) sqlRow
+	mapError(err error) error
+}
+
+func (s *sqlStore) mapError(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err == nil {
+		return nil
+	}
+	return s.dialect.mapError(err)
+}
+
+//
+// USERS
+//
+
+func (s *sqlStore) SaveUser(user *User) error {
+	_, err := s.exec("INSERT INTO `user`"+
+		" (token, password_hash, public_hash, public_key, "+
+		"  cipher_private_key, email_host, secondary_email) "+
+		" values (?, ?, ?, ?, ?, ?, ?)",
+		user.Token, user.PasswordHash, user.PublicHash, user.PublicKey,
+		user.CipherPrivateKey, user.EmailHost, user.SecondaryEmail)
+	return err
+}
+
+func (s *sqlStore) DeleteUser(token string) error {
+	res, err := s.exec("delete from `user` where token=?", token)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, "user "+token)
+}
+
+func (s *sqlStore) LoadUser(token string) (*User, error) {
+	var user User
+	user.Token = token
+	err := s.queryRow("select"+
+		" password_hash, password_hash_old, public_hash, "+
+		" public_key, cipher_private_key, email_host, secondary_email, "+
+		" sent_retention_days, quota_bytes "+
+		" from `user` where token=?", token).Scan(
+		&user.PasswordHash,
+		&user.PasswordHashOld,
+		&user.PublicHash,
+		&user.PublicKey,
+		&user.CipherPrivateKey,
+		&user.EmailHost,
+		&user.SecondaryEmail,
+		&user.SentRetentionDays,
+		&user.QuotaBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	user.EmailAddress = user.Token + "@" + user.EmailHost
+	return &user, nil
+}
+
+func (s *sqlStore) LoadUserID(token string) (*UserID, error) {
+	var user UserID
+	user.Token = token
+	err := s.queryRow("select "+
+		" password_hash, password_hash_old, public_hash, email_host, is_banned"+
+		" from `user` where token=?", token).Scan(
+		&user.PasswordHash,
+		&user.PasswordHashOld,
+		&user.PublicHash,
+		&user.EmailHost,
+		&user.IsBanned)
+	if err != nil {
+		return nil, err
+	}
+	user.EmailAddress = user.Token + "@" + user.EmailHost
+	return &user, nil
+}
+
+func (s *sqlStore) LoadPubHash(token, emailHost string) (hash string, err error) {
+	err = s.queryRow("SELECT public_hash "+
+		" FROM `user` WHERE token=? and email_host=?",
+		token, emailHost).Scan(&hash)
+	return
+}
+
+func (s *sqlStore) LoadPubKey(publicHash string) (publicKey string, err error) {
+	err = s.queryRow("SELECT public_key "+
+		"FROM `user` WHERE public_hash=?",
+		publicHash).Scan(&publicKey)
+	return
+}
+
+func (s *sqlStore) LoadAddressFromPubHash(publicHash string) (string, error) {
+	var token, emailHost string
+	err := s.queryRow("SELECT token, email_host "+
+		"FROM `user` WHERE public_hash=?",
+		publicHash).Scan(&token, &emailHost)
+	if err != nil {
+		return "", err
+	}
+	return token + "@" + emailHost, nil
+}
+
+func (s *sqlStore) LoadContacts(token string) (cipherContacts *string, err error) {
+	err = s.queryRow("SELECT cipher_contacts "+
+		"FROM `user` WHERE token=?", token).Scan(
+		&cipherContacts)
+	return
+}
+
+func (s *sqlStore) SaveContacts(token string, cipherContacts string) error {
+	_, err := s.exec("UPDATE `user` "+
+		"SET cipher_contacts=? WHERE token=?",
+		cipherContacts, token)
+	return err
+}
+
+func (s *sqlStore) ChangePassphrase(token string, change *PassphraseChange) error {
+	set := "password_hash = ?, password_hash_old = '', cipher_private_key = ?"
+	args := []interface{}{change.PassHash, change.CipherPrivateKey}
+	if change.CipherContacts != nil {
+		set += ", cipher_contacts = ?"
+		args = append(args, *change.CipherContacts)
+	}
+	args = append(args, token, change.OldPassHash, change.OldPassHashOld)
+	return s.inTx(func(tx sqlTx) error {
+		res, err := tx.exec("UPDATE `user` SET "+set+
+			" WHERE token = ? AND ((password_hash <> '' AND password_hash = ?) "+
+			"OR (password_hash_old <> '' AND password_hash_old = ?))", args...)
+		if err != nil {
+			return err
+		}
+		if err := expectRows(res, "user "+token+" with that passphrase"); err != nil {
+			return err
+		}
+		_, err = tx.exec("DELETE FROM session WHERE token = ?", token)
+		return err
+	})
+}
+
+func (s *sqlStore) DeleteAccount(token string) error {
+	return s.inTx(func(tx sqlTx) error {
+		var emailHost string
+		err := tx.queryRow("SELECT email_host FROM `user` WHERE token = ?", token).Scan(&emailHost)
+		if err != nil {
+			return err
+		}
+		address := token + "@" + emailHost
+
+		rows, err := tx.query("SELECT DISTINCT message_id FROM box WHERE address = ?", address)
+		if err != nil {
+			return err
+		}
+		var messageIDs []string
+		for rows.Next() {
+			var messageID string
+			if err := rows.Scan(&messageID); err != nil {
+				rows.Close()
+				return tx.mapError(err)
+			}
+			messageIDs = append(messageIDs, messageID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return tx.mapError(err)
+		}
+
+		// box_label rows go with the box and label rows
+		for _, table := range []string{"box", "label", "draft", "search_token"} {
+			if _, err := tx.exec("DELETE FROM "+table+" WHERE address = ?", address); err != nil {
+				return err
+			}
+		}
+		for _, messageID := range messageIDs {
+			_, err := tx.exec("DELETE FROM email WHERE message_id = ? AND "+
+				"NOT EXISTS (SELECT 1 FROM box WHERE box.message_id = email.message_id)",
+				messageID)
+			if err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"session", "recovery_code", "two_factor", "`user`"} {
+			if _, err := tx.exec("DELETE FROM "+table+" WHERE token = ?", token); err != nil {
+				return err
+			}
+		}
+		return s.setNameResolution(tx, token, emailHost, TombstoneHash)
+	})
+}
+
+//
+// SESSIONS
+//
+
+const sqlSessionColumns = "id, hash, token, ip, user_agent, created_time, expires_time"
+
+func (s *sqlStore) CreateSession(session *Session) error {
+	query := "INSERT INTO session (hash, token, ip, user_agent, created_time, expires_time) " +
+		"VALUES (?, ?, ?, ?, ?, ?)"
+	args := []interface{}{session.Hash, session.Token, session.IP, session.UserAgent,
+		session.CreatedTime, session.ExpiresTime}
+	if returning := s.dialect.returning("id"); returning != "" {
+		return s.queryRow(query+returning, args...).Scan(&session.ID)
+	}
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	session.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *sqlStore) LoadSession(hash string) (*Session, error) {
+	var session Session
+	err := s.queryRow("SELECT "+sqlSessionColumns+" FROM session WHERE hash = ?", hash).Scan(
+		&session.ID, &session.Hash, &session.Token, &session.IP, &session.UserAgent,
+		&session.CreatedTime, &session.ExpiresTime)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *sqlStore) LoadSessions(token string, now int64) ([]Session, error) {
+	rows, err := s.query("SELECT "+sqlSessionColumns+" FROM session "+
+		"WHERE token = ? AND expires_time > ? ORDER BY created_time DESC, id DESC", token, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.Hash, &session.Token, &session.IP,
+			&session.UserAgent, &session.CreatedTime, &session.ExpiresTime)
+		if err != nil {
+			return nil, s.mapError(err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, s.mapError(rows.Err())
+}
+
+func (s *sqlStore) DeleteSession(token string, id int64) error {
+	res, err := s.exec("DELETE FROM session WHERE id = ? AND token = ?", id, token)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, fmt.Sprintf("session %d for %s", id, token))
+}
+
+func (s *sqlStore) DeleteSessions(token string) (int64, error) {
+	res, err := s.exec("DELETE FROM session WHERE token = ?", token)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+//
+// TWO-FACTOR
+//
+
+func (s *sqlStore) SaveTwoFactor(tf *TwoFactor) error {
+	return s.inTx(func(tx sqlTx) error {
+		var enabledTime int64
+		err := tx.queryRow("SELECT enabled_time FROM two_factor WHERE token = ?",
+			tf.Token).Scan(&enabledTime)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil && enabledTime != 0 {
+			return fmt.Errorf("%w: two-factor of %s is on already", ErrConflict, tf.Token)
+		}
+		if _, err := tx.exec("DELETE FROM two_factor WHERE token = ?", tf.Token); err != nil {
+			return err
+		}
+		_, err = tx.exec("INSERT INTO two_factor (token, secret, enabled_time, last_step) "+
+			"VALUES (?, ?, ?, ?)", tf.Token, tf.Secret, tf.EnabledTime, tf.LastStep)
+		return err
+	})
+}
+
+func (s *sqlStore) LoadTwoFactor(token string) (*TwoFactor, error) {
+	tf := &TwoFactor{Token: token}
+	err := s.queryRow("SELECT secret, enabled_time, last_step FROM two_factor WHERE token = ?",
+		token).Scan(&tf.Secret, &tf.EnabledTime, &tf.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+func (s *sqlStore) EnableTwoFactor(token string, step int64, now int64, recoveryHashes []string) error {
+	return s.inTx(func(tx sqlTx) error {
+		res, err := tx.exec("UPDATE two_factor SET enabled_time = ?, last_step = ? "+
+			"WHERE token = ? AND enabled_time = 0 AND last_step < ?", now, step, token, step)
+		if err != nil {
+			return err
+		}
+		if err := expectRows(res, "two-factor enrollment of "+token); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM recovery_code WHERE token = ?", token); err != nil {
+			return err
+		}
+		for _, hash := range recoveryHashes {
+			_, err := tx.exec("INSERT INTO recovery_code (token, hash) VALUES (?, ?)", token, hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) UseTwoFactorStep(token string, step int64) error {
+	res, err := s.exec("UPDATE two_factor SET last_step = ? WHERE token = ? AND last_step < ?",
+		step, token, step)
+	if err != nil {
+		return err
+	}
+	if err := expectRows(res, "two-factor of "+token); err != nil {
+		return fmt.Errorf("%w: code used already", ErrConflict)
+	}
+	return nil
+}
+
+func (s *sqlStore) UseRecoveryCode(token string, hash string) error {
+	res, err := s.exec("DELETE FROM recovery_code WHERE token = ? AND hash = ?", token, hash)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, "recovery code of "+token)
+}
+
+func (s *sqlStore) CountRecoveryCodes(token string) (count int, err error) {
+	err = s.queryRow("SELECT COUNT(*) FROM recovery_code WHERE token = ?", token).Scan(&count)
+	return
+}
+
+func (s *sqlStore) DeleteTwoFactor(token string) error {
+	return s.inTx(func(tx sqlTx) error {
+		if _, err := tx.exec("DELETE FROM recovery_code WHERE token = ?", token); err != nil {
+			return err
+		}
+		res, err := tx.exec("DELETE FROM two_factor WHERE token = ?", token)
+		if err != nil {
+			return err
+		}
+		return expectRows(res, "two-factor of "+token)
+	})
+}
+
+//
+// EMAIL HEADERS
+//
+
+func (s *sqlStore) LoadBox(address string, box string, offset, limit int) ([]EmailHeader, error) {
+	rows, err := s.query("SELECT m.message_id, m.unix_time, "+
+		" m.from_email, m.to_email, b.is_read, b.flags, m.cipher_subject, m.thread_id "+
+		" FROM email AS m INNER JOIN box AS b "+
+		" ON b.message_id = m.message_id "+
+		" WHERE b.address = ? and b.box=? "+
+		" ORDER BY b.unix_time DESC"+
+		" LIMIT ? OFFSET ? ",
+		address, box,
+		limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToHeaders(rows)
+}
+
+func (s *sqlStore) LoadBoxByThread(address string, box string, offset, limit int) ([]EmailHeader, error) {
+	return s.loadThreads("address=? AND box=?", []interface{}{address, box}, offset, limit)
+}
+
+func (s *sqlStore) LoadBoxByThreadAfter(address string, box string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return s.loadThreadsAfter("address=? AND box=?", []interface{}{address, box}, after, limit)
+}
+
+func (s *sqlStore) CountBox(address string, box string) (count int, err error) {
+	return s.countThreads("address=? AND box=?", []interface{}{address, box})
+}
+
+// One query for all three, so that polling it stays cheap.
+// A label's LEFT JOINs leave b's columns NULL when it has no mail,
+// which neither COUNT counts.
+func (s *sqlStore) LoadBoxCounts(address string) (map[string]BoxCount, error) {
+	rows, err := s.query("SELECT b.box, 0, "+sqlThreadCounts+" FROM box AS b "+
+		"WHERE b.address = ? AND b.box IN ('inbox','sent','archive','trash') "+
+		"GROUP BY b.box "+
+		"UNION ALL "+
+		"SELECT 'label', l.id, "+sqlThreadCounts+" FROM label AS l "+
+		"LEFT JOIN box_label AS bl ON bl.label_id = l.id "+
+		"LEFT JOIN box AS b ON b.id = bl.box_id AND b.box <> 'trash' "+
+		"WHERE l.address = ? GROUP BY l.id "+
+		"UNION ALL "+
+		"SELECT 'drafts', 0, COUNT(*), 0 FROM draft WHERE address = ?",
+		address, address, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := newBoxCounts()
+	for rows.Next() {
+		var box string
+		var labelID int64
+		var count BoxCount
+		if err := rows.Scan(&box, &labelID, &count.Total, &count.Unread); err != nil {
+			return nil, s.mapError(err)
+		}
+		if box == "label" {
+			box = labelBoxName(labelID)
+		}
+		counts[box] = count
+	}
+	return counts, s.mapError(rows.Err())
+}
+
+// The threads of a group of box rows b, and those with unread mail
+const sqlThreadCounts = "COUNT(DISTINCT b.thread_id), " +
+	"COUNT(DISTINCT CASE WHEN b.is_read THEN NULL ELSE b.thread_id END)"
+
+// Loads a page of the threads of the box rows matching where,
+// with the latest mail of each
+func (s *sqlStore) loadThreads(where string, args []interface{}, offset, limit int) ([]EmailHeader, error) {
+	rows, err := s.query("SELECT e.message_id, e.unix_time, "+
+		"e.from_email, e.to_email, m.is_read, m.flags, e.cipher_subject, e.thread_id "+
+		"FROM email AS e INNER JOIN ( "+
+		"    SELECT MAX(message_id) as message_id, "+
+		"       MIN(CASE WHEN is_read THEN 1 ELSE 0 END) as is_read, "+
+		"       "+sqlAnyFlags+" as flags FROM box "+
+		"       WHERE "+where+" "+
+		"       GROUP BY thread_id "+
+		"       ORDER BY MAX(unix_time) DESC, thread_id DESC "+
+		"       LIMIT ? OFFSET ? "+
+		") AS m ON e.message_id = m.message_id "+
+		"ORDER BY e.unix_time DESC ",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToHeaders(rows)
+}
+
+// Like loadThreads, but pages with a cursor
+func (s *sqlStore) loadThreadsAfter(where string, args []interface{}, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	having := ""
+	if after != nil {
+		having = "       HAVING MAX(unix_time) < ? OR (MAX(unix_time) = ? AND thread_id < ?) "
+		args = append(args, after.UnixTime, after.UnixTime, after.ThreadID)
+	}
+	args = append(args, limit)
+	rows, err := s.query("SELECT e.message_id, e.unix_time, "+
+		"e.from_email, e.to_email, m.is_read, m.flags, e.cipher_subject, e.thread_id, "+
+		"m.last_time, m.thread_id "+
+		"FROM email AS e INNER JOIN ( "+
+		"    SELECT MAX(message_id) as message_id, "+
+		"       MIN(CASE WHEN is_read THEN 1 ELSE 0 END) as is_read, "+
+		"       "+sqlAnyFlags+" as flags, "+
+		"       MAX(unix_time) as last_time, thread_id FROM box "+
+		"       WHERE "+where+" "+
+		"       GROUP BY thread_id "+
+		having+
+		"       ORDER BY MAX(unix_time) DESC, thread_id DESC "+
+		"       LIMIT ? "+
+		") AS m ON e.message_id = m.message_id "+
+		"ORDER BY m.last_time DESC, m.thread_id DESC ",
+		args...,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	headers := make([]EmailHeader, 0)
+	var last BoxCursor
+	for rows.Next() {
+		var header EmailHeader
+		err := rows.Scan(
+			&header.MessageID,
+			&header.UnixTime,
+			&header.From,
+			&header.To,
+			&header.IsRead,
+			&header.Flags,
+			&header.CipherSubject,
+			&header.ThreadID,
+			&last.UnixTime,
+			&last.ThreadID,
+		)
+		if err != nil {
+			return nil, nil, s.mapError(err)
+		}
+		headers = append(headers, header)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, s.mapError(err)
+	}
+	if len(headers) < limit {
+		return headers, nil, nil
+	}
+	return headers, &last, nil
+}
+
+// The flags of any of a group of box rows. Only MySQL and Postgres
+// have a bitwise OR aggregate, but each flag's MAX adds up to the same.
+var sqlAnyFlags = func() string {
+	var maxes []string
+	for flag := FlagStarred; flag&allFlags != 0; flag <<= 1 {
+		maxes = append(maxes, fmt.Sprintf("MAX(flags & %d)", flag))
+	}
+	return strings.Join(maxes, " + ")
+}()
+
+func (s *sqlStore) countThreads(where string, args []interface{}) (count int, err error) {
+	err = s.queryRow("SELECT count(distinct thread_id) FROM box WHERE "+where, args...).Scan(&count)
+	return
+}
+
+// Counts every email once, even if it is in several of the user's boxes,
+// plus the user's drafts
+func (s *sqlStore) LoadStorageUsed(address string) (used int64, err error) {
+	err = s.queryRow("SELECT "+
+		" (SELECT COALESCE(SUM(body_size), 0) FROM email "+
+		"  WHERE message_id IN (SELECT message_id FROM box WHERE address = ?)) + "+
+		" (SELECT COALESCE(SUM(LENGTH(cipher_body)), 0) FROM draft WHERE address = ?)",
+		address, address).Scan(&used)
+	return
+}
+
+func (s *sqlStore) rowsToHeaders(rows *sql.Rows) ([]EmailHeader, error) {
+	defer rows.Close()
+	// collect a short description of each email
+	headers := make([]EmailHeader, 0)
+	for rows.Next() {
+		var header EmailHeader
+		err := rows.Scan(
+			&header.MessageID,
+			&header.UnixTime,
+			&header.From,
+			&header.To,
+			&header.IsRead,
+			&header.Flags,
+			&header.CipherSubject,
+			&header.ThreadID,
+		)
+		if err != nil {
+			return nil, s.mapError(err)
+		}
+		headers = append(headers, header)
+	}
+	return headers, s.mapError(rows.Err())
+}
+
+//
+// EMAIL
+//
+
+func (s *sqlStore) SaveMessage(e *Email) error {
+	return insertEmail(s, e)
+}
+
+func (s *sqlStore) DeliverMessage(e *Email, boxes []MessageBox) error {
+	return s.inTx(func(tx sqlTx) error {
+		return deliverMessage(tx, e, boxes)
+	})
+}
+
+func (s *sqlStore) DeliverDraft(address string, e *Email, boxes []MessageBox) error {
+	return s.inTx(func(tx sqlTx) error {
+		if err := deliverMessage(tx, e, boxes); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM draft WHERE address = ? AND message_id = ?",
+			address, e.MessageID)
+		return err
+	})
+}
+
+func deliverMessage(tx sqlTx, e *Email, boxes []MessageBox) error {
+	if err := insertEmail(tx, e); err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if err := insertBox(tx, e, box.Address, box.Box); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The body goes to the blob store first. If the insert fails,
+// the blob is left for the janitor to collect.
+func insertEmail(db sqlExecer, e *Email) error {
+	bodyRef, err := blobs.Put([]byte(e.CipherBody))
+	if err != nil {
+		return err
+	}
+	_, err = db.exec("insert into email "+
+		"(message_id, unix_time, from_email, to_email, "+
+		" cipher_subject, body_ref, body_size, "+
+		" ancestor_ids, thread_id) "+
+		"values (?,?,?,?,?,?,?,?,?)",
+		e.MessageID,
+		e.UnixTime,
+		e.From,
+		e.To,
+		e.CipherSubject,
+		bodyRef,
+		len(e.CipherBody),
+		e.AncestorIDs,
+		e.ThreadID,
+	)
+	return err
+}
+
+// Loads an email's cipher body from the blob store
+func loadBody(email *Email, bodyRef string) error {
+	body, err := blobs.Get(bodyRef)
+	if err != nil {
+		return fmt.Errorf("body of %s: %w", email.MessageID, err)
+	}
+	email.CipherBody = string(body)
+	return nil
+}
+
+func (s *sqlStore) LoadMessage(id string) (Email, error) {
+	var email Email
+	var bodyRef string
+	err := s.queryRow("SELECT "+
+		"unix_time, from_email, to_email, "+
+		"cipher_subject, body_ref, "+
+		"ancestor_ids, thread_id "+
+		"FROM email WHERE message_id=?",
+		id).Scan(
+		&email.UnixTime,
+		&email.From,
+		&email.To,
+		&email.CipherSubject,
+		&bodyRef,
+		&email.AncestorIDs,
+		&email.ThreadID,
+	)
+	email.MessageID = id
+	if err == nil {
+		err = loadBody(&email, bodyRef)
+	}
+	return email, err
+}
+
+func (s *sqlStore) LoadThread(address, threadID string) ([]Email, error) {
+
+	rows, err := s.query("SELECT "+
+		"e.message_id, e.unix_time, e.from_email, e.to_email, "+
+		"e.cipher_subject, e.body_ref, "+
+		"e.ancestor_ids, e.thread_id, "+sqlAnyFlags+" "+
+		"FROM email AS e INNER JOIN box "+
+		"ON e.message_id = box.message_id "+
+		"WHERE box.address=? AND box.thread_id=? "+
+		"GROUP BY e.message_id "+
+		"ORDER BY e.unix_time ASC",
+		address,
+		threadID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.rowsToEmails(rows)
+}
+
+func (s *sqlStore) rowsToEmails(rows *sql.Rows) ([]Email, error) {
+	defer rows.Close()
+	emails := []Email{}
+	for rows.Next() {
+		var email Email
+		var bodyRef string
+		err := rows.Scan(
+			&email.MessageID,
+			&email.UnixTime,
+			&email.From,
+			&email.To,
+			&email.CipherSubject,
+			&bodyRef,
+			&email.AncestorIDs,
+			&email.ThreadID,
+			&email.Flags,
+		)
+		if err != nil {
+			return nil, s.mapError(err)
+		}
+		if err := loadBody(&email, bodyRef); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, s.mapError(rows.Err())
+}
+
+func (s *sqlStore) LoadThreadIDsForMessageIDs(messageIDs []interface{}) ([]string, error) {
+	messageIDsPH := "?" + strings.Repeat(",?", len(messageIDs)-1)
+	rows, err := s.query("SELECT message_id, thread_id "+
+		"FROM email WHERE message_id IN ("+messageIDsPH+")",
+		messageIDs...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lookup := map[string]string{}
+	for rows.Next() {
+		var messageID, threadID string
+		err := rows.Scan(&messageID, &threadID)
+		if err != nil {
+			return nil, s.mapError(err)
+		}
+		lookup[messageID] = threadID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.mapError(err)
+	}
+	threadIDs := []string{}
+	for _, messageID := range messageIDs {
+		threadIDs = append(threadIDs, lookup[messageID.(string)])
+	}
+	return threadIDs, nil
+}
+
+func (s *sqlStore) AddMessageToBox(e *Email, address string, box string) error {
+	return insertBox(s, e, address, box)
+}
+
+func insertBox(db sqlExecer, e *Email, address string, box string) error {
+	// mail delivered straight to the trash counts as trashed on arrival
+	trashedTime := int64(0)
+	if box == "trash" {
+		trashedTime = e.UnixTime
+	}
+	_, err := db.exec("INSERT INTO box "+
+		"(message_id, unix_time, thread_id, address, box, trashed_time) "+
+		"VALUES (?,?,?,?,?,?)",
+		e.MessageID,
+		e.UnixTime,
+		e.ThreadID,
+		address,
+		box,
+		trashedTime,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteFromBoxes(address string, id string) error {
+	return deleteWhere(s, sqlMessage, []interface{}{address, id}, "message "+id+" for "+address)
+}
+
+func (s *sqlStore) BoxesForMessage(address string, id string) ([]string, error) {
+	rows, err := s.query("select box from box "+
+		"where address=? and message_id=?",
+		address, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	boxes := []string{}
+	for rows.Next() {
+		var box string
+		err := rows.Scan(&box)
+		if err != nil {
+			return nil, s.mapError(err)
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes, s.mapError(rows.Err())
+}
+
+// Matches a user's box rows of one message.
+// Takes two args: address, messageID
+const sqlMessage = "address = ? AND message_id = ?"
+
+func (s *sqlStore) MoveEmail(address string, messageID string, newBox string) error {
+	return moveWhere(s, sqlMessage, []interface{}{address, messageID},
+		newBox, "message "+messageID+" for "+address)
+}
+
+func (s *sqlStore) MarkAsRead(address string, messageID string, isRead bool) error {
+	_, err := s.exec(
+		"UPDATE box SET is_read = ? "+
+			"WHERE "+sqlMessage,
+		isRead, address, messageID)
+	return err
+}
+
+func (s *sqlStore) TrashEmail(address string, messageID string, trashedTime int64) error {
+	return trashWhere(s, sqlMessage, []interface{}{address, messageID},
+		trashedTime, "message "+messageID+" for "+address)
+}
+
+func (s *sqlStore) RestoreEmail(address string, messageID string) error {
+	return restoreWhere(s, sqlMessage, []interface{}{address, messageID},
+		"trashed message "+messageID+" for "+address)
+}
+
+func (s *sqlStore) UpdateInBulk(address string, op BulkOp, messageIDs []string, now int64) ([]error, error) {
+	if err := op.check(); err != nil {
+		return nil, err
+	}
+	var results []error
+	err := s.inTx(func(tx sqlTx) error {
+		results = make([]error, len(messageIDs))
+		for i, messageID := range messageIDs {
+			err := updateOne(tx, address, op, messageID, now)
+			if errors.Is(err, ErrNotFound) {
+				results[i] = err
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Makes a bulk change to the thread of one message, or to the message.
+// Only returns ErrNotFound without running a statement that failed,
+// so that the transaction can go on.
+func updateOne(db sqlExecer, address string, op BulkOp, messageID string, now int64) error {
+	where := sqlThreadUpTo
+	args := []interface{}{address, messageID, messageID}
+	what := "thread of " + messageID + " for " + address
+	if op.MessageOnly {
+		where, args = sqlMessage, []interface{}{address, messageID}
+		what = "message " + messageID + " for " + address
+	}
+	switch op.Action {
+	case "move":
+		if op.Box == "trash" {
+			return trashWhere(db, where, args, now, what)
+		}
+		return moveWhere(db, where, args, op.Box, what)
+	case "restore":
+		return restoreWhere(db, where, args, "trashed "+what)
+	case "read", "unread":
+		return markReadWhere(db, where, args, op.Action == "read", what)
+	case "delete":
+		return deleteWhere(db, where, args, what)
+	case "label":
+		return labelThread(db, address, messageID, op.AddLabels, op.RemoveLabels)
+	}
+	return fmt.Errorf("%w: no bulk action %s", ErrConstraint, op.Action)
+}
+
+func (s *sqlStore) MarkBoxAsRead(address string, box string) (int64, error) {
+	res, err := s.exec("UPDATE box SET is_read = ? "+
+		"WHERE address = ? AND box = ? AND is_read = ?",
+		true, address, box, false)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+//
+// EMAIL (THREADS)
+//
+
+// Matches a user's box rows in the thread of a given message,
+// up to and including that message.
+// Takes three args: address, messageID, messageID
+const sqlThreadUpTo = "address = ? AND " +
+	"thread_id = (SELECT thread_id FROM email WHERE message_id = ?) AND " +
+	"unix_time <= (SELECT unix_time FROM email WHERE message_id = ?)"
+
+func (s *sqlStore) MoveThread(address string, messageID string, newBox string) error {
+	return moveWhere(s, sqlThreadUpTo, []interface{}{address, messageID, messageID},
+		newBox, "thread of "+messageID+" for "+address)
+}
+
+func (s *sqlStore) ThreadMarkAsRead(address string, messageID string, isRead bool) error {
+	_, err := s.exec(
+		"UPDATE box SET is_read = ? "+
+			"WHERE "+sqlThreadUpTo,
+		isRead, address, messageID, messageID)
+	return err
+}
+
+func (s *sqlStore) GetUsersWithUnreadMail(minAgeMins int, maxAgeMins int) ([]string, error) {
+	currentUnixTime := time.Now().UTC().Unix()
+	minUnixTime := currentUnixTime - int64(maxAgeMins)*60
+	maxUnixTime := currentUnixTime - int64(minAgeMins)*60
+	rows, err := s.query(
+		"SELECT DISTINCT secondary_email FROM `user` u "+
+			"INNER JOIN box b ON b.address="+s.dialect.concat("u.token", "'@'", "u.email_host")+" "+
+			"WHERE b.box='inbox' AND b.is_read=? AND b.unix_time>? AND b.unix_time<?",
+		false, minUnixTime, maxUnixTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := make([]string, 0)
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, s.mapError(err)
+		}
+		emails = append(emails, email)
+	}
+	return emails, s.mapError(rows.Err())
+}
+
+func (s *sqlStore) DeleteThreadFromBoxes(address string, messageID string) error {
+	return deleteWhere(s, sqlThreadUpTo, []interface{}{address, messageID, messageID},
+		"thread of "+messageID+" for "+address)
+}
+
+func (s *sqlStore) TrashThread(address string, messageID string, trashedTime int64) error {
+	return trashWhere(s, sqlThreadUpTo, []interface{}{address, messageID, messageID},
+		trashedTime, "thread of "+messageID+" for "+address)
+}
+
+func (s *sqlStore) RestoreThread(address string, messageID string) error {
+	return restoreWhere(s, sqlThreadUpTo, []interface{}{address, messageID, messageID},
+		"trashed thread of "+messageID+" for "+address)
+}
+
+// The statements below change the box rows matching where,
+// with what naming them in ErrNotFound
+
+func moveWhere(db sqlExecer, where string, args []interface{}, newBox string, what string) error {
+	if err := checkMovableBox(newBox); err != nil {
+		return err
+	}
+	res, err := db.exec(
+		"UPDATE box SET box = ?, trashed_from = '', trashed_time = 0 "+
+			"WHERE "+where+" AND "+
+			"box IN ('inbox', 'archive', 'trash') ",
+		append([]interface{}{newBox}, args...)...)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, what)
+}
+
+// MySQL assigns left to right, seeing the new values of earlier columns,
+// so trashed_from has to come before box. The others see old values.
+func trashWhere(db sqlExecer, where string, args []interface{}, trashedTime int64, what string) error {
+	res, err := db.exec(
+		"UPDATE box SET trashed_from = box, box = 'trash', trashed_time = ? "+
+			"WHERE "+where+" AND "+
+			"box IN ('inbox', 'archive', 'sent')",
+		append([]interface{}{trashedTime}, args...)...)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, what)
+}
+
+// Mail that was in the trash before it remembered where from goes to the inbox.
+// As in trashWhere, box has to be assigned before trashed_from.
+func restoreWhere(db sqlExecer, where string, args []interface{}, what string) error {
+	res, err := db.exec(
+		"UPDATE box SET "+
+			"box = CASE WHEN trashed_from = '' THEN 'inbox' ELSE trashed_from END, "+
+			"trashed_from = '', trashed_time = 0 "+
+			"WHERE "+where+" AND box = 'trash'",
+		args...)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, what)
+}
+
+// Rows that were already read count too, see newMySQLStore
+func markReadWhere(db sqlExecer, where string, args []interface{}, isRead bool, what string) error {
+	res, err := db.exec("UPDATE box SET is_read = ? WHERE "+where,
+		append([]interface{}{isRead}, args...)...)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, what)
+}
+
+// Deletes the box rows, then their emails if no one else has them,
+// and the search tokens of messages their users no longer have.
+// Checking for other boxes first, rather than counting on the foreign key
+// to stop the delete, keeps a transaction going in Postgres.
+func deleteWhere(db sqlExecer, where string, args []interface{}, what string) error {
+	rows, err := db.query("SELECT DISTINCT address, message_id FROM box WHERE "+where, args...)
+	if err != nil {
+		return err
+	}
+	var addresses, messageIDs []string
+	for rows.Next() {
+		var address, messageID string
+		if err := rows.Scan(&address, &messageID); err != nil {
+			rows.Close()
+			return db.mapError(err)
+		}
+		addresses = append(addresses, address)
+		messageIDs = append(messageIDs, messageID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return db.mapError(err)
+	}
+	if len(messageIDs) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, what)
+	}
+
+	if _, err := db.exec("DELETE FROM box WHERE "+where, args...); err != nil {
+		return err
+	}
+	for i, messageID := range messageIDs {
+		_, err := db.exec("DELETE FROM email WHERE message_id = ? AND "+
+			"NOT EXISTS (SELECT 1 FROM box WHERE box.message_id = email.message_id)",
+			messageID)
+		if err != nil {
+			return err
+		}
+		if err := deleteSearchTokens(db, addresses[i], messageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) EmptyTrash(address string) (int64, error) {
+	rows, err := s.query("SELECT message_id FROM box WHERE address = ? AND box = 'trash'", address)
+	if err != nil {
+		return 0, err
+	}
+	var messageIDs []string
+	for rows.Next() {
+		var messageID string
+		if err := rows.Scan(&messageID); err != nil {
+			rows.Close()
+			return 0, s.mapError(err)
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, s.mapError(err)
+	}
+
+	res, err := s.exec("DELETE FROM box WHERE address = ? AND box = 'trash'", address)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	for _, messageID := range messageIDs {
+		if err := s.deleteEmailIfUnreferenced(messageID); err != nil {
+			return count, err
+		}
+		if err := deleteSearchTokens(s, address, messageID); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Deletes an email that is no longer in anyone's box.
+// The box foreign key stops it while the email is still in use,
+// which isn't an error.
+func (s *sqlStore) deleteEmailIfUnreferenced(messageID string) error {
+	_, err := s.exec("DELETE FROM email WHERE message_id=?", messageID)
+	if errors.Is(err, ErrConstraint) {
+		return nil
+	}
+	return err
+}
+
+// Returns ErrNotFound if a statement didn't touch any rows
+func expectRows(res sql.Result, what string) error {
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, what)
+	}
+	return nil
+}
+
+//
+// LABELS
+//
+
+func (s *sqlStore) CreateLabel(address string, cipherName string) (*Label, error) {
+	label := &Label{CipherName: cipherName, UnixTime: time.Now().Unix()}
+	query := "INSERT INTO label (address, cipher_name, unix_time) VALUES (?, ?, ?)"
+	if returning := s.dialect.returning("id"); returning != "" {
+		err := s.queryRow(query+returning, address, cipherName, label.UnixTime).Scan(&label.ID)
+		if err != nil {
+			return nil, err
+		}
+		return label, nil
+	}
+	res, err := s.exec(query, address, cipherName, label.UnixTime)
+	if err != nil {
+		return nil, err
+	}
+	if label.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return label, nil
+}
+
+func (s *sqlStore) LoadLabels(address string) ([]Label, error) {
+	rows, err := s.query("SELECT id, cipher_name, unix_time FROM label "+
+		"WHERE address = ? ORDER BY id", address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	labels := []Label{}
+	for rows.Next() {
+		var label Label
+		if err := rows.Scan(&label.ID, &label.CipherName, &label.UnixTime); err != nil {
+			return nil, s.mapError(err)
+		}
+		labels = append(labels, label)
+	}
+	return labels, s.mapError(rows.Err())
+}
+
+func (s *sqlStore) RenameLabel(address string, id int64, cipherName string) error {
+	res, err := s.exec("UPDATE label SET cipher_name = ? WHERE id = ? AND address = ?",
+		cipherName, id, address)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, fmt.Sprintf("label %d for %s", id, address))
+}
+
+// box_label rows go with the label, see the foreign key
+func (s *sqlStore) DeleteLabel(address string, id int64) error {
+	res, err := s.exec("DELETE FROM label WHERE id = ? AND address = ?", id, address)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, fmt.Sprintf("label %d for %s", id, address))
+}
+
+func (s *sqlStore) LabelThread(address string, messageID string, add, remove []int64) error {
+	return s.inTx(func(tx sqlTx) error {
+		return labelThread(tx, address, messageID, add, remove)
+	})
+}
+
+func labelThread(db sqlExecer, address string, messageID string, add, remove []int64) error {
+	for _, id := range append(append([]int64{}, add...), remove...) {
+		var count int
+		err := db.queryRow("SELECT COUNT(*) FROM label WHERE id = ? AND address = ?",
+			id, address).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: label %d for %s", ErrNotFound, id, address)
+		}
+	}
+	var count int
+	err := db.queryRow("SELECT COUNT(*) FROM box WHERE "+sqlThreadUpTo,
+		address, messageID, messageID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: thread of %s for %s", ErrNotFound, messageID, address)
+	}
+	for _, id := range add {
+		_, err := db.exec("INSERT INTO box_label (box_id, label_id) "+
+			"SELECT id, ? FROM box WHERE "+sqlThreadUpTo+" AND "+
+			"id NOT IN (SELECT box_id FROM box_label WHERE label_id = ?)",
+			id, address, messageID, messageID, id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range remove {
+		_, err := db.exec("DELETE FROM box_label WHERE label_id = ? AND "+
+			"box_id IN (SELECT id FROM box WHERE "+sqlThreadUpTo+")",
+			id, address, messageID, messageID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches a user's box rows with a given label, except in the trash.
+// Takes two args: address, labelID
+const sqlWithLabel = "address=? AND box<>'trash' AND " +
+	"id IN (SELECT box_id FROM box_label WHERE label_id=?)"
+
+func (s *sqlStore) LoadLabelByThread(address string, labelID int64, offset, limit int) ([]EmailHeader, error) {
+	return s.loadThreads(sqlWithLabel, []interface{}{address, labelID}, offset, limit)
+}
+
+func (s *sqlStore) LoadLabelByThreadAfter(address string, labelID int64, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return s.loadThreadsAfter(sqlWithLabel, []interface{}{address, labelID}, after, limit)
+}
+
+func (s *sqlStore) CountLabel(address string, labelID int64) (int, error) {
+	return s.countThreads(sqlWithLabel, []interface{}{address, labelID})
+}
+
+//
+// FLAGS
+//
+
+func (s *sqlStore) FlagThread(address string, messageID string, set, clear Flags) error {
+	return s.setFlags(sqlThreadUpTo, []interface{}{address, messageID, messageID},
+		set, clear, "thread of "+messageID+" for "+address)
+}
+
+func (s *sqlStore) FlagMessage(address string, messageID string, set, clear Flags) error {
+	return s.setFlags("address = ? AND message_id = ?", []interface{}{address, messageID},
+		set, clear, messageID+" for "+address)
+}
+
+// MySQL doesn't count rows whose flags don't change as affected,
+// so setFlags looks for the rows first rather than using expectRows
+func (s *sqlStore) setFlags(where string, args []interface{}, set, clear Flags, what string) error {
+	return s.inTx(func(tx sqlTx) error {
+		var count int
+		err := tx.queryRow("SELECT COUNT(*) FROM box WHERE "+where, args...).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: %s", ErrNotFound, what)
+		}
+		_, err = tx.exec("UPDATE box SET flags = (flags | ?) & ? WHERE "+where,
+			append([]interface{}{set, allFlags &^ clear}, args...)...)
+		return err
+	})
+}
+
+// Matches a user's box rows in a box with any of some flags.
+// Takes three args: address, box, flags
+const sqlFlagged = "address=? AND box=? AND (flags & ?) <> 0"
+
+func (s *sqlStore) LoadFlaggedByThread(address string, box string, flags Flags, offset, limit int) ([]EmailHeader, error) {
+	return s.loadThreads(sqlFlagged, []interface{}{address, box, flags}, offset, limit)
+}
+
+func (s *sqlStore) LoadFlaggedByThreadAfter(address string, box string, flags Flags, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	return s.loadThreadsAfter(sqlFlagged, []interface{}{address, box, flags}, after, limit)
+}
+
+func (s *sqlStore) CountFlagged(address string, box string, flags Flags) (int, error) {
+	return s.countThreads(sqlFlagged, []interface{}{address, box, flags})
+}
+
+//
+// DRAFTS
+//
+
+// A draft can't reuse the message ID of mail that was sent,
+// which is what happens when an autosave races the send
+func (s *sqlStore) CreateDraft(address string, draft *Draft) error {
+	err := s.inTx(func(tx sqlTx) error {
+		var sent int
+		err := tx.queryRow("SELECT COUNT(*) FROM email WHERE message_id = ?",
+			draft.MessageID).Scan(&sent)
+		if err != nil {
+			return err
+		}
+		if sent > 0 {
+			return fmt.Errorf("%w: message %s was already sent", ErrDuplicate, draft.MessageID)
+		}
+		_, err = tx.exec("INSERT INTO draft (address, message_id, thread_id, ancestor_ids, "+
+			"to_email, cipher_subject, cipher_body, unix_time, version) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)",
+			address, draft.MessageID, draft.ThreadID, draft.AncestorIDs,
+			draft.To, draft.CipherSubject, draft.CipherBody, draft.UnixTime)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	draft.Version = 1
+	return nil
+}
+
+func (s *sqlStore) UpdateDraft(address string, draft *Draft) error {
+	res, err := s.exec("UPDATE draft SET thread_id = ?, ancestor_ids = ?, to_email = ?, "+
+		"cipher_subject = ?, cipher_body = ?, unix_time = ?, version = version + 1 "+
+		"WHERE address = ? AND message_id = ? AND version = ?",
+		draft.ThreadID, draft.AncestorIDs, draft.To,
+		draft.CipherSubject, draft.CipherBody, draft.UnixTime,
+		address, draft.MessageID, draft.Version)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		// either it's gone, or someone else saved it first
+		var version int64
+		err := s.queryRow("SELECT version FROM draft WHERE address = ? AND message_id = ?",
+			address, draft.MessageID).Scan(&version)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: draft %s is at version %d, not %d",
+			ErrConflict, draft.MessageID, version, draft.Version)
+	}
+	draft.Version++
+	return nil
+}
+
+func (s *sqlStore) LoadDraft(address string, messageID string) (*Draft, error) {
+	draft := &Draft{MessageID: messageID}
+	err := s.queryRow("SELECT thread_id, ancestor_ids, to_email, cipher_subject, "+
+		"cipher_body, unix_time, version FROM draft "+
+		"WHERE address = ? AND message_id = ?",
+		address, messageID).Scan(
+		&draft.ThreadID,
+		&draft.AncestorIDs,
+		&draft.To,
+		&draft.CipherSubject,
+		&draft.CipherBody,
+		&draft.UnixTime,
+		&draft.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+func (s *sqlStore) LoadDrafts(address string, offset, limit int) ([]EmailHeader, error) {
+	rows, err := s.query("SELECT message_id, thread_id, to_email, cipher_subject, unix_time "+
+		"FROM draft WHERE address = ? "+
+		"ORDER BY unix_time DESC, message_id DESC "+
+		"LIMIT ? OFFSET ?",
+		address, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	headers := make([]EmailHeader, 0)
+	for rows.Next() {
+		var draft Draft
+		err := rows.Scan(
+			&draft.MessageID,
+			&draft.ThreadID,
+			&draft.To,
+			&draft.CipherSubject,
+			&draft.UnixTime,
+		)
+		if err != nil {
+			return nil, s.mapError(err)
+		}
+		headers = append(headers, draft.header(address))
+	}
+	return headers, s.mapError(rows.Err())
+}
+
+func (s *sqlStore) CountDrafts(address string) (count int, err error) {
+	err = s.queryRow("SELECT COUNT(*) FROM draft WHERE address = ?", address).Scan(&count)
+	return
+}
+
+func (s *sqlStore) DeleteDraft(address string, messageID string) error {
+	res, err := s.exec("DELETE FROM draft WHERE address = ? AND message_id = ?",
+		address, messageID)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, "draft "+messageID+" for "+address)
+}
+
+//
+// SEARCH
+//
+
+// How many tokens SaveSearchTokens inserts per statement
+const sqlSearchTokenBatch = 100
+
+func (s *sqlStore) SaveSearchTokens(address string, messageID string, tokens []string) error {
+	return s.inTx(func(tx sqlTx) error {
+		var count int
+		err := tx.queryRow("SELECT COUNT(*) FROM box WHERE "+sqlMessage,
+			address, messageID).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: message %s for %s", ErrNotFound, messageID, address)
+		}
+		_, err = tx.exec("DELETE FROM search_token WHERE "+sqlMessage, address, messageID)
+		if err != nil {
+			return err
+		}
+
+		var args []interface{}
+		seen := map[string]bool{}
+		for i, token := range tokens {
+			if !seen[token] {
+				seen[token] = true
+				args = append(args, address, token, messageID)
+			}
+			if len(args) == 3*sqlSearchTokenBatch || (i == len(tokens)-1 && len(args) > 0) {
+				_, err := tx.exec("INSERT INTO search_token (address, token, message_id) VALUES "+
+					"(?, ?, ?)"+strings.Repeat(", (?, ?, ?)", len(args)/3-1), args...)
+				if err != nil {
+					return err
+				}
+				args = args[:0]
+			}
+		}
+		return nil
+	})
+}
+
+// Matches a user's box rows, except in the trash, of the messages
+// that have every one of the tokens
+func sqlWithTokens(address string, tokens []string) (string, []interface{}) {
+	where := "address=? AND box<>'trash'"
+	args := []interface{}{address}
+	for _, token := range tokens {
+		where += " AND message_id IN " +
+			"(SELECT message_id FROM search_token WHERE address=? AND token=?)"
+		args = append(args, address, token)
+	}
+	return where, args
+}
+
+func (s *sqlStore) SearchByThread(address string, tokens []string, offset, limit int) ([]EmailHeader, error) {
+	where, args := sqlWithTokens(address, tokens)
+	return s.loadThreads(where, args, offset, limit)
+}
+
+func (s *sqlStore) SearchByThreadAfter(address string, tokens []string, after *BoxCursor, limit int) ([]EmailHeader, *BoxCursor, error) {
+	where, args := sqlWithTokens(address, tokens)
+	return s.loadThreadsAfter(where, args, after, limit)
+}
+
+func (s *sqlStore) CountSearch(address string, tokens []string) (int, error) {
+	where, args := sqlWithTokens(address, tokens)
+	return s.countThreads(where, args)
+}
+
+// Deletes a user's search tokens for a message,
+// once the message is in none of their boxes
+func deleteSearchTokens(db sqlExecer, address string, messageID string) error {
+	_, err := db.exec("DELETE FROM search_token WHERE "+sqlMessage+" AND "+sqlNotInBox,
+		address, messageID)
+	return err
+}
+
+// Matches the search tokens of messages that aren't in their user's boxes
+const sqlNotInBox = "NOT EXISTS (SELECT 1 FROM box WHERE " +
+	"box.address = search_token.address AND box.message_id = search_token.message_id)"
+
+//
+// NOTARY
+//
+
+func (s *sqlStore) AddNameResolution(name, host, hash string) error {
+	_, err := s.exec("INSERT INTO name_resolution "+
+		"(name, host, hash, unix_time) "+
+		"VALUES (?,?,?,?)",
+		name,
+		host,
+		hash,
+		time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *sqlStore) SetNameResolution(name, host, hash string) error {
+	return s.setNameResolution(s, name, host, hash)
+}
+
+func (s *sqlStore) setNameResolution(db sqlExecer, name, host, hash string) error {
+	_, err := db.exec("INSERT INTO name_resolution "+
+		"(name, host, hash, unix_time) "+
+		"VALUES (?,?,?,?) "+
+		s.dialect.upsert("host, name", "hash", "unix_time"),
+		name,
+		host,
+		hash,
+		time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteNameResolution(name, host string) error {
+	_, err := s.exec("DELETE FROM name_resolution "+
+		"WHERE name=? and host=?",
+		name,
+		host,
+	)
+	return err
+}
+
+func (s *sqlStore) GetNameResolution(name, host string) (hash string, err error) {
+	err = s.queryRow("SELECT "+
+		"hash FROM name_resolution WHERE "+
+		"name=? AND host=?",
+		name, host).Scan(
+		&hash)
+	return
+}
+
+func (s *sqlStore) SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) (*MxHostInfo, error) {
+	now := time.Now().Unix()
+	_, err := s.exec("INSERT INTO mx_hosts "+
+		"(host, is_scramble, notary_public_key, unix_time) "+
+		"VALUES (?,?,?,?) "+
+		s.dialect.upsert("host", "is_scramble", "notary_public_key", "unix_time"),
+		host,
+		isScramble,
+		sql.NullString{notaryPublicKey, notaryPublicKey != ""},
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &MxHostInfo{host, isScramble, notaryPublicKey, now}, nil
+}
+
+func (s *sqlStore) GetMxHostInfo(host string) (*MxHostInfo, error) {
+	var info MxHostInfo
+	var pubKeyNull sql.NullString
+	err := s.queryRow("SELECT "+
+		"host, is_scramble, notary_public_key, unix_time "+
+		"FROM mx_hosts WHERE host=?",
+		host).Scan(
+		&info.Host,
+		&info.IsScramble,
+		&pubKeyNull,
+		&info.UnixTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	info.NotaryPublicKey = pubKeyNull.String
+	return &info, nil
+}
+
+//
+// RETENTION
+//
+
+func (s *sqlStore) SetSentRetentionDays(token string, days int) error {
+	_, err := s.exec("UPDATE `user` SET sent_retention_days=? WHERE token=?",
+		days, token)
+	return err
+}
+
+func (s *sqlStore) LoadSentRetentionDays() (map[string]int, error) {
+	rows, err := s.query("SELECT token, email_host, sent_retention_days " +
+		"FROM `user` WHERE sent_retention_days > 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	daysByAddress := map[string]int{}
+	for rows.Next() {
+		var token, emailHost string
+		var days int
+		if err := rows.Scan(&token, &emailHost, &days); err != nil {
+			return nil, s.mapError(err)
+		}
+		daysByAddress[token+"@"+emailHost] = days
+	}
+	return daysByAddress, s.mapError(rows.Err())
+}
+
+func (s *sqlStore) PurgeBox(purge BoxPurge, dryRun bool) (int64, error) {
+	where := "box = ? AND unix_time < ?"
+	args := []interface{}{purge.Box, purge.Before}
+	if len(purge.Addresses) > 0 {
+		where += " AND address IN (?" + strings.Repeat(",?", len(purge.Addresses)-1) + ")"
+		for _, address := range purge.Addresses {
+			args = append(args, address)
+		}
+	}
+	if len(purge.Except) > 0 {
+		where += " AND address NOT IN (?" + strings.Repeat(",?", len(purge.Except)-1) + ")"
+		for _, address := range purge.Except {
+			args = append(args, address)
+		}
+	}
+	return s.purge("box", where, dryRun, args...)
+}
+
+func (s *sqlStore) PurgeTrash(before int64, dryRun bool) (int64, error) {
+	return s.purge("box", "box = 'trash' AND trashed_time < ?", dryRun, before)
+}
+
+func (s *sqlStore) PurgeOrphanEmails(before int64, dryRun bool) (int64, error) {
+	return s.purge("email", "unix_time < ? AND NOT EXISTS "+
+		"(SELECT 1 FROM box WHERE box.message_id = email.message_id)",
+		dryRun, before)
+}
+
+// Box rows that the janitor purges leave their search tokens behind
+func (s *sqlStore) PurgeOrphanSearchTokens(dryRun bool) (int64, error) {
+	return s.purge("search_token", sqlNotInBox, dryRun)
+}
+
+func (s *sqlStore) PurgeMxHosts(before int64, dryRun bool) (int64, error) {
+	return s.purge("mx_hosts", "unix_time < ?", dryRun, before)
+}
+
+func (s *sqlStore) PurgeSessions(before int64, dryRun bool) (int64, error) {
+	return s.purge("session", "expires_time < ?", dryRun, before)
+}
+
+// Deletes the rows in table that match where,
+// or for a dry run, counts them
+func (s *sqlStore) purge(table string, where string, dryRun bool, args ...interface{}) (count int64, err error) {
+	if dryRun {
+		err = s.queryRow("SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&count)
+		return
+	}
+	res, err := s.exec("DELETE FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) IsBlobReferenced(ref string) (bool, error) {
+	var count int
+	err := s.queryRow("SELECT COUNT(*) FROM email WHERE body_ref = ?", ref).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,96 @@
+package scramble
+
+import "database/sql"
+import "github.com/mattn/go-sqlite3"
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Opens (or creates) a SQLite database file. See openStore for migrations.
+// Meant for single-node deployments, where running MySQL is overkill.
+func newSQLiteStore(path string) *sqlStore {
+	log.Printf("Opening SQLite database %s\n", path)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		panic(err)
+	}
+	// foreign keys are off by default in SQLite.
+	// WAL and a busy timeout let the HTTP and SMTP goroutines share the file.
+	db, err := sql.Open("sqlite3", "file:"+path+
+		"?_foreign_keys=1&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		panic(err)
+	}
+
+	return &sqlStore{db, sqliteDialect{}}
+}
+
+// Where the SQLite database lives. DbCatalog is the file name,
+// relative paths are relative to ~/.scramble
+func sqlitePath(conf *Config) string {
+	if filepath.IsAbs(conf.DbCatalog) {
+		return conf.DbCatalog
+	}
+	return filepath.Join(os.Getenv("HOME"), ".scramble", conf.DbCatalog)
+}
+
+type sqliteDialect struct{}
+
+// SQLite takes ? placeholders, and `backticks` for MySQL compatibility
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) upsert(key string, cols ...string) string {
+	sets := []string{}
+	for _, col := range cols {
+		sets = append(sets, col+" = excluded."+col)
+	}
+	return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+func (sqliteDialect) concat(exprs ...string) string {
+	return "(" + strings.Join(exprs, " || ") + ")"
+}
+
+func (sqliteDialect) mapError(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrConstraint {
+		return err
+	}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+	return fmt.Errorf("%w: %v", ErrConstraint, err)
+}
+
+// Another connection held the write lock for longer than the busy timeout
+func (sqliteDialect) retryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+func (sqliteDialect) resetSerial(table, column string) string {
+	return ""
+}
+
+func (sqliteDialect) returning(column string) string {
+	return ""
+}
+
+// SQLite has no advisory locks. Every migration step starts by
+// writing to the migration table, which takes the database's write lock,
+// so steps of different processes run one after the other.
+func (sqliteDialect) lockMigrations(conn *sql.Conn) (func(), error) {
+	return func() {}, nil
+}
@@ -11,6 +11,8 @@ package scramble
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/net/html"
@@ -38,20 +40,47 @@ func saveEmails() {
 		// wrap in func to Recover per saveEmail operation,
 		// such that this loop never dies.
 		func() {
-			defer Recover()
 			msg := <-SaveMailChan
+			// the SMTP client is waiting for an answer, even if we panic.
+			// the same mail would most likely panic again, so it's refused.
+			var result error = errors.New("panic while saving mail")
+			defer func() { msg.saveResult <- result }()
+			defer Recover()
 			log.Println("Saving mail from " + msg.mailFrom + " to " + strings.Join(msg.rcptTo, ","))
-			success := saveEmail(msg)
-			msg.saveSuccess <- success
+			result = saveEmail(msg)
 		}()
 	}
 }
 
-func saveEmail(msg *SMTPMessage) bool {
+// Mail that can't be saved however often the sender tries,
+// e.g. it can't be encrypted for the recipient
+var errUndeliverable = errors.New("undeliverable mail")
+
+// Mail that doesn't fit in a recipient's quota. The sender gets a 552.
+var errMailboxFull = errors.New("mailbox full")
+
+// Saves the email. Returns an smtpTempError if the sending server should
+// try again later, or another error if the mail should be refused.
+func saveEmail(msg *SMTPMessage) error {
 	err := deliverMailLocally(msg)
-	if err != nil {
-		log.Printf("Can't save email, DB error: %v\n", err)
-		return false
+	if err == nil {
+		return nil
+	} else if isTemporarySaveError(err) {
+		log.Printf("Can't save email, DB error, the sender will retry: %v\n", err)
+		return smtpTempError{err}
+	}
+	log.Printf("Can't save email, refusing it: %v\n", err)
+	return err
+}
+
+// The Store's own errors say what's wrong with the rows, and so will
+// be the same next time. Any other error from it means the database
+// failed, e.g. it's down or a transaction deadlocked, see repo.go.
+func isTemporarySaveError(err error) bool {
+	for _, permanent := range []error{errUndeliverable, errMailboxFull, ErrNotFound, ErrDuplicate, ErrConstraint} {
+		if errors.Is(err, permanent) {
+			return false
+		}
 	}
 	return true
 }
@@ -66,22 +95,32 @@ func deliverMailLocally(msg *SMTPMessage) error {
 		cipherBody = cipherPackets[1]
 	} else if len(cipherPackets) == 1 {
 		// Mail from an outside PGP implementation: encrypted body only
-		cipherSubject = encryptForUsers(msg.data.subject, msg.rcptTo)
+		var err error
+		cipherSubject, err = encryptForUsers(msg.data.subject, msg.rcptTo)
+		if err != nil {
+			return err
+		}
 		cipherBody = cipherPackets[0]
 	} else {
-		cipherSubject = encryptForUsers(msg.data.subject, msg.rcptTo)
+		var err error
+		cipherSubject, err = encryptForUsers(msg.data.subject, msg.rcptTo)
+		if err != nil {
+			return err
+		}
 		var textBody string
 		if msg.data.textBody == "" && msg.data.decodedBody != "" {
 			// HTML email, blank body with file attachments, etc
-			var err error
 			textBody, err = extractTextFromHTML(msg.data.decodedBody)
 			if err != nil {
-				return err
+				return fmt.Errorf("%w: %v", errUndeliverable, err)
 			}
 		} else {
 			textBody = msg.data.textBody
 		}
-		cipherBody = encryptForUsers("Subject: "+msg.data.subject+"\n\n"+textBody, msg.rcptTo)
+		cipherBody, err = encryptForUsers("Subject: "+msg.data.subject+"\n\n"+textBody, msg.rcptTo)
+		if err != nil {
+			return err
+		}
 	}
 
 	email := new(Email)
@@ -96,23 +135,34 @@ func deliverMailLocally(msg *SMTPMessage) error {
 	email.AncestorIDs = msg.data.ancestorIDs.AngledStringCappedToBytes(
 		" ", GetConfig().AncestorIDsMaxBytes)
 
-	err := SaveMessage(email)
-	if err == nil {
-		// all good, add to inbox locally
-		for _, addr := range msg.rcptTo {
-			AddMessageToBox(email, addr, "inbox")
-		}
+	// usage counts cipher bodies, so this is the size that has to fit
+	if err := checkMailboxRoom(msg.rcptTo, int64(len(cipherBody))); err != nil {
+		return err
+	}
 
+	// save the email and add it to each inbox in one transaction.
+	// if that fails nothing was saved, and the sending server will
+	// retry after we answer 451. if it succeeded but the sender
+	// never got our 250, the retry is a duplicate, see below.
+	boxes := []MessageBox{}
+	for _, addr := range msg.rcptTo {
+		boxes = append(boxes, MessageBox{addr, "inbox"})
+	}
+	err := DeliverMessage(email, boxes)
+	if err == nil {
 		msgSize := len(email.CipherBody)
 		log.Printf("Successfully saved mail from %s to %s, %d bytes, message ID %s\n",
 			email.From, email.To, msgSize, email.MessageID)
-	} else if strings.HasPrefix(err.Error(), "Error 1062: Duplicate entry") {
+	} else if errors.Is(err, ErrDuplicate) {
 		// tried to save mail, but the MessageID already exists
 		// this can happen, for example, if you send an email
 		// and it gets auto-forwarded back to you
 		// sanity check that this is the same message
 		// (we can only check From and To since Subject and Body are encrypted)
-		oldEmail := LoadMessage(email.MessageID)
+		oldEmail, err := LoadMessage(email.MessageID)
+		if err != nil {
+			return err
+		}
 		if oldEmail.From != email.From ||
 			oldEmail.To != email.To {
 			log.Printf("Discarding mail with duplicate MessageID %s from %s to %s\n",
@@ -120,12 +170,36 @@ func deliverMailLocally(msg *SMTPMessage) error {
 		}
 	} else {
 		// unknown error trying to save mail
-		panic(err)
+		return err
 	}
 
 	return nil
 }
 
+// Returns errMailboxFull if the message doesn't fit in the quota of one
+// of the recipients. RCPT TO only refused mailboxes that were full already.
+// There's one reply to DATA for all recipients, so the sender bounces
+// the message for all of them, and the bounce says which one is full.
+func checkMailboxRoom(addrs []string, size int64) error {
+	for _, addr := range addrs {
+		token := strings.Split(addr, "@")[0]
+		user, err := LoadUser(token)
+		var usage *StorageUsage
+		if err == nil {
+			usage, err = LoadStorageUsage(user)
+		}
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		} else if !usage.HasRoomFor(size) {
+			return fmt.Errorf("%w: %s has %d of %d bytes used, the message has %d",
+				errMailboxFull, addr, usage.UsedBytes, usage.QuotaBytes, size)
+		}
+	}
+	return nil
+}
+
 // Extracts reasonably readable plain text from an HTML email
 // Note this is NOT an HTML sanitizer and the output is NOT safe to display as HTML.
 // The output should be displayed only as plain text.
@@ -213,26 +287,28 @@ func joinAddresses(addrs []*mail.Address) string {
 	return strings.Join(strs, ",")
 }
 
-func encryptForUsers(plaintext string, addrs []string) string {
+func encryptForUsers(plaintext string, addrs []string) (string, error) {
 	keys := make([]*openpgp.Entity, 0)
 	for _, addr := range addrs {
 		token := strings.Split(addr, "@")[0]
-		user := LoadUser(token)
-		if user == nil {
+		user, err := LoadUser(token)
+		if errors.Is(err, ErrNotFound) {
 			// we've already told the SMTP sender that those
 			// recipients don't exist on this server
 			continue
+		} else if err != nil {
+			return "", err
 		}
 
 		entity, err := ReadEntity(user.PublicKey)
 		if err != nil {
-			panic(err)
+			return "", fmt.Errorf("%w: public key of %s: %v", errUndeliverable, addr, err)
 		}
 		keys = append(keys, entity)
 	}
 	if len(keys) == 0 {
 		log.Printf("Warning: not encrypting incoming mail--unrecognized recipients")
-		return plaintext
+		return plaintext, nil
 	} else if len(keys) != len(addrs) {
 		log.Printf("Warning: encrypting plaintext for %s, found only %d keys\n",
 			strings.Join(addrs, ","), len(keys))
@@ -245,12 +321,13 @@ func encryptForUsers(plaintext string, addrs []string) string {
 	}
 	plainWriter, err := openpgp.Encrypt(w, keys, nil, nil, nil)
 	if err != nil {
-		panic(err)
+		// eg a key that can't encrypt
+		return "", fmt.Errorf("%w: %v", errUndeliverable, err)
 	}
 	plainWriter.Write([]byte(plaintext))
 	plainWriter.Close()
 	w.Close()
 
 	ciphertext := cipherBuffer.String()
-	return ciphertext
+	return ciphertext, nil
 }
@@ -1,6 +1,11 @@
 package scramble
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
 
 func TestPlainTextFromHTML(t *testing.T) {
 	pairs := [...][2]string{
@@ -47,3 +52,139 @@ Click here: ( link to https://google.com ) Google`,
 		}
 	}
 }
+
+func TestDeliverMailLocally(t *testing.T) {
+	tUser := loadTestUser()
+	smtpData := "Message-ID: <deliver-test@example.com>\r\n" +
+		"From: <sender@example.com>\r\n" +
+		"To: <" + tUser.EmailAddress + ">\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello World\r\n"
+	data, err := parseSMTPData(smtpData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &SMTPMessage{
+		time:     time.Now().Unix(),
+		mailFrom: "sender@example.com",
+		rcptTo:   []string{tUser.EmailAddress},
+		data:     *data,
+	}
+	for i := 0; i < 2; i++ {
+		// the second delivery is a duplicate Message-ID, which is not an error
+		if err := deliverMailLocally(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	boxes, err := BoxesForMessage(tUser.EmailAddress, "deliver-test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 1 || boxes[0] != "inbox" {
+		t.Errorf("Expected delivered mail in the inbox once, got %v", boxes)
+	}
+	if err := DeleteFromBoxes(tUser.EmailAddress, "deliver-test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A Store whose database fails to save mail
+type failingDeliveryStore struct {
+	Store
+	err error
+}
+
+func (s failingDeliveryStore) DeliverMessage(e *Email, boxes []MessageBox) error {
+	return s.err
+}
+
+func TestSaveEmailErrors(t *testing.T) {
+	newMessage := func(id string, to string) *SMTPMessage {
+		data, err := parseSMTPData("Message-ID: <" + id + ">\r\n" +
+			"From: <sender@example.com>\r\n" +
+			"To: <" + to + ">\r\n" +
+			"Subject: Hello\r\n" +
+			"\r\n" +
+			"Hello World\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &SMTPMessage{time: time.Now().Unix(), mailFrom: "sender@example.com",
+			rcptTo: []string{to}, data: *data}
+	}
+
+	// a recipient whose key can't be read, it won't be any better later
+	broken := &User{UserID: UserID{Token: "brokenkey", PasswordHash: "hash", PublicHash: "brokenkeyhash",
+		EmailHost: GetConfig().SMTPMxHost}, PublicKey: "not a key"}
+	if err := SaveUser(broken); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteUser(broken.Token)
+	err := saveEmail(newMessage("broken-key@example.com", "brokenkey@"+GetConfig().SMTPMxHost))
+	var tempErr smtpTempError
+	if err == nil || errors.As(err, &tempErr) {
+		t.Errorf("Expected mail for a broken key to be refused for good, got %v", err)
+	}
+
+	// the database failing is worth a retry, rows it refuses aren't
+	tUser := loadTestUser()
+	defer func(saved Store) { store = saved }(getStore())
+	for _, c := range []struct {
+		err       error
+		temporary bool
+	}{
+		{errors.New("dial tcp: connection refused"), true},
+		{fmt.Errorf("%w: value too long", ErrConstraint), false},
+	} {
+		store = failingDeliveryStore{getStore(), c.err}
+		err := saveEmail(newMessage("failing-db@example.com", tUser.EmailAddress))
+		store = store.(failingDeliveryStore).Store
+		if x := errors.As(err, &tempErr); err == nil || x != c.temporary {
+			t.Errorf("Expected %v to be temporary: %v, got %v", c.err, c.temporary, err)
+		}
+	}
+}
+
+func TestSaveEmailQuota(t *testing.T) {
+	tUser := loadTestUser()
+	usage, err := LoadStorageUsage(tUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := parseSMTPData("Message-ID: <quota-test@example.com>\r\n" +
+		"From: <sender@example.com>\r\n" +
+		"To: <" + tUser.EmailAddress + ">\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello World\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &SMTPMessage{time: time.Now().Unix(), mailFrom: "sender@example.com",
+		rcptTo: []string{tUser.EmailAddress}, data: *data}
+
+	// not full, so RCPT TO took it, but the encrypted message won't fit
+	conf := GetConfig()
+	defer func(quota int64) { conf.DefaultQuotaBytes = quota }(conf.DefaultQuotaBytes)
+	conf.DefaultQuotaBytes = usage.UsedBytes + 10
+	if reply := checkRecipientQuota(tUser.EmailAddress); reply != "" {
+		t.Errorf("Expected a mailbox with room to be accepted, got %s", reply)
+	}
+	err = saveEmail(msg)
+	var tempErr smtpTempError
+	if !errors.Is(err, errMailboxFull) || errors.As(err, &tempErr) {
+		t.Errorf("Expected a message over quota to be refused, got %v", err)
+	}
+	if _, err := LoadMessage("quota-test@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the message not to be saved, got %v", err)
+	}
+
+	conf.DefaultQuotaBytes = usage.UsedBytes + 100000
+	if err := saveEmail(msg); err != nil {
+		t.Errorf("Expected a message that fits to be saved, got %v", err)
+	}
+	if err := DeleteFromBoxes(tUser.EmailAddress, "quota-test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -52,7 +52,10 @@ type SMTPMessage struct {
 
 	data SMTPMessageData
 
-	saveSuccess chan bool
+	// nil once the message is saved, an smtpTempError if
+	// the sending server should try again later, errMailboxFull
+	// if it doesn't fit, any other error if it's refused for good
+	saveResult chan error
 }
 
 type SMTPMessageData struct {
@@ -72,6 +75,12 @@ type SMTPMessageData struct {
 
 var SaveMailChan chan *SMTPMessage
 
+// An error that isn't the sender's fault, e.g. the database is down.
+// The sending server gets a 451 and tries again later.
+type smtpTempError struct {
+	error
+}
+
 // Private implementation
 
 var emailRegex = regexp.MustCompile(`<(.+?)>`)
@@ -221,6 +230,8 @@ func handleClient(client *client) {
 					log.Println("Rejecting mail for " + rawEmail)
 					responseAdd(client, "550 Invalid address")
 					killClient(client)
+				} else if reply := checkRecipientQuota(email); reply != "" {
+					responseAdd(client, reply)
 				} else {
 					client.rcptTo = append(client.rcptTo, email)
 					responseAdd(client, "250 Accepted")
@@ -256,18 +267,21 @@ func handleClient(client *client) {
 				// place on the channel so that one of the save mail workers can pick it up
 				smtpMessage, err := createSMTPMessage(client)
 
-				var success bool
 				if err == nil {
 					SaveMailChan <- smtpMessage
 					// wait for the save to complete
-					success = <-smtpMessage.saveSuccess
+					err = <-smtpMessage.saveResult
 				} else {
 					log.Printf("Could not parse SMTP message: %v", err)
-					success = false
 				}
 
-				if success {
+				var tempErr smtpTempError
+				if err == nil {
 					responseAdd(client, "250 OK : queued")
+				} else if errors.Is(err, errMailboxFull) {
+					responseAdd(client, "552 5.2.2 Mailbox full")
+				} else if errors.As(err, &tempErr) {
+					responseAdd(client, "451 Error : temporary failure, try again later")
 				} else {
 					responseAdd(client, "554 Error : transaction failed")
 				}
@@ -295,6 +309,31 @@ func handleClient(client *client) {
 
 }
 
+// Returns the reply that rejects a recipient whose mailbox is full,
+// or "" if their mail can be accepted.
+// Full mailboxes get a temporary error, the user may make room.
+// Whether the message itself fits is checked once it's read,
+// see checkMailboxRoom.
+func checkRecipientQuota(address string) string {
+	token := strings.Split(address, "@")[0]
+	user, err := LoadUser(token)
+	var usage *StorageUsage
+	if err == nil {
+		usage, err = LoadStorageUsage(user)
+	}
+	if errors.Is(err, ErrNotFound) {
+		// not one of our users, nothing to check
+		return ""
+	} else if err != nil {
+		log.Printf("Can't check quota for %s: %v", address, err)
+		return "451 4.3.0 Temporary failure, try again later"
+	} else if usage.IsFull() {
+		log.Printf("Rejecting mail for %s, mailbox full", address)
+		return "452 4.2.2 Mailbox full"
+	}
+	return ""
+}
+
 func createSMTPMessage(client *client) (*SMTPMessage, error) {
 	// check mailFrom and rcptTo, etc.
 	if err := validateEmailData(client); err != nil {
@@ -315,7 +354,7 @@ func createSMTPMessage(client *client) (*SMTPMessage, error) {
 
 		data: *smtpData,
 
-		saveSuccess: make(chan bool),
+		saveResult: make(chan error),
 	}, nil
 }
 
@@ -342,7 +381,10 @@ func parseSMTPData(smtpData string) (*SMTPMessageData, error) {
 	threadIDStr := strings.Trim(parsed.Header.Get("X-Scramble-Thread-ID"), "<>")
 	threadID, ok := ParseEmailAddressSafe(threadIDStr)
 	if !ok {
-		threadID = computeThreadID(messageID, ancestorIDs)
+		threadID, err = computeThreadID(messageID, ancestorIDs)
+		if err != nil {
+			return nil, smtpTempError{err}
+		}
 	}
 
 	data := new(SMTPMessageData)
@@ -655,19 +697,22 @@ func sanitizeAncestorIDs(headers mail.Header) EmailAddresses {
 
 // Generally the ancestorIDs[0], we do a lookup in our db
 //  to see if we can find an older ancestor.
-func computeThreadID(messageID *EmailAddress, ancestorIDs EmailAddresses) *EmailAddress {
+func computeThreadID(messageID *EmailAddress, ancestorIDs EmailAddresses) (*EmailAddress, error) {
 	if len(ancestorIDs) > 0 {
 		var ancestors []interface{}
 		for _, messageID := range ancestorIDs {
 			ancestors = append(ancestors, messageID.String())
 		}
-		threadIDs := LoadThreadIDsForMessageIDs(ancestors)
+		threadIDs, err := LoadThreadIDsForMessageIDs(ancestors)
+		if err != nil {
+			return nil, err
+		}
 		// This algo isn't perfect, but might be good enough.
 		for _, threadID := range threadIDs {
 			if threadID != "" {
-				return ParseEmailAddress(threadID)
+				return ParseEmailAddress(threadID), nil
 			}
 		}
 	}
-	return messageID
+	return messageID, nil
 }
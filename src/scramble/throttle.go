@@ -0,0 +1,192 @@
+/**
+ * Slows down passphrase guessing. Failed logins are counted per account
+ * and per client IP. After a few, each further attempt has to wait twice
+ * as long as the one before, and after many the account or IP is locked
+ * out for a while and the AdminEmails hear about it. Throttled requests
+ * get HTTP 429 with a Retry-After header, see auth().
+ *
+ * Whatever checks a passphrase hash or a two-factor code is throttled, see
+ * authenticateUserPass. Session secrets are too long to guess, so a user
+ * who is already logged in keeps working while their account is locked.
+ *
+ * The counts are kept in memory. A restart forgets them.
+ */
+
+package scramble
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type throttleLimits struct {
+	freeFailures    int   // before the backoff starts
+	lockoutFailures int   // locks out, and tells the admins
+	lockoutSecs     int64 // how long a lockout lasts
+}
+
+var (
+	accountLimits = throttleLimits{freeFailures: 3, lockoutFailures: 10, lockoutSecs: 15 * 60}
+	// many users can share an IP, eg behind NAT
+	ipLimits = throttleLimits{freeFailures: 10, lockoutFailures: 50, lockoutSecs: 60 * 60}
+)
+
+const (
+	// the backoff doubles with every failure, up to this
+	maxBackoffSecs = 5 * 60
+	// counts are forgotten this long after the last failure
+	failureWindowSecs = 24 * 60 * 60
+)
+
+// Sent back instead of checking the passphrase while it's too soon to try again
+type throttledError struct {
+	retryAfter int64 // seconds
+}
+
+func (e *throttledError) Error() string {
+	return "Too many failed logins. Please try again in " + formatWait(e.retryAfter)
+}
+
+// The Retry-After header, in seconds
+func (e *throttledError) RetryAfter() string {
+	return strconv.FormatInt(e.retryAfter, 10)
+}
+
+func formatWait(secs int64) string {
+	if secs < 60 {
+		return fmt.Sprintf("%d seconds", secs)
+	}
+	return fmt.Sprintf("%d minutes", (secs+59)/60)
+}
+
+type failureCount struct {
+	failures    int
+	lastFailure int64
+	lockedUntil int64
+}
+
+// Failed logins by account or IP
+type loginThrottle struct {
+	mutex     sync.Mutex
+	counts    map[string]*failureCount // by "token:<token>" or "ip:<ip>"
+	lastSweep int64                    // when old counts were last forgotten
+}
+
+var logins = newLoginThrottle()
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{counts: map[string]*failureCount{}}
+}
+
+// Returns a throttledError if the account or the IP has to wait
+// before it tries again
+func (t *loginThrottle) check(token string, ip string, now int64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	wait := t.wait("token:"+token, accountLimits, now)
+	if ipWait := t.wait("ip:"+ip, ipLimits, now); ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		return &throttledError{wait}
+	}
+	return nil
+}
+
+// Counts a failed login. The token is "" if there's no such user,
+// then only the IP counts.
+func (t *loginThrottle) fail(token string, ip string, now int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now-t.lastSweep >= 60 {
+		t.forgetOld(now)
+		t.lastSweep = now
+	}
+	if token != "" {
+		t.count("token:"+token, "account "+token, accountLimits, now)
+	}
+	t.count("ip:"+ip, "IP "+ip, ipLimits, now)
+}
+
+// Clears the account's failures after a good login.
+// The IP's stay, or else guessing at one account could be hidden
+// between logins to another.
+func (t *loginThrottle) succeed(token string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.counts, "token:"+token)
+}
+
+// Seconds until the next attempt is allowed, 0 if it's allowed now
+func (t *loginThrottle) wait(key string, limits throttleLimits, now int64) int64 {
+	count := t.counts[key]
+	if count == nil {
+		return 0
+	}
+	if count.lockedUntil > now {
+		return count.lockedUntil - now
+	}
+	if count.failures < limits.freeFailures {
+		return 0
+	}
+	if wait := count.lastFailure + backoffSecs(count.failures-limits.freeFailures) - now; wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// 1, 2, 4, 8... seconds, up to maxBackoffSecs
+func backoffSecs(extraFailures int) int64 {
+	if extraFailures >= 30 {
+		return maxBackoffSecs
+	}
+	secs := int64(1) << uint(extraFailures)
+	if secs > maxBackoffSecs {
+		return maxBackoffSecs
+	}
+	return secs
+}
+
+func (t *loginThrottle) count(key string, what string, limits throttleLimits, now int64) {
+	count := t.counts[key]
+	if count == nil {
+		count = &failureCount{}
+		t.counts[key] = count
+	}
+	count.failures++
+	count.lastFailure = now
+	if count.failures >= limits.lockoutFailures {
+		count.lockedUntil = now + limits.lockoutSecs
+	}
+	if count.failures == limits.lockoutFailures {
+		log.Printf("Locked out %s after %d failed logins\n", what, count.failures)
+		notifyAdmins("Login lockout on Scramble server "+GetConfig().SMTPMxHost,
+			fmt.Sprintf("%d failed logins for %s. It is locked out for %s, "+
+				"and again after each further failure.\n",
+				count.failures, what, formatWait(limits.lockoutSecs)))
+	}
+}
+
+func (t *loginThrottle) forgetOld(now int64) {
+	for key, count := range t.counts {
+		if count.lastFailure+failureWindowSecs < now && count.lockedUntil < now {
+			delete(t.counts, key)
+		}
+	}
+}
+
+// Checks, before the passphrase hash is, that the account and IP may try now
+func checkLoginThrottle(token string, ip string) error {
+	return logins.check(token, ip, time.Now().Unix())
+}
+
+func recordLoginFailure(token string, ip string) {
+	logins.fail(token, ip, time.Now().Unix())
+}
+
+func recordLoginSuccess(token string) {
+	logins.succeed(token)
+}
@@ -0,0 +1,71 @@
+package scramble
+
+import "testing"
+
+func TestLoginThrottle(t *testing.T) {
+	throttle := newLoginThrottle()
+	now := int64(1000)
+	for i := 0; i < accountLimits.freeFailures; i++ {
+		if err := throttle.check("alice", "1.2.3.4", now); err != nil {
+			t.Fatalf("Expected failure %d to be free, got %v", i+1, err)
+		}
+		throttle.fail("alice", "1.2.3.4", now)
+	}
+
+	// then the wait doubles with every failure
+	for wait := int64(1); wait <= 8; wait *= 2 {
+		err := throttle.check("alice", "5.6.7.8", now)
+		if throttled, ok := err.(*throttledError); !ok || throttled.retryAfter != wait {
+			t.Fatalf("Expected to wait %d seconds, got %v", wait, err)
+		}
+		now += wait
+		if err := throttle.check("alice", "5.6.7.8", now); err != nil {
+			t.Fatalf("Expected a try after %d seconds, got %v", wait, err)
+		}
+		throttle.fail("alice", "5.6.7.8", now)
+	}
+	if err := throttle.check("bob", "5.6.7.8", now); err != nil {
+		t.Errorf("Expected other accounts to be fine, got %v", err)
+	}
+
+	// and enough failures lock the account out
+	for i := accountLimits.freeFailures + 4; i < accountLimits.lockoutFailures; i++ {
+		now += maxBackoffSecs
+		throttle.fail("alice", "9.9.9.9", now)
+	}
+	err := throttle.check("alice", "9.9.9.9", now+maxBackoffSecs)
+	if throttled, ok := err.(*throttledError); !ok || throttled.retryAfter != accountLimits.lockoutSecs-maxBackoffSecs {
+		t.Errorf("Expected a lockout, got %v", err)
+	}
+	if err := throttle.check("alice", "9.9.9.9", now+accountLimits.lockoutSecs); err != nil {
+		t.Errorf("Expected the lockout to end, got %v", err)
+	}
+
+	// a good login clears the account, but not the IP
+	for i := 0; i < ipLimits.freeFailures; i++ {
+		throttle.fail("", "6.6.6.6", now)
+	}
+	throttle.fail("carol", "6.6.6.6", now)
+	throttle.succeed("carol")
+	if err := throttle.check("carol", "1.1.1.1", now); err != nil {
+		t.Errorf("Expected carol to be cleared, got %v", err)
+	}
+	if err := throttle.check("carol", "6.6.6.6", now); err == nil {
+		t.Errorf("Expected the IP to still wait")
+	}
+
+	// and counts are forgotten after a while
+	now += failureWindowSecs + accountLimits.lockoutSecs
+	throttle.fail("", "1.1.1.1", now)
+	if len(throttle.counts) != 1 {
+		t.Errorf("Expected old counts to be forgotten, got %d", len(throttle.counts))
+	}
+}
+
+func TestBackoffSecs(t *testing.T) {
+	for extra, secs := range map[int]int64{0: 1, 3: 8, 8: 256, 9: maxBackoffSecs, 100: maxBackoffSecs} {
+		if x := backoffSecs(extra); x != secs {
+			t.Errorf("backoffSecs(%d) = %d, should be %d", extra, x, secs)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/**
+ * Optional two-factor login with TOTP codes (RFC 6238), the six digit
+ * codes authenticator apps show every 30 seconds.
+ *
+ * A user enrolls by POSTing to /user/me/twofactor, which returns a secret,
+ * then confirms with a code from their app, which turns two-factor on and
+ * returns recovery codes. Each recovery code works once, instead of a TOTP
+ * code, for when the app is gone. scramble-admin reset-2fa turns it off.
+ *
+ * Once it's on, logging in with the passphrase hash also takes a code,
+ * in the x-scramble-code header, see authenticateUserPass. Sessions
+ * started that way don't need another one.
+ */
+
+package scramble
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	totpStepSecs = 30
+	totpDigits   = 6
+	// codes from this many steps before or after now still work,
+	// for phones whose clocks are off a little
+	totpSkewSteps = 1
+)
+
+// How many recovery codes a user gets, and how long they are in base32
+const (
+	recoveryCodeCount = 10
+	recoveryCodeLen   = 10
+)
+
+// Sent back when the passphrase hash is right but a code is missing,
+// so that the client knows to ask for one
+var errTwoFactorNeeded = authError("Two-factor code needed")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns a random 160 bit secret, as authenticator apps take it
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// The code for one time step, see RFC 4226 section 5.3
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Returns the time step of a code that's valid now, or -1.
+// Steps up to lastStep were used already and don't count.
+func matchTOTP(secret string, code string, now int64, lastStep int64) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	current := now / totpStepSecs
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+// The otpauth:// URI that authenticator apps read from a QR code
+func totpURI(address string, secret string) string {
+	query := url.Values{
+		"secret": {secret},
+		"issuer": {"Scramble"},
+	}
+	return "otpauth://totp/" + url.PathEscape("Scramble:"+address) + "?" + query.Encode()
+}
+
+// Returns new recovery codes, eg "abcde-fghij", and the hashes to store
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	random := make([]byte, recoveryCodeLen*5/8)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))
+		codes = append(codes, code[:recoveryCodeLen/2]+"-"+code[recoveryCodeLen/2:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Recovery codes get typed in, so case, spaces and dashes don't matter
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Checks the second factor of a user who has two-factor on:
+// a TOTP code, which can't be used again, or else a recovery code,
+// which gets used up. Users without two-factor need no code.
+//
+// Returns a descriptive authError if the code is missing or wrong
+func checkTwoFactor(token string, code string, now int64) error {
+	tf, err := LoadTwoFactor(token)
+	if errors.Is(err, ErrNotFound) || (err == nil && tf.EnabledTime == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if code == "" {
+		return errTwoFactorNeeded
+	}
+	return useTwoFactorCode(tf, code, now)
+}
+
+// Uses up a TOTP or recovery code of a user who is enrolled
+func useTwoFactorCode(tf *TwoFactor, code string, now int64) error {
+	if step := matchTOTP(tf.Secret, code, now, tf.LastStep); step >= 0 {
+		err := UseTwoFactorStep(tf.Token, step)
+		if errors.Is(err, ErrConflict) {
+			return authError("That code was used already, wait for the next one")
+		}
+		return err
+	}
+	err := UseRecoveryCode(tf.Token, hashRecoveryCode(code))
+	if errors.Is(err, ErrNotFound) {
+		return authError("Incorrect two-factor code")
+	}
+	return err
+}
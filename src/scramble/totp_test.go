@@ -0,0 +1,55 @@
+package scramble
+
+import "testing"
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA1 vectors from RFC 6238 appendix B, the last six digits
+	secret := []byte("12345678901234567890")
+	for unixTime, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	} {
+		if x := totpCode(secret, unixTime/totpStepSecs); x != code {
+			t.Errorf("totpCode at %d = %s, should be %s", unixTime, x, code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := int64(1111111109)
+	step := now / totpStepSecs
+	if x := matchTOTP(secret, "081804", now, 0); x != step {
+		t.Errorf("Expected the current code to match step %d, got %d", step, x)
+	}
+	if x := matchTOTP(secret, "081804", now+totpStepSecs, 0); x != step {
+		t.Errorf("Expected the last code to still match, got %d", x)
+	}
+	if x := matchTOTP(secret, "081804", now+3*totpStepSecs, 0); x != -1 {
+		t.Errorf("Expected an old code not to match, got %d", x)
+	}
+	if x := matchTOTP(secret, "081804", now, step); x != -1 {
+		t.Errorf("Expected a used code not to match again, got %d", x)
+	}
+	if x := matchTOTP(secret, "81804", now, 0); x != -1 {
+		t.Errorf("Expected a short code not to match, got %d", x)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(codes[0]) != recoveryCodeLen+1 {
+		t.Fatalf("Expected %d codes like abcde-fghij, got %v", recoveryCodeCount, codes)
+	}
+	if hashRecoveryCode(" ABCDE-fghij") != hashRecoveryCode("abcdefghij") {
+		t.Errorf("Expected case, spaces and dashes not to matter")
+	}
+	if hashRecoveryCode(codes[0]) != hashes[0] || hashes[0] == hashes[1] {
+		t.Errorf("Expected each code to hash to its own stored hash")
+	}
+}
@@ -13,6 +13,7 @@ var domain = `[A-Z0-9.-]+\.[A-Z]{2,4}`
 var regexHex = regexp.MustCompile("^(?i)[a-f0-9]+$")
 var regexPassHash = regexp.MustCompile("^(?i)[a-f0-9]{40}$")
 var regexHash = regexp.MustCompile("^(?i)[a-f0-9]{40}|[a-z2-7]{16}$")
+var regexSearchToken = regexp.MustCompile("^[a-f0-9]{64}$")
 var regexToken = regexp.MustCompile("^(?i)[a-z0-9]{3}[a-z0-9]*$")
 var regexAddress = regexp.MustCompile(`^(?i)(` + dotAtom + `)@(` + dotAtom + `)$`)
 var regexAngledAddress = regexp.MustCompile(`(?i)<(` + dotAtom + `)@(` + dotAtom + `)>`)
@@ -51,6 +52,12 @@ func validateToken(str string) string {
 	}
 	return str
 }
+func validateSearchToken(str string) string {
+	if !regexSearchToken.MatchString(str) {
+		log.Panicf("Invalid search token %s", str)
+	}
+	return str
+}
 func validateBox(str string) string {
 	if str != "inbox" && str != "sent" && str != "archive" && str != "trash" {
 		log.Panicf("Expected inbox/sent/archive/trash, got %s", str)
@@ -18,6 +18,11 @@ var ALGO_SHA1 = 2;
 var ALGO_AES128 = 7;
 
 var BOX_PAGE_SIZE = 20;
+var BOX_COUNTS_POLL_MS = 60*1000;
+
+// The server takes at most this many search tokens per message, and per search
+var MAX_SEARCH_TOKENS = 2000;
+var MAX_SEARCH_TERMS = 20;
 
 var REGEX_TOKEN = /^[a-z0-9][a-z0-9][a-z0-9]+$/;
 var REGEX_EMAIL = /^([A-Z0-9._%+-=]+)@([A-Z0-9.-]+\.[A-Z][A-Z]+)$/i;
@@ -54,8 +59,10 @@ var MAX_MISSING_NOTARIES = 1;
 //
 // sessionStorage["token"] is the username
 // sessionStorage["emailAddress"] is <token>@<host>
-// sessionStorage["passHash"] is the auth key
+// sessionStorage["passHash"] is the auth key, traded for a session at login
 // sessionStorage["passHashOld"] is for backwards compatibility
+// sessionStorage["session"] is the session secret, sent instead of passHash
+// sessionStorage["sessionID"] is its id, for logging out
 // sessionStorage["/publickeys/notary"] is the cached /publickeys/notary response
 // sessionStorage["hostPrefix"] is the request prefix, like "https://scramble.io", for chrome
 //
@@ -63,6 +70,7 @@ var MAX_MISSING_NOTARIES = 1;
 // sessionStorage["passKey"] is AES128 key derived from passphrase, used to encrypt to private key
 // sessionStorage["publicKeyArmored"] is the PGP public key, ascii armored
 // sessionStorage["privateKeyArmored"] is the plaintext private key, ascii armored
+// sessionStorage["searchKey"] is the key for search tokens, see getSearchKey
 //
 
 
@@ -103,6 +111,8 @@ viewState.clearEmails = function() {
     this.emails = null;
 };
 
+viewState.boxCounts = null; // box name -> thread counts, see loadBoxCounts
+viewState.searchQuery = null; // plaintext, never sent to the server
 viewState.contacts = null; // plaintext address book
 viewState.notaries = null; // notaries that client trusts.
 
@@ -119,6 +129,7 @@ var cache = {};
 cache.keyMap = {}; // email address -> notarized public key
 cache.emailCache = {};
 cache.plaintextCache = {}; // cache key -> plaintext
+cache.searchIndexed = {}; // msgID -> true once its search tokens are saved
 
 
 //
@@ -162,7 +173,38 @@ function main() {
     }
 }
 
-function login(failureCb){
+// Logs in with the passphrase hash, plus a code for users with two-factor on.
+// Calls failureCb with the error message and the failed request.
+function login(failureCb, twoFactorCode){
+    var fail = function(xhr){
+        clearCredentials(); 
+        if(failureCb){
+            failureCb(xhr.responseText, xhr);
+        } else {
+            alert("Login failed. Please refresh and try again.");
+        }
+    };
+    if (sessionStorage["session"]) {
+        loadUserAndShowInbox(fail);
+        return;
+    }
+
+    // trade the passphrase hash for a session, so it isn't sent again
+    $.ajax({
+        url: HOST_PREFIX+"/user/me/sessions",
+        type: "POST",
+        headers: twoFactorCode ? {"x-scramble-code": twoFactorCode} : {},
+        dataType: "json"
+    }).done(function(data){
+        sessionStorage["session"] = data.Session;
+        sessionStorage["sessionID"] = data.ID;
+        sessionStorage.removeItem("passHash");
+        sessionStorage.removeItem("passHashOld");
+        loadUserAndShowInbox(fail);
+    }).fail(fail);
+}
+
+function loadUserAndShowInbox(fail){
     $.get(HOST_PREFIX+"/user/me", function(data){
         // (first load after login)
         sessionStorage["emailAddress"] = data.EmailAddress;
@@ -172,16 +214,10 @@ function login(failureCb){
 
         startPgpDecryptWorkers();
         startPgpWorkerWatcher();
+        setInterval(loadBoxCounts, BOX_COUNTS_POLL_MS);
 
         loadDecryptAndShowBox("inbox");
-    }, "json").fail(function(xhr){
-        clearCredentials(); 
-        if(failureCb){
-            failureCb(xhr.responseText);
-        } else {
-            alert("Login failed. Please refresh and try again.");
-        }
-    });
+    }, "json").fail(fail);
 }
 
 function decryptPrivateKey(cipherPrivateKeyHex){
@@ -303,12 +339,15 @@ var keyMap = {
         "c":showContacts,
         "i":function(){loadDecryptAndShowBox("inbox");},
         "s":function(){loadDecryptAndShowBox("sent");},
-        "a":function(){loadDecryptAndShowBox("archive");}
+        "d":function(){loadDecryptAndShowBox("drafts");},
+        "a":function(){loadDecryptAndShowBox("archive");},
+        "t":function(){loadDecryptAndShowBox("trash");}
     },
     "c":showCompose,
     "r":function(){emailReply(viewState.getLastEmailFromAnother());},
     "a":function(){emailReplyAll(viewState.getLastEmail());},
     "f":function(){emailForward(viewState.getLastEmail());},
+    "s":function(){toggleStar(viewState.getLastEmail());},
     "y":function(){threadMove(viewState.getLastEmail(), "archive");},
     "d":function(){threadMove(viewState.getLastEmail(), "trash");},
 };
@@ -354,16 +393,22 @@ function bindKeyboardShortcuts() {
 //
 
 function bindTabEvents() {
-    // Navigate to Inbox, Sent, or Archive
+    // Navigate to Inbox, Sent, Archive or Trash
     $(".js-tab-inbox").click(function(e) {
         loadDecryptAndShowBox("inbox");
     });
     $(".js-tab-sent").click(function(e) {
         loadDecryptAndShowBox("sent");
     });
+    $(".js-tab-drafts").click(function(e) {
+        loadDecryptAndShowBox("drafts");
+    });
     $(".js-tab-archive").click(function(e) {
         loadDecryptAndShowBox("archive");
     });
+    $(".js-tab-trash").click(function(e) {
+        loadDecryptAndShowBox("trash");
+    });
 
     // Navigate to Compose
     $(".js-tab-compose").click(function(e) {
@@ -375,13 +420,64 @@ function bindTabEvents() {
         showContacts();
     });
 
-    // Log out: click a link, deletes sessionStorage and refreshes the page
+    // Log out: click a link, ends the session, deletes sessionStorage
+    // and refreshes the page
     $("#link-logout").click(function(e) {
+        e.preventDefault();
         if (keepUnsavedWork()) {
-            e.preventDefault();
             return;
         }
-        clearCredentials();
+        var href = $(this).attr("href");
+        $.ajax({
+            url: HOST_PREFIX+"/user/me/sessions/"+sessionStorage["sessionID"],
+            type: "DELETE"
+        }).always(function(){
+            clearCredentials();
+            window.location.href = href;
+        });
+    });
+
+    // Change the passphrase in a modal
+    $("#link-passphrase").click(function(e) {
+        e.preventDefault();
+        var modal = $("#modal-passphrase");
+        modal.find("input").val("");
+        modal.find(".js-passphrase-error").text("");
+        modal.modal("show");
+    });
+    $("#modal-passphrase .js-change-passphrase").click(changePassphrase);
+
+    // Delete the account, after asking for the passphrase again
+    $("#link-delete-account").click(function(e) {
+        e.preventDefault();
+        var modal = $("#modal-delete-account");
+        modal.find("input").val("");
+        modal.find(".js-delete-account-error").text("");
+        modal.modal("show");
+    });
+    $("#modal-delete-account .js-delete-account").click(deleteAccount);
+
+    showBoxCounts();
+}
+
+// Loads how many threads are in each box, and how many are unread
+function loadBoxCounts() {
+    $.get(HOST_PREFIX+"/boxes", function(res) {
+        viewState.boxCounts = res.Boxes;
+        showBoxCounts();
+    }, "json").fail(function(xhr) {
+        console.log("Loading box counts failed: "+xhr.responseText);
+    });
+}
+
+// Badges on the tabs: unread threads, or for drafts, how many there are
+function showBoxCounts() {
+    if (!viewState.boxCounts) return;
+    $(".js-box-count").each(function() {
+        var box = $(this).data("box");
+        var count = viewState.boxCounts[box] || {Total: 0, Unread: 0};
+        var n = box == "drafts" ? count.Total : count.Unread;
+        $(this).text(n > 0 ? n : "");
     });
 }
 
@@ -446,10 +542,15 @@ function bindLoginEvents() {
     $("#enterButton").click(function() {
         var token = $("#token").val();
         var pass = $("#pass").val();
+        var code = trim($("#twoFactorCode").val());
         setAuthTokens(token, pass);
-        login(function(err){
+        login(function(err, xhr){
+            if (xhr && xhr.getResponseHeader("X-Scramble-Two-Factor")) {
+                $(".js-two-factor").show();
+                $("#twoFactorCode").focus();
+            }
             $(".error-signin").text(err);
-        });
+        }, code);
     });
 
     var keys = null;
@@ -522,7 +623,7 @@ function showCreateAccountModal() {
 function createAccount(keys) {
     var token = validateToken();
     if (token === null) return false;
-    var pass = validateNewPassword();
+    var pass = validateNewPassword($("#createPass").val(), $("#confirmPass").val());
     if (pass === null) return false;
     var secondaryEmail = trim($("#secondaryEmail").val());
     
@@ -574,9 +675,63 @@ function validateToken() {
     }
 }
 
-function validateNewPassword() {
-    var pass1 = $("#createPass").val();
-    var pass2 = $("#confirmPass").val();
+// Re-encrypts the private key and contacts with a new passphrase.
+// The server swaps them and the passphrase hash at once, and ends every
+// session, so this one switches to the new session it sends back.
+function changePassphrase() {
+    var modal = $("#modal-passphrase");
+    var token = sessionStorage["token"];
+    var oldPass = modal.find(".js-old-pass").val();
+    var pass = validateNewPassword(modal.find(".js-new-pass").val(), modal.find(".js-confirm-pass").val());
+    if (pass === null) return;
+    var passKey = computeAesKey(token, pass);
+
+    getContacts(function(contacts) {
+        var data = {
+            oldPassHash: computeAuth(token, oldPass),
+            oldPassHashOld: computeAuthOld(token, oldPass),
+            passHash: computeAuth(token, pass),
+            cipherPrivateKey: bin2hex(passphraseEncrypt(sessionStorage["privateKeyArmored"], passKey)),
+            code: modal.find(".js-passphrase-code").val().trim()
+        };
+        var jsonContacts = JSON.stringify({
+            version:  CONTACTS_VERSION,
+            contacts: contacts,
+        });
+        data.cipherContacts = bin2hex(passphraseEncrypt(jsonContacts, passKey));
+        $.post(HOST_PREFIX+"/user/me/passphrase", data, function(res) {
+            sessionStorage["passKey"] = passKey;
+            sessionStorage.removeItem("passKeyOld");
+            sessionStorage["session"] = res.Session;
+            sessionStorage["sessionID"] = res.ID;
+            modal.modal("hide");
+            showStatus("Passphrase changed");
+        }, "json").fail(function(xhr) {
+            modal.find(".js-passphrase-error").text(xhr.responseText);
+        });
+    });
+}
+
+// Closes the account for good. The server deletes all of the user's mail
+// and keys, and tells the notaries the name is gone.
+function deleteAccount() {
+    var modal = $("#modal-delete-account");
+    var token = sessionStorage["token"];
+    var pass = modal.find(".js-delete-pass").val();
+    var data = {
+        passHash: computeAuth(token, pass),
+        passHashOld: computeAuthOld(token, pass),
+        code: modal.find(".js-delete-code").val().trim()
+    };
+    $.post(HOST_PREFIX+"/user/me/delete", data, function() {
+        clearCredentials();
+        window.location.href = "/";
+    }).fail(function(xhr) {
+        modal.find(".js-delete-account-error").text(xhr.responseText);
+    });
+}
+
+function validateNewPassword(pass1, pass2) {
     if (pass1 != pass2) {
         alert("Passphrases must match");
         return null;
@@ -597,19 +752,66 @@ function validateNewPassword() {
 //
 
 function bindBoxEvents() {
-    // Click on an email to open it
+    // Click on an email (or draft) to open it
     $("#box .js-item").click(function(e) {
-        showEmail($(e.currentTarget));
+        showEmailOrContact($(e.currentTarget));
     });
     // Click on a pagination link
     $("#box .box-pagination a").click(function(e) {
         var box = $(this).data("box");
         var page = $(this).data("page");
-        loadDecryptAndShowBox(box, page);
+        if (viewState.box == "search") {
+            searchAndShowBox(viewState.searchQuery, page);
+        } else {
+            loadDecryptAndShowBox(box, page);
+        }
+        return false;
+    });
+    $("#box .js-search-form").submit(function(e) {
+        searchAndShowBox($(this).find(".js-search-query").val());
+        return false;
+    });
+    $("#box .js-empty-trash").click(function(e) {
+        emptyTrash();
+        return false;
+    });
+    $("#box .js-mark-box-read").click(function(e) {
+        markBoxRead(viewState.box);
         return false;
     });
 }
 
+// Marks every message in the box read, not just the page shown
+function markBoxRead(box) {
+    $.ajax({
+        url: HOST_PREFIX+'/box/'+encodeURIComponent(box),
+        type: 'PUT',
+        data: {isRead: "true"},
+        dataType: 'json'
+    }).done(function(res) {
+        $("#box .js-item").addClass("js-read").removeClass("js-unread");
+        showStatus("Marked "+res.Marked+" messages read");
+        loadBoxCounts();
+    }).fail(function(xhr) {
+        alert("Marking "+box+" read failed: "+xhr.responseText);
+    });
+}
+
+// Deletes everything in the trash. Unlike moving to the trash, there is no undo.
+function emptyTrash() {
+    if (!confirm("Delete everything in the trash for good?")) return;
+    $.ajax({
+        url: HOST_PREFIX+'/box/trash',
+        type: 'DELETE',
+        dataType: 'json'
+    }).done(function(res) {
+        showStatus("Deleted "+res.Deleted+" messages");
+        loadDecryptAndShowBox("trash");
+    }).fail(function(xhr) {
+        alert("Emptying the trash failed: "+xhr.responseText);
+    });
+}
+
 function loadDecryptAndShowBox(box, page) {
     if (keepUnsavedWork()) { return; }
     box = box || "inbox";
@@ -621,6 +823,7 @@ function loadDecryptAndShowBox(box, page) {
             console.log("Decrypting and showing "+box);
             showEncryptedBox(summary, box);
             startDecryptingBox(summary);
+            loadBoxCounts();
         }, 'json').fail(function(xhr) {
             alert(xhr.responseText || "Could not reach the server, try again");
         }
@@ -640,7 +843,9 @@ function showEncryptedBox(boxSummary, box) {
         total:        boxSummary.Total,
         page:         Math.floor(boxSummary.Offset / boxSummary.Limit)+1,
         totalPages:   Math.ceil(boxSummary.Total / boxSummary.Limit),
-        emailHeaders: boxSummary.EmailHeaders.map(createEmailViewModel)
+        emailHeaders: boxSummary.EmailHeaders.map(createEmailViewModel),
+        isDrafts:     box == "drafts",
+        searchQuery:  box == "search" ? viewState.searchQuery : ""
     };
     var pages = [];
     for (var i=0; i<data.totalPages; i++) {
@@ -658,6 +863,11 @@ function showEncryptedBox(boxSummary, box) {
 // Asynchronously decrypts a box (eg inbox and sent). Uses Web Workers.
 function startDecryptingBox(boxSummary, box) {
     getContacts(function() {
+        // Drafts open in Compose, there are no threads to prefetch
+        if (boxSummary.Box == "drafts") {
+            boxSummary.EmailHeaders.forEach(decryptDraftSubject);
+            return;
+        }
         // Start decrypting the subjects
         boxSummary.EmailHeaders.forEach(decryptSubject);
         // Start prefetching and decrypting the bodies
@@ -665,19 +875,73 @@ function startDecryptingBox(boxSummary, box) {
     });
 }
 
+// Lists the threads with every word of the query, in any box but the trash.
+// Only finds mail this user has opened or prefetched since search came in,
+// since the client indexes messages as it decrypts them.
+function searchAndShowBox(query, page) {
+    var tokens = computeSearchTokens(query, getSearchKey()).slice(0, MAX_SEARCH_TERMS);
+    if (tokens.length === 0) {
+        loadDecryptAndShowBox("inbox");
+        return;
+    }
+    if (keepUnsavedWork()) { return; }
+    page = page || 1;
+    $.ajax({
+        url: HOST_PREFIX+"/search/",
+        data: { token: tokens, offset: (page-1)*BOX_PAGE_SIZE, limit: BOX_PAGE_SIZE },
+        traditional: true,
+        dataType: 'json'
+    }).done(function(summary) {
+        viewState.searchQuery = query;
+        showEncryptedBox(summary, "search");
+        startDecryptingBox(summary);
+    }).fail(function(xhr) {
+        alert(xhr.responseText || "Could not reach the server, try again");
+    });
+}
+
+// Saves search tokens for the words of a decrypted email,
+// once per session. The server only ever sees the tokens.
+function indexEmail(email) {
+    if (cache.searchIndexed[email.msgID]) { return; }
+    cache.searchIndexed[email.msgID] = true;
+    var text = email.plainSubject+" "+email.plainBody;
+    var tokens = computeSearchTokens(text, getSearchKey()).slice(0, MAX_SEARCH_TOKENS);
+    $.ajax({
+        url: HOST_PREFIX+'/search/'+encodeURIComponent(email.msgID),
+        type: 'PUT',
+        data: { token: tokens },
+        traditional: true
+    }).fail(function(xhr) {
+        delete cache.searchIndexed[email.msgID];
+        console.log("Indexing "+email.msgID+" for search failed: "+xhr.responseText);
+    });
+}
+
 function decryptSubject(h) {
     cachedDecryptPgp(h.ThreadID+" subject", h.CipherSubject, null, function(subject){
-        if (subject === null) {
-            subject = "(Decryption failed)";
-        } else if (trim(subject)==="") {
-            subject = "(No subject)";
-        }
-        var hexMsgID = bin2hex(h.MessageID);
-        $("#subject-"+hexMsgID).removeClass("still-decrypting").text(subject);
-        $("#subject-header-"+hexMsgID).removeClass("still-decrypting").text(subject);
+        showSubject(h, subject);
+    });
+}
+
+// Drafts get saved over, so their subjects are cached by when they were saved
+function decryptDraftSubject(h) {
+    cachedDecryptPgp("draft "+h.MessageID+" "+h.UnixTime+" subject", h.CipherSubject, null, function(subject){
+        showSubject(h, subject);
     });
 }
 
+function showSubject(h, subject) {
+    if (subject === null) {
+        subject = "(Decryption failed)";
+    } else if (trim(subject)==="") {
+        subject = "(No subject)";
+    }
+    var hexMsgID = bin2hex(h.MessageID);
+    $("#subject-"+hexMsgID).removeClass("still-decrypting").text(subject);
+    $("#subject-header-"+hexMsgID).removeClass("still-decrypting").text(subject);
+}
+
 function prefetchAndDecryptThread(h){
     cachedLoadThread({msgID:h.MessageID, threadID:h.ThreadID}, function(emails) {
         console.log("Prefetched thread, # emails: "+emails.length);
@@ -712,6 +976,8 @@ function showPrevItem() {
 function showEmailOrContact(item) {
     if (item.hasClass("js-box-item")) {
         showEmail(item);
+    } else if (item.hasClass("js-draft-item")) {
+        showDraft(item.data("msgId"));
     } else if(item.hasClass("js-contact-item")) {
         showContact(item);
     } else {
@@ -739,6 +1005,16 @@ function bindEmailEvents() {
     $(".js-email-control .js-reply-button").click(withEmail(emailReply));
     $(".js-email-control .js-reply-all-button").click(withEmail(emailReplyAll));
     $(".js-email-control .js-forward-button").click(withEmail(emailForward));
+    $(".js-email .js-star-button").click(withEmail(toggleStar));
+    $(".js-email .js-message-unread-button").click(withEmail(function(email){
+        messageUpdate(email, {isRead: "false"}, "Marked unread");
+    }));
+    $(".js-email .js-message-delete-button").click(withEmail(function(email){
+        messageUpdate(email, {box: "trash"}, "Moved to trash");
+    }));
+    $(".js-email .js-message-restore-button").click(withEmail(function(email){
+        messageUpdate(email, {restore: "true"}, "Restored");
+    }));
     $(".email .js-enter-add-contact-button").click(addContact);
 
     var withLastEmail = function(cb) {
@@ -764,6 +1040,7 @@ function bindEmailEvents() {
     $(".js-thread-control .js-delete-button").click(withLastEmail(function(email){
         threadMove(email, "trash");
     }));
+    $(".js-thread-control .js-restore-button").click(withLastEmail(threadRestore));
 
     $(".js-show-orig").click(toggleShowOriginal);
 }
@@ -931,6 +1208,9 @@ function decryptAndVerifyEmail(email, keyMap, cb) {
             email.plainSubject = "(Encrypted message)";
             email.plainBody = plain;
         }
+        if (parsedBody.ok) {
+            indexEmail(email);
+        }
         if (email.plainBody) {
             email.htmlBody = createHyperlinks(email.plainBody);
         } else {
@@ -960,6 +1240,8 @@ function createEmailViewModel(data) {
         toAddresses:   toAddresses,
         hexMsgID:      bin2hex(data.MessageID),
         isRead:        data.IsRead,
+        flags:         data.Flags || [],
+        isStarred:     (data.Flags || []).indexOf("starred") >= 0,
         cipherSubject: data.CipherSubject,
         cipherBody:    data.CipherBody,
         // following are decrypted asynchronously
@@ -1016,7 +1298,7 @@ function markAsRead(emails, isRead){
         type: 'PUT',
         data: {isRead: isRead},
     }).done(function() {
-        // Marked as read
+        if (changed) loadBoxCounts();
     }).fail(function(xhr) {
         console.log("Marking thread for "+msgID+" as "+
         	(isRead?"read":"unread")+" failed: "+xhr.responseText);
@@ -1047,10 +1329,43 @@ function createHyperlinks(text) {
     return safeParts.join("");
 }
 
+// Stars or unstars one email of a thread.
+// The box shows a thread as starred if any of its emails is.
+function toggleStar(email) {
+    if (!email) return;
+    var isStarred = !email.isStarred;
+    setEmailFlag(email, "starred", isStarred, function() {
+        email.isStarred = isStarred;
+        var elEmail = getEmailElement(email.msgID);
+        if (elEmail) {
+            elEmail.find(".js-star-button").html(isStarred ? "&#9733;" : "&#9734;");
+        }
+        var threadStarred = $(".js-email").toArray().some(function(el) {
+            return $(el).data("email").isStarred;
+        });
+        $(".js-box-item.active .js-star").html(threadStarred ? "&#9733;" : "");
+    });
+}
+
+// Sets or clears a flag, eg "starred", on just the one email
+function setEmailFlag(email, flag, isSet, cb) {
+    var params = {messageOnly: "true"};
+    params[isSet ? "addFlags" : "removeFlags"] = flag;
+    $.ajax({
+        url: HOST_PREFIX+'/email/'+encodeURIComponent(email.msgID),
+        type: 'PUT',
+        data: params,
+    }).done(function() {
+        if (cb) cb();
+    }).fail(function(xhr) {
+        console.log("Flagging "+email.msgID+" as "+flag+" failed: "+xhr.responseText);
+    });
+}
+
 function emailReply(email) {
     if (!email) return;
     var replyTo = email.fromAddress.name || email.fromAddress.address;
-    showComposeInline(email, replyTo, email.plainSubject, undefined);
+    showComposeInline(email, replyTo, email.plainSubject, undefined, "answered");
 }
 
 function emailReplyAll(email) {
@@ -1070,27 +1385,33 @@ function emailReplyAll(email) {
     var replyTo = allRecipientsExceptMe.map(function(addr) {
         return addr.name || addr.address;
     }).join(",");
-    showComposeInline(email, replyTo, email.plainSubject, undefined);
+    showComposeInline(email, replyTo, email.plainSubject, undefined, "answered");
 }
 
 function emailForward(email) {
     if (!email) return;
-    showComposeInline(email, "", email.plainSubject, email.plainBody);
+    showComposeInline(email, "", email.plainSubject, email.plainBody, "forwarded");
 }
 
 // Moves all emails in box for thread up to email.unixTime.
 // That way, server doesn't move new emails that the user hasn't seen.
+// Moving to the trash can be undone with threadRestore.
 function threadMove(email, box) {
+    threadUpdate(email, box, {box: box}, "Moved to "+box);
+}
+
+// Moves a thread in the trash back to the boxes it came from.
+function threadRestore(email) {
+    threadUpdate(email, "restore", {restore: "true"}, "Restored");
+}
+
+function threadUpdate(email, box, params, doneStatus) {
     if (!email) return;
     if (keepUnsavedWork()) return;
     // Do nothing if already moved.
     if (email._movedToBox == box) {
         return;
     }
-    // Confirm if deleting
-    if (box == "trash") {
-		if (!confirm("Are you sure you want to delete this thread?")) return;
-    }
     // Disable buttons while moving
     email._movedToBox = box;
     var elEmail = getEmailElement(email.msgID);
@@ -1102,9 +1423,6 @@ function threadMove(email, box) {
 	elThread.find(".js-thread-control button").prop("disabled", true);
     
     // Send request
-    var params = {
-        box: box
-    };
     $.ajax({
         url: HOST_PREFIX+'/email/'+encodeURIComponent(email.msgID),
         type: 'PUT',
@@ -1112,9 +1430,41 @@ function threadMove(email, box) {
     }).done(function() {
         $("#thread").remove();
         showNextThread();
-        showStatus("Moved to "+box);
+        showStatus(doneStatus);
+    }).fail(function(xhr) {
+        alert(doneStatus+" failed: "+xhr.responseText);
+    });
+}
+
+// Like threadUpdate, but for just the one email of the thread.
+// It leaves the thread view once it's no longer in the box.
+function messageUpdate(email, params, doneStatus) {
+    if (!email) return;
+    params.messageOnly = "true";
+    $.ajax({
+        url: HOST_PREFIX+'/email/'+encodeURIComponent(email.msgID),
+        type: 'PUT',
+        data: params,
+        dataType: 'json'
+    }).done(function(res) {
+        if (params.isRead === "false") {
+            $(".js-box-item.active").addClass("js-unread").removeClass("js-read");
+        }
+        // search lists mail in any box but the trash
+        var stillListed = viewState.box == "search" ?
+            res.Boxes.some(function(box) { return box != "trash"; }) :
+            res.Boxes.indexOf(viewState.box) >= 0;
+        if (!stillListed) {
+            var elEmail = getEmailElement(email.msgID);
+            if (elEmail) elEmail.remove();
+            if ($("#thread .js-email").length === 0) {
+                $("#thread").remove();
+                showNextThread();
+            }
+        }
+        showStatus(doneStatus);
     }).fail(function(xhr) {
-        alert("Move to "+box+" failed: "+xhr.responseText);
+        alert(doneStatus+" failed: "+xhr.responseText);
     });
 }
 
@@ -1145,12 +1495,20 @@ function showNextThread() {
 // cb: function(emailData), emailData has plaintext components including
 //  msgID, threadID, ancestorIDs, subject, to, body...
 function bindComposeEvents(elCompose, cb) {
+    // A draft keeps its message id when it's sent. Otherwise,
+    // generate 160-bit (20 byte) message id
+    // secure random generator, so it will be unique
+    if (!elCompose.find("[name='msgID']").val()) {
+        elCompose.find("[name='msgID']").val(
+            bin2hex(openpgp_crypto_getRandomBytes(20))+"@"+window.location.hostname);
+    }
+    bindDraftEvents(elCompose);
+
     elCompose.find(".js-send-button").on('click', function() {
         $(this).prop("disabled", true);
+        stopDraftSaves(elCompose);
 
-        // generate 160-bit (20 byte) message id
-        // secure random generator, so it will be unique
-        var msgID = bin2hex(openpgp_crypto_getRandomBytes(20))+"@"+window.location.hostname;
+        var msgID       = elCompose.find("[name='msgID']").val();
         var threadID    = elCompose.find("[name='threadID']").val() || msgID;
         var ancestorIDs = elCompose.find("[name='ancestorIDs']").val() || "";
         var subject     = elCompose.find("[name='subject']").val();
@@ -1171,11 +1529,13 @@ function bindComposeEvents(elCompose, cb) {
                 alert(error);
             }
             elCompose.find(".js-send-button").prop("disabled", false);
+            elCompose.data("draftStopped", false);
         });
     });
 }
 
-function showCompose(to, subject, body) {
+// draft is optional, the draft to carry on with
+function showCompose(to, subject, body, draft) {
     if (keepUnsavedWork()) { return; }
     if (body === undefined) {
         body = DEFAULT_SIGNATURE;
@@ -1190,16 +1550,21 @@ function showCompose(to, subject, body) {
     // Go to Compose tab
     setSelectedTab($(".js-tab-compose"));
 
-    showComposeStandalone(to, subject, body);
+    showComposeStandalone(to, subject, body, draft);
 }
 
 // Shows the standalone compose screen--
 // in other words, not part of an existing email thread
-function showComposeStandalone(to, subject, body){
+function showComposeStandalone(to, subject, body, draft){
+    draft = draft || {};
     var elCompose = $(render("compose-template", {
-        to:          to,
-        subject:     subject,
-        body:        body,
+        to:           to,
+        subject:      subject,
+        body:         body,
+        msgID:        draft.MessageID,
+        threadID:     draft.ThreadID,
+        ancestorIDs:  draft.AncestorIDs,
+        draftVersion: draft.Version,
     }));
     $("#content").empty().append(elCompose);
     bindComposeEvents(elCompose, function(emailData) {
@@ -1208,7 +1573,8 @@ function showComposeStandalone(to, subject, body){
     });
 }
 
-function showComposeInline(email, to, subject, body) {
+// flag: set on email once sent, "answered" or "forwarded"
+function showComposeInline(email, to, subject, body, flag) {
     var elEmail = $("#thread-emails");
     var bodyDefault;
     if (body !== undefined) {
@@ -1245,6 +1611,7 @@ function showComposeInline(email, to, subject, body) {
     // Bind events (eg Send button)
     bindComposeEvents(elCompose, function(emailData) {
         showStatus("Sent");
+        setEmailFlag(email, flag, true);
         showEmail(emailData);
     });
 
@@ -1591,6 +1958,134 @@ function sendEmailPost(data, cb, failCb) {
 
 
 
+//
+// DRAFTS
+//
+
+// How long after the user stops typing a draft is saved
+var DRAFT_SAVE_DELAY_MS = 3000;
+
+function bindDraftEvents(elCompose) {
+    elCompose.find("input[type='text'], textarea").on("input", function() {
+        scheduleDraftSave(elCompose);
+    });
+    elCompose.find(".js-discard-button").on("click", function() {
+        discardDraft(elCompose);
+    });
+}
+
+function scheduleDraftSave(elCompose) {
+    if (elCompose.data("draftStopped")) return;
+    clearTimeout(elCompose.data("draftTimer"));
+    elCompose.data("draftTimer", setTimeout(function() {
+        saveDraft(elCompose);
+    }, DRAFT_SAVE_DELAY_MS));
+}
+
+// Stops autosaving, eg while the email is being sent
+function stopDraftSaves(elCompose) {
+    clearTimeout(elCompose.data("draftTimer"));
+    elCompose.data("draftStopped", true);
+}
+
+// Saves the draft, encrypted for ourselves only.
+// Sends the version we last saved, so that if another tab saved
+// the same draft since, this save fails instead of overwriting it.
+function saveDraft(elCompose) {
+    if (elCompose.data("draftStopped")) return;
+    if (elCompose.data("draftSaving")) {
+        // one save at a time, the next needs this one's version
+        elCompose.data("draftSaveAgain", true);
+        return;
+    }
+    var msgID   = elCompose.find("[name='msgID']").val();
+    var version = elCompose.find("[name='draftVersion']").val();
+    var subject = elCompose.find("[name='subject']").val();
+    var body    = elCompose.find("[name='body']").val();
+    var privateKey = getPrivateKey();
+    var publicKey = getPublicKey();
+    var data = {
+        msgID:         msgID,
+        threadID:      elCompose.find("[name='threadID']").val() || msgID,
+        ancestorIDs:   elCompose.find("[name='ancestorIDs']").val() || "",
+        to:            elCompose.find("[name='to']").val(),
+        cipherSubject: openpgp.write_signed_and_encrypted_message(privateKey[0], publicKey, subject),
+        cipherBody:    openpgp.write_signed_and_encrypted_message(privateKey[0], publicKey, body)
+    };
+    if (version) {
+        data.version = version;
+    }
+
+    elCompose.data("draftSaving", true);
+    $.ajax({
+        url:      HOST_PREFIX+"/drafts/"+(version ? encodeURIComponent(msgID) : ""),
+        type:     version ? "PUT" : "POST",
+        data:     data,
+        dataType: "json"
+    }).done(function(res) {
+        elCompose.find("[name='draftVersion']").val(res.Version);
+        // what's saved isn't lost when the user leaves
+        elCompose.find("textarea[data-default]").data("default", body);
+        elCompose.find(".js-draft-status").text("Draft saved "+moment().format("LT"));
+    }).fail(function(xhr) {
+        if (xhr.status == 409 || xhr.status == 404) {
+            // saved from another tab, sent, or discarded
+            stopDraftSaves(elCompose);
+            elCompose.find(".js-draft-status").text("Draft changed elsewhere, no longer saving");
+        } else {
+            elCompose.find(".js-draft-status").text("Saving the draft failed");
+        }
+    }).always(function() {
+        elCompose.data("draftSaving", false);
+        if (elCompose.data("draftSaveAgain")) {
+            elCompose.data("draftSaveAgain", false);
+            saveDraft(elCompose);
+        }
+    });
+}
+
+function discardDraft(elCompose) {
+    if (!confirm("Discard this draft?")) return;
+    stopDraftSaves(elCompose);
+    var msgID   = elCompose.find("[name='msgID']").val();
+    var version = elCompose.find("[name='draftVersion']").val();
+    var done = function() {
+        elCompose.find("[data-default]").removeAttr("data-default");
+        showStatus("Draft discarded");
+        loadDecryptAndShowBox("drafts");
+    };
+    if (!version) {
+        return done();
+    }
+    $.ajax({
+        url:  HOST_PREFIX+"/drafts/"+encodeURIComponent(msgID),
+        type: "DELETE"
+    }).done(done).fail(function(xhr) {
+        alert("Discarding the draft failed: "+xhr.responseText);
+    });
+}
+
+// Loads a draft and carries on with it in Compose
+function showDraft(msgID) {
+    if (keepUnsavedWork()) { return; }
+    $.get(HOST_PREFIX+"/drafts/"+encodeURIComponent(msgID), function(draft) {
+        var cacheKey = "draft "+draft.MessageID+" "+draft.UnixTime;
+        cachedDecryptPgp(cacheKey+" subject", draft.CipherSubject, null, function(subject) {
+            cachedDecryptPgp(cacheKey+" body", draft.CipherBody, null, function(body) {
+                if (subject === null || body === null) {
+                    alert("Could not decrypt the draft");
+                    return;
+                }
+                showCompose(draft.To, subject, body, draft);
+            });
+        });
+    }, "json").fail(function(xhr) {
+        alert(xhr.responseText || "Could not reach the server, try again");
+    });
+}
+
+
+
 //
 // CONTACTS
 //
@@ -2316,10 +2811,41 @@ function computeAuthOld(token, pass) {
     return new jsSHA("1"+token+pass, "ASCII").getHash("SHA-1", "HEX");
 }
 
+// Derives the key for search tokens from the private key, which only
+// the user has, and which stays the same if they change their passphrase
+// Returns 256-bit hex
+function getSearchKey() {
+    if (!sessionStorage["searchKey"]) {
+        sessionStorage["searchKey"] = new jsSHA("3"+sessionStorage["privateKeyArmored"], "ASCII")
+            .getHash("SHA-256", "HEX");
+    }
+    return sessionStorage["searchKey"];
+}
+
+// Splits text into its distinct words, lowercase
+function searchWords(text) {
+    return (text || "").toLowerCase()
+        .split(/[^a-z0-9\u00c0-\uffff]+/)
+        .filter(function(word) { return word.length >= 2; })
+        .unique();
+}
+
+// A blind index of the words in text: the HMAC-SHA256 of each word,
+// so the server can match words without learning what they are
+// Returns a list of 256-bit hex
+function computeSearchTokens(text, searchKey) {
+    return searchWords(text).map(function(word) {
+        var utf8 = unescape(encodeURIComponent(word));
+        return new jsSHA(utf8, "ASCII").getHMAC(searchKey, "HEX", "SHA-256", "HEX");
+    });
+}
+
 // Symmetric encryption using a key derived from the user's passphrase
-// The user must be logged in: the key must be in sessionStorage
-function passphraseEncrypt(plainText) {
-    if (!sessionStorage["passKey"] || sessionStorage["passKey"] == "undefined") {
+// The user must be logged in: the key must be in sessionStorage,
+// unless passKey is given, see changePassphrase
+function passphraseEncrypt(plainText, passKey) {
+    passKey = passKey || sessionStorage["passKey"];
+    if (!passKey || passKey == "undefined") {
         alert("Missing passphrase. Please log out and back in.");
         return null;
     }
@@ -2328,7 +2854,7 @@ function passphraseEncrypt(plainText) {
     return openpgp_crypto_symmetricEncrypt(
         prefixRandom, 
         ALGO_AES128, 
-        sessionStorage["passKey"], 
+        passKey, 
         plainText);
 }
 
@@ -2517,6 +3043,10 @@ function initAjaxAuth() {
     $.ajaxSetup({
         // http://stackoverflow.com/questions/7686827/how-can-i-add-a-custom-http-header-to-ajax-request-with-js-or-jquery
         beforeSend: function(xhr) {
+            if (sessionStorage["session"]) {
+                xhr.setRequestHeader('x-scramble-session', sessionStorage["session"]);
+                return;
+            }
             xhr.setRequestHeader('x-scramble-token', sessionStorage["token"]);
             xhr.setRequestHeader('x-scramble-passHash', sessionStorage["passHash"]);
             xhr.setRequestHeader('x-scramble-passHashOld', sessionStorage["passHashOld"]);
@@ -20,6 +20,15 @@ tests.key = function() {
     assertEquals(bin2hex(key), "9c2a7d2518c5bc0b7ebdba72b8d7c71e")
 }
 
+tests.searchTokens = function() {
+    var key = "0000000000000000000000000000000000000000000000000000000000000001";
+    assertEquals(searchWords("Hello, hello CAFÉ a").join(" "), "hello café");
+    var tokens = computeSearchTokens("Hello, hello CAFÉ a", key);
+    assertEquals(tokens.length, 2);
+    assertEquals(tokens[0], "63affb6372f2302775e4c6e799f38aa4e20ec9823f4a75a19262204cd9ee4a7c");
+    assertEquals(tokens[1], "f6fe92ff904863f53d84a4bb7e821b51c498922277407bec6cb468662129a085");
+}
+
 tests.addContacts = function() {
 
     // normal add